@@ -4,14 +4,84 @@ import (
 	"fmt"
 	"github.com/fluent/fluent-bit-go/output"
 	log "github.com/sirupsen/logrus"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 )
 
+// instanceCount is the number of output instances whose configuration has been parsed
+var instanceCount int
+
 type PluginConfig struct {
 	NRClientConfig   NRClientConfig
 	DataFormatConfig DataFormatConfig
 	ProxyConfig      ProxyConfig
+	Routes           []RouteConfig
+	LogsToMetrics    []LogToMetricConfig
+	// ShutdownTimeout is the maximum time to wait for the in-flight sends when the plugin exits
+	ShutdownTimeout time.Duration
+	Quarantine      QuarantineConfig
+}
+
+// QuarantineConfig defines where the records making the plugin panic are stored. If no directory is configured,
+// they are only logged.
+type QuarantineConfig struct {
+	Dir      string
+	MaxBytes int64
+}
+
+// Enabled returns true if the quarantined records are stored on disk
+func (cfg QuarantineConfig) Enabled() bool {
+	return len(cfg.Dir) > 0
+}
+
+// RouteConfig sends the records matching an expression to a different New Relic account or endpoint. The
+// records not matching any route are sent using the top-level configuration (the default route).
+type RouteConfig struct {
+	Name           string
+	Match          string
+	NRClientConfig NRClientConfig
+}
+
+// LogToMetricType is the kind of metric derived from the log records
+type LogToMetricType int64
+
+const (
+	// LogToMetricCount counts the matching records, or adds up the value attribute if configured
+	LogToMetricCount LogToMetricType = iota
+	// LogToMetricGauge reports the last value attribute of the matching records
+	LogToMetricGauge
+	// LogToMetricSummary reports the count, sum, min and max of the value attribute of the matching records
+	LogToMetricSummary
+)
+
+func (t LogToMetricType) String() string {
+	switch t {
+	case LogToMetricCount:
+		return "count"
+	case LogToMetricGauge:
+		return "gauge"
+	case LogToMetricSummary:
+		return "summary"
+	}
+	return "unknown"
+}
+
+// LogToMetricConfig derives a metric from the records matching an expression, which is sent to the Metric API
+type LogToMetricConfig struct {
+	Name  string
+	Match string
+	// Metric is the name of the derived metric
+	Metric string
+	Type   LogToMetricType
+	// ValueKey is the attribute the metric value is taken from
+	ValueKey string
+	// Dimensions are the attributes added as dimensions to the metric
+	Dimensions []string
+	// DropLogs discards the matching records once the metric has been derived
+	DropLogs bool
 }
 
 type CompressionType int64
@@ -20,6 +90,10 @@ const (
 	Unknown CompressionType = iota
 	Gzip    CompressionType = iota
 	Zstd
+	// Deflate compresses the payloads in the zlib format, as expected by the deflate Content-Encoding
+	Deflate
+	// NoCompression sends the payloads uncompressed, for debugging or local endpoints
+	NoCompression
 )
 
 func (s CompressionType) String() string {
@@ -28,6 +102,95 @@ func (s CompressionType) String() string {
 		return "gzip"
 	case Zstd:
 		return "zstd"
+	case Deflate:
+		return "deflate"
+	case NoCompression:
+		return "none"
+	}
+	return "unknown"
+}
+
+// ContentEncoding returns the value of the Content-Encoding header of the payloads, or an empty string if they are
+// not compressed
+func (s CompressionType) ContentEncoding() string {
+	if s == NoCompression {
+		return ""
+	}
+	return s.String()
+}
+
+// maxLevel returns the maximum compression level of the codec, or 0 if it doesn't support levels
+func (s CompressionType) maxLevel() int {
+	switch s {
+	case Gzip, Deflate:
+		return 9
+	case Zstd:
+		return 22
+	}
+	return 0
+}
+
+// OutputFormat is the format of the payloads sent to New Relic
+type OutputFormat int64
+
+const (
+	// JsonFormat sends the records to the Log API as JSON
+	JsonFormat OutputFormat = iota
+	// OtlpFormat sends the records to the OTLP endpoint as OTLP/HTTP protobuf-encoded logs
+	OtlpFormat
+	// EventFormat sends the records to the Event API as custom events
+	EventFormat
+)
+
+func (f OutputFormat) String() string {
+	switch f {
+	case JsonFormat:
+		return "json"
+	case OtlpFormat:
+		return "otlp"
+	case EventFormat:
+		return "event"
+	}
+	return "unknown"
+}
+
+// supportsCompression returns true if the endpoints receiving the format accept the compression codec
+func (f OutputFormat) supportsCompression(compression CompressionType) bool {
+	switch f {
+	case OtlpFormat:
+		return compression == Gzip || compression == NoCompression
+	case EventFormat:
+		return compression == Gzip || compression == Deflate || compression == NoCompression
+	}
+	return true
+}
+
+const (
+	defaultLogsEndpoint = "https://log-api.newrelic.com/log/v1"
+	defaultOtlpEndpoint = "https://otlp.nr-data.net/v1/logs"
+	// eventsEndpointFormat is the US Event API endpoint, which includes the account ID
+	eventsEndpointFormat = "https://insights-collector.newrelic.com/v1/accounts/%s/events"
+
+	defaultEventType = "FluentBitEvent"
+	maxEventTypeLen  = 255
+)
+
+type RateLimitAction int64
+
+const (
+	RateLimitRetry RateLimitAction = iota
+	RateLimitDrop
+	RateLimitSpill
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitRetry:
+		return "retry"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitSpill:
+		return "spill"
 	}
 	return "unknown"
 }
@@ -39,11 +202,228 @@ type NRClientConfig struct {
 	UseApiKey      bool
 	TimeoutSeconds int
 	SendMetrics    bool
-	Compression    CompressionType
+	// MetricsHarvestPeriod is the interval between harvests of the troubleshooting metrics
+	MetricsHarvestPeriod time.Duration
+	MetricsEndpoint      MetricsEndpointConfig
+	Compression          CompressionType
+	// CompressionLevel is the level of the compression codec, 0 meaning the default level of the codec
+	CompressionLevel int
+	OutputFormat     OutputFormat
+	Event            EventConfig
+	RateLimit        RateLimitConfig
+	Mirrors          []MirrorConfig
+	Failover         FailoverConfig
+	CircuitBreaker   CircuitBreakerConfig
+	Prometheus       PrometheusConfig
+}
+
+// EventConfig defines how the records are converted to custom events when using the event output format
+type EventConfig struct {
+	// EventType is the type of the events whose record has no valid EventTypeKey attribute
+	EventType string
+	// EventTypeKey is the record attribute the event type is taken from, if any
+	EventTypeKey string
+}
+
+// IsValidEventType returns true if the event type is accepted by the Event API: a non-empty string of up to 255
+// alphanumeric, underscore or colon characters
+func IsValidEventType(eventType string) bool {
+	if len(eventType) == 0 || len(eventType) > maxEventTypeLen {
+		return false
+	}
+	for _, r := range eventType {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricsEndpointConfig overrides the Metric API endpoint inferred from the Log API endpoint to send the
+// troubleshooting metrics, optionally with its own credentials
+type MetricsEndpointConfig struct {
+	Endpoint   string
+	ApiKey     string
+	LicenseKey string
+	UseApiKey  bool
+}
+
+// HasCredentials returns true if credentials specific to the Metric API endpoint have been configured
+func (cfg MetricsEndpointConfig) HasCredentials() bool {
+	return len(cfg.ApiKey) > 0 || len(cfg.LicenseKey) > 0
+}
+
+// PrometheusConfig exposes the troubleshooting metrics in Prometheus text format through a local HTTP listener
+type PrometheusConfig struct {
+	ListenAddress string
+	// Labels are added to every metric exposed by the output instance (and route)
+	Labels map[string]string
+}
+
+// Enabled returns true if a listen address has been configured
+func (cfg PrometheusConfig) Enabled() bool {
+	return len(cfg.ListenAddress) > 0
+}
+
+// WithLabel returns a copy of the configuration with an additional label
+func (cfg PrometheusConfig) WithLabel(name string, value string) PrometheusConfig {
+	labels := make(map[string]string, len(cfg.Labels)+1)
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	labels[name] = value
+	cfg.Labels = labels
+	return cfg
+}
+
+type CircuitBreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// Enabled returns true if a number of consecutive failures to trip the circuit breaker has been configured
+func (cfg CircuitBreakerConfig) Enabled() bool {
+	return cfg.Threshold > 0
+}
+
+// FailoverConfig defines a secondary endpoint to switch to when the primary one keeps failing
+type FailoverConfig struct {
+	Endpoint string
+	// Credentials used for the secondary endpoint. If none are provided, the primary ones are used.
+	ApiKey        string
+	LicenseKey    string
+	UseApiKey     bool
+	Threshold     int
+	ProbeInterval time.Duration
+}
+
+// Enabled returns true if a secondary endpoint has been configured
+func (cfg FailoverConfig) Enabled() bool {
+	return len(cfg.Endpoint) > 0
+}
+
+// MirrorConfig defines an additional endpoint, with its own credentials, receiving a copy of every payload
+type MirrorConfig struct {
+	Name           string
+	NRClientConfig NRClientConfig
+}
+
+type RateLimitConfig struct {
+	BytesPerSecond   int
+	RecordsPerSecond int
+	Action           RateLimitAction
+	SpillDir         string
+	SpillMaxBytes    int64
+}
+
+// Enabled returns true if at least one of the throughput limits has been configured.
+func (cfg RateLimitConfig) Enabled() bool {
+	return cfg.BytesPerSecond > 0 || cfg.RecordsPerSecond > 0
 }
 
 type DataFormatConfig struct {
-	LowDataMode bool
+	LowDataMode          bool
+	Severity             SeverityConfig
+	ExtractTraceContext  bool
+	ParseNrLinking       bool
+	TagKey               string
+	IncludeEventMetadata bool
+	EventMetadataPrefix  string
+	Types                TypesConfig
+	// FastPath enables transcoding the records straight from msgpack into JSON when no feature needs them as maps
+	FastPath    bool
+	InvalidUtf8 InvalidUtf8Action
+}
+
+// AttributeType is the type an attribute value is coerced to
+type AttributeType int64
+
+const (
+	IntType AttributeType = iota
+	FloatType
+	BoolType
+	StringType
+	// DurationType converts Go durations (such as 1.5s or 250ms) to milliseconds
+	DurationType
+)
+
+func (t AttributeType) String() string {
+	switch t {
+	case IntType:
+		return "int"
+	case FloatType:
+		return "float"
+	case BoolType:
+		return "bool"
+	case StringType:
+		return "string"
+	case DurationType:
+		return "duration"
+	}
+	return "unknown"
+}
+
+// CoercionFailureAction is what to do with the values that can't be coerced to the configured type
+type CoercionFailureAction int64
+
+const (
+	// CoercionKeep leaves the value untouched
+	CoercionKeep CoercionFailureAction = iota
+	// CoercionDrop discards the attribute
+	CoercionDrop
+	// CoercionRaw moves the value to a <key>_raw attribute
+	CoercionRaw
+)
+
+func (a CoercionFailureAction) String() string {
+	switch a {
+	case CoercionKeep:
+		return "keep"
+	case CoercionDrop:
+		return "drop"
+	case CoercionRaw:
+		return "raw"
+	}
+	return "unknown"
+}
+
+// InvalidUtf8Action is what to do with the byte values that aren't valid UTF-8, such as binary fields
+type InvalidUtf8Action int64
+
+const (
+	// InvalidUtf8Replace replaces the invalid sequences with the Unicode replacement character
+	InvalidUtf8Replace InvalidUtf8Action = iota
+	// InvalidUtf8Base64 moves the value, encoded in base64, to a <key>.b64 attribute
+	InvalidUtf8Base64
+	// InvalidUtf8Drop discards the attribute
+	InvalidUtf8Drop
+)
+
+func (a InvalidUtf8Action) String() string {
+	switch a {
+	case InvalidUtf8Replace:
+		return "replace"
+	case InvalidUtf8Base64:
+		return "base64"
+	case InvalidUtf8Drop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// TypesConfig coerces the values of some attributes to a fixed type
+type TypesConfig struct {
+	// Types contains the type of each attribute, keyed by the attribute name (nested ones using dots)
+	Types     map[string]AttributeType
+	OnFailure CoercionFailureAction
+}
+
+type SeverityConfig struct {
+	Normalize   bool
+	AddNumber   bool
+	FromMessage bool
+	// Mapping contains the user-provided level mappings, keyed by the lower-cased original value
+	Mapping map[string]string
 }
 
 type ProxyConfig struct {
@@ -54,14 +434,57 @@ type ProxyConfig struct {
 	ValidateCerts     bool
 }
 
+func parseOutputFormat(str string) (OutputFormat, error) {
+	switch str {
+	case "json", "" /* default to json if unspecified */ :
+		return JsonFormat, nil
+	case "otlp":
+		return OtlpFormat, nil
+	case "event":
+		return EventFormat, nil
+	default:
+		return JsonFormat, fmt.Errorf("unknown output format: %s. Supported: \"json\" (default), \"otlp\", \"event\"", str)
+	}
+}
+
 func parseCompressionType(str string) (CompressionType, error) {
 	switch str {
 	case "gzip", "" /* default to gzip if unspecified */ :
 		return Gzip, nil
 	case "zstd":
 		return Zstd, nil
+	case "deflate":
+		return Deflate, nil
+	case "none":
+		return NoCompression, nil
 	default:
-		return Unknown, fmt.Errorf("unknown compression type: %s. Supported: \"gzip\" (default), \"zstd\"", str)
+		return Unknown, fmt.Errorf("unknown compression type: %s. Supported: \"gzip\" (default), \"zstd\", \"deflate\", \"none\"", str)
+	}
+}
+
+func parseLogToMetricType(str string) (LogToMetricType, error) {
+	switch str {
+	case "count", "" /* default to count if unspecified */ :
+		return LogToMetricCount, nil
+	case "gauge":
+		return LogToMetricGauge, nil
+	case "summary":
+		return LogToMetricSummary, nil
+	default:
+		return LogToMetricCount, fmt.Errorf("unknown metric type: %s. Supported: \"count\" (default), \"gauge\", \"summary\"", str)
+	}
+}
+
+func parseRateLimitAction(str string) (RateLimitAction, error) {
+	switch str {
+	case "retry", "" /* default to back-pressure if unspecified */ :
+		return RateLimitRetry, nil
+	case "drop":
+		return RateLimitDrop, nil
+	case "spill":
+		return RateLimitSpill, nil
+	default:
+		return RateLimitRetry, fmt.Errorf("unknown rate limit action: %s. Supported: \"retry\" (default), \"drop\", \"spill\"", str)
 	}
 }
 
@@ -91,45 +514,583 @@ func NewPluginConfig(ctx unsafe.Pointer) (cfg PluginConfig, err error) {
 		return
 	}
 
+	cfg.Routes, err = parseRoutes(ctx, cfg.NRClientConfig)
+	if err != nil {
+		return
+	}
+
+	cfg.LogsToMetrics, err = parseLogsToMetrics(ctx)
+	if err != nil {
+		return
+	}
+
+	shutdownTimeoutSeconds, err := optInt(ctx, "shutdownTimeout", 5)
+	if err != nil {
+		return
+	}
+	cfg.ShutdownTimeout = time.Duration(shutdownTimeoutSeconds) * time.Second
+
+	cfg.Quarantine, err = parseQuarantineConfig(ctx)
+	if err != nil {
+		return
+	}
+
 	checkDeprecatedConfigFields(ctx)
 
 	return
 }
 
 func parseNRClientConfig(ctx unsafe.Pointer) (cfg NRClientConfig, err error) {
-	cfg.Endpoint = output.FLBPluginConfigKey(ctx, "endpoint")
+	cfg.OutputFormat, err = parseOutputFormat(output.FLBPluginConfigKey(ctx, "outputFormat"))
+	if err != nil {
+		return
+	}
+
+	switch cfg.OutputFormat {
+	case OtlpFormat:
+		cfg.Endpoint = optString(ctx, "endpoint", defaultOtlpEndpoint)
+	case EventFormat:
+		cfg.Event, err = parseEventConfig(ctx)
+		if err != nil {
+			return
+		}
+		cfg.Endpoint = output.FLBPluginConfigKey(ctx, "endpoint")
+		if accountId := output.FLBPluginConfigKey(ctx, "accountId"); len(cfg.Endpoint) == 0 && len(accountId) > 0 {
+			cfg.Endpoint = fmt.Sprintf(eventsEndpointFormat, accountId)
+		}
+		if len(cfg.Endpoint) == 0 {
+			err = fmt.Errorf("the event output format requires either the endpoint or the accountId option")
+			return
+		}
+	default:
+		cfg.Endpoint = optString(ctx, "endpoint", defaultLogsEndpoint)
+	}
+
+	err = parseCredentials(ctx, "apiKey", "licenseKey", &cfg)
+	if err != nil {
+		return
+	}
+
+	cfg.TimeoutSeconds, err = optInt(ctx, "httpClientTimeout", 5)
+
+	cfg.SendMetrics, err = optBool(ctx, "sendMetrics", false)
+
+	harvestPeriodSeconds, err := optInt(ctx, "metricsHarvestPeriod", 5)
+	if err != nil {
+		return
+	}
+	cfg.MetricsHarvestPeriod = time.Duration(harvestPeriodSeconds) * time.Second
+
+	cfg.MetricsEndpoint, err = parseMetricsEndpointConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.Compression, err = parseCompressionType(output.FLBPluginConfigKey(ctx, "compression"))
+	if err != nil {
+		return
+	}
+	if !cfg.OutputFormat.supportsCompression(cfg.Compression) {
+		err = fmt.Errorf("the %s output format doesn't support %s compression", cfg.OutputFormat, cfg.Compression)
+		return
+	}
+
+	cfg.CompressionLevel, err = optInt(ctx, "compressionLevel", 0)
+	if err != nil {
+		return
+	}
+	if maxLevel := cfg.Compression.maxLevel(); maxLevel == 0 && cfg.CompressionLevel != 0 {
+		err = fmt.Errorf("invalid value for compressionLevel: %d. The %s compression has no levels", cfg.CompressionLevel, cfg.Compression)
+		return
+	} else if cfg.CompressionLevel < 0 || cfg.CompressionLevel > maxLevel {
+		err = fmt.Errorf("invalid value for compressionLevel: %d. It should be between 1 and %d for %s compression, or 0 for the default level", cfg.CompressionLevel, maxLevel, cfg.Compression)
+		return
+	}
+
+	cfg.RateLimit, err = parseRateLimitConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.Failover, err = parseFailoverConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.CircuitBreaker, err = parseCircuitBreakerConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.Prometheus, err = parsePrometheusConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.Mirrors, err = parseMirrors(ctx, cfg)
+
+	return
+}
+
+func parsePrometheusConfig(ctx unsafe.Pointer) (cfg PrometheusConfig, err error) {
+	cfg.ListenAddress = output.FLBPluginConfigKey(ctx, "prometheusListenAddress")
+
+	cfg.Labels, err = parsePrometheusLabels(output.FLBPluginConfigKey(ctx, "prometheusLabels"))
+	if err != nil {
+		return
+	}
+
+	// Fluent Bit names the instances of an output plugin after the plugin name and the order in which they are
+	// initialized, so using the same name allows identifying the instance in the Fluent Bit metrics too
+	if _, ok := cfg.Labels["output"]; !ok {
+		cfg.Labels["output"] = fmt.Sprintf("newrelic.%d", instanceCount)
+	}
+	instanceCount++
+
+	return
+}
+
+func parsePrometheusLabels(str string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if len(strings.TrimSpace(str)) == 0 {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid prometheusLabels entry: %s. It should follow the format name=value", pair)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+func parseCircuitBreakerConfig(ctx unsafe.Pointer) (cfg CircuitBreakerConfig, err error) {
+	cfg.Threshold, err = optInt(ctx, "circuitBreakerThreshold", 0)
+	if err != nil {
+		return
+	}
+
+	cooldownSeconds, err := optInt(ctx, "circuitBreakerCooldown", 30)
+	if err != nil {
+		return
+	}
+	if cooldownSeconds < 1 {
+		err = fmt.Errorf("invalid value for circuitBreakerCooldown: %d. It should be greater than 0", cooldownSeconds)
+		return
+	}
+	cfg.Cooldown = time.Duration(cooldownSeconds) * time.Second
+
+	return
+}
+
+func parseMetricsEndpointConfig(ctx unsafe.Pointer) (cfg MetricsEndpointConfig, err error) {
+	cfg.Endpoint = output.FLBPluginConfigKey(ctx, "metricsEndpoint")
+
+	var credentials NRClientConfig
+	if len(output.FLBPluginConfigKey(ctx, "metricsApiKey")) > 0 || len(output.FLBPluginConfigKey(ctx, "metricsLicenseKey")) > 0 {
+		if len(cfg.Endpoint) == 0 {
+			err = fmt.Errorf("metricsApiKey and metricsLicenseKey can only be specified together with metricsEndpoint")
+			return
+		}
+		if err = parseCredentials(ctx, "metricsApiKey", "metricsLicenseKey", &credentials); err != nil {
+			return
+		}
+	}
+	cfg.ApiKey, cfg.LicenseKey, cfg.UseApiKey = credentials.ApiKey, credentials.LicenseKey, credentials.UseApiKey
+
+	return
+}
+
+func parseEventConfig(ctx unsafe.Pointer) (cfg EventConfig, err error) {
+	cfg.EventType = optString(ctx, "eventType", defaultEventType)
+	if !IsValidEventType(cfg.EventType) {
+		err = fmt.Errorf("invalid value for eventType: %s. It should only contain alphanumeric characters, underscores and colons, up to %d characters", cfg.EventType, maxEventTypeLen)
+		return
+	}
+	cfg.EventTypeKey = output.FLBPluginConfigKey(ctx, "eventTypeKey")
+	return
+}
+
+func parseFailoverConfig(ctx unsafe.Pointer) (cfg FailoverConfig, err error) {
+	cfg.Endpoint = output.FLBPluginConfigKey(ctx, "failoverEndpoint")
 	if len(cfg.Endpoint) == 0 {
-		cfg.Endpoint = "https://log-api.newrelic.com/log/v1"
+		return
 	}
-	cfg.LicenseKey = output.FLBPluginConfigKey(ctx, "licenseKey")
-	cfg.ApiKey = output.FLBPluginConfigKey(ctx, "apiKey")
 
-	if len(cfg.ApiKey) == 0 && len(cfg.LicenseKey) == 0 {
-		err = fmt.Errorf("either apiKey or licenseKey must be specified")
+	var credentials NRClientConfig
+	if len(output.FLBPluginConfigKey(ctx, "failoverApiKey")) > 0 || len(output.FLBPluginConfigKey(ctx, "failoverLicenseKey")) > 0 {
+		if err = parseCredentials(ctx, "failoverApiKey", "failoverLicenseKey", &credentials); err != nil {
+			return
+		}
+	}
+	cfg.ApiKey, cfg.LicenseKey, cfg.UseApiKey = credentials.ApiKey, credentials.LicenseKey, credentials.UseApiKey
+
+	cfg.Threshold, err = optInt(ctx, "failoverThreshold", 3)
+	if err != nil {
+		return
+	}
+	if cfg.Threshold < 1 {
+		err = fmt.Errorf("invalid value for failoverThreshold: %d. It should be greater than 0", cfg.Threshold)
 		return
 	}
 
-	if len(cfg.ApiKey) > 0 && len(cfg.LicenseKey) > 0 {
-		err = fmt.Errorf("only one of apiKey or licenseKey can be specified")
+	probeIntervalSeconds, err := optInt(ctx, "failoverProbeInterval", 60)
+	if err != nil {
+		return
+	}
+	if probeIntervalSeconds < 1 {
+		err = fmt.Errorf("invalid value for failoverProbeInterval: %d. It should be greater than 0", probeIntervalSeconds)
 		return
 	}
+	cfg.ProbeInterval = time.Duration(probeIntervalSeconds) * time.Second
+
+	return
+}
+
+// parseCredentials reads the provided API key and license key options into the client configuration
+func parseCredentials(ctx unsafe.Pointer, apiKeyName string, licenseKeyName string, cfg *NRClientConfig) error {
+	cfg.LicenseKey = output.FLBPluginConfigKey(ctx, licenseKeyName)
+	cfg.ApiKey = output.FLBPluginConfigKey(ctx, apiKeyName)
+
+	if len(cfg.ApiKey) == 0 && len(cfg.LicenseKey) == 0 {
+		return fmt.Errorf("either %s or %s must be specified", apiKeyName, licenseKeyName)
+	}
+
+	if len(cfg.ApiKey) > 0 && len(cfg.LicenseKey) > 0 {
+		return fmt.Errorf("only one of %s or %s can be specified", apiKeyName, licenseKeyName)
+	}
 
 	cfg.UseApiKey = len(cfg.ApiKey) > 0
+	return nil
+}
 
-	cfg.TimeoutSeconds, err = optInt(ctx, "httpClientTimeout", 5)
+// parseNumberedOptions reads the <group>.N.* options, starting from N=1 until no <group>.N.<key> option is found,
+// calling parse with the prefix of each N (<group>.N.) and the value of its key option
+func parseNumberedOptions(ctx unsafe.Pointer, group string, key string, parse func(n int, prefix string, value string) error) error {
+	for n := 1; ; n++ {
+		prefix := fmt.Sprintf("%s.%d.", group, n)
+		value := output.FLBPluginConfigKey(ctx, prefix+key)
+		if len(value) == 0 {
+			return nil
+		}
+		if err := parse(n, prefix, value); err != nil {
+			return err
+		}
+	}
+}
 
-	cfg.SendMetrics, err = optBool(ctx, "sendMetrics", false)
+// parseMirrors reads the mirror.N.* options. Each mirror inherits the client configuration, overriding its endpoint
+// and credentials.
+func parseMirrors(ctx unsafe.Pointer, primaryCfg NRClientConfig) (mirrors []MirrorConfig, err error) {
+	err = parseNumberedOptions(ctx, "mirror", "endpoint", func(n int, prefix string, endpoint string) error {
+		mirror := MirrorConfig{
+			Name:           optString(ctx, prefix+"name", fmt.Sprintf("mirror.%d", n)),
+			NRClientConfig: primaryCfg,
+		}
+		mirror.NRClientConfig.Endpoint = endpoint
+		// Mirrors receive the payloads already accepted by the primary rate limiter and circuit breaker, and don't
+		// fail over
+		mirror.NRClientConfig.RateLimit = RateLimitConfig{}
+		mirror.NRClientConfig.Failover = FailoverConfig{}
+		mirror.NRClientConfig.CircuitBreaker = CircuitBreakerConfig{}
+		if err := parseCredentials(ctx, prefix+"apiKey", prefix+"licenseKey", &mirror.NRClientConfig); err != nil {
+			return err
+		}
 
-	cfg.Compression, err = parseCompressionType(output.FLBPluginConfigKey(ctx, "compression"))
+		mirrors = append(mirrors, mirror)
+		return nil
+	})
+	return
+}
+
+// parseLogsToMetrics reads the l2m.N.* options
+func parseLogsToMetrics(ctx unsafe.Pointer) (rules []LogToMetricConfig, err error) {
+	err = parseNumberedOptions(ctx, "l2m", "metric", func(n int, prefix string, metric string) error {
+		rule, err := parseLogToMetric(n, prefix, metric, func(key string) string {
+			return output.FLBPluginConfigKey(ctx, prefix+key)
+		})
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+		return nil
+	})
+	return
+}
+
+// parseLogToMetric builds the N-th logs to metrics rule out of its metric and the rest of its options, which option
+// returns by key (without the l2m.N. prefix)
+func parseLogToMetric(n int, prefix string, metric string, option func(key string) string) (rule LogToMetricConfig, err error) {
+	rule = LogToMetricConfig{
+		Name:     option("name"),
+		Match:    option("match"),
+		Metric:   metric,
+		ValueKey: option("value"),
+	}
+	if len(rule.Name) == 0 {
+		rule.Name = fmt.Sprintf("l2m.%d", n)
+	}
+	if len(rule.Match) == 0 {
+		return rule, fmt.Errorf("missing %smatch option", prefix)
+	}
+
+	rule.Type, err = parseLogToMetricType(option("type"))
+	if err != nil {
+		return rule, fmt.Errorf("%stype: %v", prefix, err)
+	}
+	if rule.Type != LogToMetricCount && len(rule.ValueKey) == 0 {
+		return rule, fmt.Errorf("missing %svalue option, required by %s metrics", prefix, rule.Type)
+	}
+
+	for _, dimension := range strings.Split(option("dimensions"), ",") {
+		if dimension = strings.TrimSpace(dimension); len(dimension) > 0 {
+			rule.Dimensions = append(rule.Dimensions, dimension)
+		}
+	}
+
+	rule.DropLogs, err = parseBool(prefix+"dropLogs", option("dropLogs"), false)
+	return
+}
+
+// parseRoutes reads the route.N.* options. Each route inherits the default client configuration, overriding its
+// endpoint and credentials.
+func parseRoutes(ctx unsafe.Pointer, defaultCfg NRClientConfig) (routes []RouteConfig, err error) {
+	err = parseNumberedOptions(ctx, "route", "match", func(n int, prefix string, match string) error {
+		route := RouteConfig{
+			Name:           optString(ctx, prefix+"name", fmt.Sprintf("route.%d", n)),
+			Match:          match,
+			NRClientConfig: defaultCfg,
+		}
+		route.NRClientConfig.Endpoint = optString(ctx, prefix+"endpoint", defaultCfg.Endpoint)
+		if len(defaultCfg.RateLimit.SpillDir) > 0 {
+			// Each route has its own rate limiter, so they can't share the same spill directory
+			route.NRClientConfig.RateLimit.SpillDir = filepath.Join(defaultCfg.RateLimit.SpillDir, route.Name)
+		}
+		if err := parseCredentials(ctx, prefix+"apiKey", prefix+"licenseKey", &route.NRClientConfig); err != nil {
+			return err
+		}
+		route.NRClientConfig.Prometheus = defaultCfg.Prometheus.WithLabel("route", route.Name)
+		route.NRClientConfig.Mirrors = make([]MirrorConfig, len(defaultCfg.Mirrors))
+		for i, mirror := range defaultCfg.Mirrors {
+			mirror.NRClientConfig.Prometheus = route.NRClientConfig.Prometheus
+			route.NRClientConfig.Mirrors[i] = mirror
+		}
+
+		routes = append(routes, route)
+		return nil
+	})
+	return
+}
+
+func parseRateLimitConfig(ctx unsafe.Pointer) (cfg RateLimitConfig, err error) {
+	cfg.BytesPerSecond, err = optInt(ctx, "rateLimitBytesPerSecond", 0)
+	if err != nil {
+		return
+	}
+
+	cfg.RecordsPerSecond, err = optInt(ctx, "rateLimitRecordsPerSecond", 0)
+	if err != nil {
+		return
+	}
+
+	cfg.Action, err = parseRateLimitAction(output.FLBPluginConfigKey(ctx, "rateLimitAction"))
+	if err != nil {
+		return
+	}
 
+	cfg.SpillDir = output.FLBPluginConfigKey(ctx, "rateLimitSpillDir")
+	if cfg.Action == RateLimitSpill && len(cfg.SpillDir) == 0 {
+		err = fmt.Errorf("rateLimitSpillDir must be specified when rateLimitAction is \"spill\"")
+		return
+	}
+
+	spillMaxMB, err := optInt(ctx, "rateLimitSpillMaxMB", 512)
+	if err != nil {
+		return
+	}
+	cfg.SpillMaxBytes = int64(spillMaxMB) << 20
+
+	return
+}
+
+func parseQuarantineConfig(ctx unsafe.Pointer) (cfg QuarantineConfig, err error) {
+	cfg.Dir = output.FLBPluginConfigKey(ctx, "quarantineDir")
+
+	quarantineMaxMB, err := optInt(ctx, "quarantineMaxMB", 64)
+	if err != nil {
+		return
+	}
+	cfg.MaxBytes = int64(quarantineMaxMB) << 20
 	return
 }
 
 func parseDataFormatConfig(ctx unsafe.Pointer) (cfg DataFormatConfig, err error) {
 	cfg.LowDataMode, err = optBool(ctx, "lowDataMode", false)
+	if err != nil {
+		return
+	}
+
+	cfg.Severity, err = parseSeverityConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.ExtractTraceContext, err = optBool(ctx, "extractTraceContext", false)
+	if err != nil {
+		return
+	}
+
+	cfg.ParseNrLinking, err = optBool(ctx, "parseNrLinking", false)
+	if err != nil {
+		return
+	}
+
+	cfg.TagKey = output.FLBPluginConfigKey(ctx, "tagKey")
+
+	cfg.IncludeEventMetadata, err = optBool(ctx, "includeEventMetadata", false)
+	if err != nil {
+		return
+	}
+
+	cfg.EventMetadataPrefix = optString(ctx, "eventMetadataPrefix", "metadata.")
+
+	cfg.Types, err = parseTypesConfig(ctx)
+	if err != nil {
+		return
+	}
+
+	cfg.FastPath, err = optBool(ctx, "fastPath", false)
+	if err != nil {
+		return
+	}
+
+	cfg.InvalidUtf8, err = parseInvalidUtf8Action(output.FLBPluginConfigKey(ctx, "invalidUtf8"))
 	return
 }
 
+func parseTypesConfig(ctx unsafe.Pointer) (cfg TypesConfig, err error) {
+	cfg.Types, err = parseTypes(output.FLBPluginConfigKey(ctx, "types"))
+	if err != nil {
+		return
+	}
+
+	cfg.OnFailure, err = parseCoercionFailureAction(output.FLBPluginConfigKey(ctx, "typesOnFailure"))
+	return
+}
+
+// parseTypes parses a comma-separated list of key:type pairs, such as "status:int,cached:bool"
+func parseTypes(str string) (map[string]AttributeType, error) {
+	types := make(map[string]AttributeType)
+	if len(strings.TrimSpace(str)) == 0 {
+		return types, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		// Empty entries, such as the one after a trailing comma, are ignored
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid types entry: %s. It should follow the format key:type", pair)
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := types[key]; ok {
+			return nil, fmt.Errorf("duplicated types entry for %s", key)
+		}
+		attributeType, err := parseAttributeType(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		types[key] = attributeType
+	}
+	return types, nil
+}
+
+func parseAttributeType(str string) (AttributeType, error) {
+	switch str {
+	case "int":
+		return IntType, nil
+	case "float":
+		return FloatType, nil
+	case "bool":
+		return BoolType, nil
+	case "string":
+		return StringType, nil
+	case "duration":
+		return DurationType, nil
+	default:
+		return StringType, fmt.Errorf("unknown type: %s. Supported: \"int\", \"float\", \"bool\", \"string\", \"duration\"", str)
+	}
+}
+
+func parseCoercionFailureAction(str string) (CoercionFailureAction, error) {
+	switch str {
+	case "keep", "" /* default to keep if unspecified */ :
+		return CoercionKeep, nil
+	case "drop":
+		return CoercionDrop, nil
+	case "raw":
+		return CoercionRaw, nil
+	default:
+		return CoercionKeep, fmt.Errorf("unknown value for typesOnFailure: %s. Supported: \"keep\" (default), \"drop\", \"raw\"", str)
+	}
+}
+
+func parseInvalidUtf8Action(str string) (InvalidUtf8Action, error) {
+	switch str {
+	case "replace", "" /* default to replace if unspecified */ :
+		return InvalidUtf8Replace, nil
+	case "base64":
+		return InvalidUtf8Base64, nil
+	case "drop":
+		return InvalidUtf8Drop, nil
+	default:
+		return InvalidUtf8Replace, fmt.Errorf("unknown value for invalidUtf8: %s. Supported: \"replace\" (default), \"base64\", \"drop\"", str)
+	}
+}
+
+func parseSeverityConfig(ctx unsafe.Pointer) (cfg SeverityConfig, err error) {
+	cfg.Normalize, err = optBool(ctx, "normalizeSeverity", false)
+	if err != nil {
+		return
+	}
+
+	cfg.AddNumber, err = optBool(ctx, "severityNumber", false)
+	if err != nil {
+		return
+	}
+
+	cfg.FromMessage, err = optBool(ctx, "severityFromMessage", false)
+	if err != nil {
+		return
+	}
+
+	cfg.Mapping, err = parseSeverityMapping(output.FLBPluginConfigKey(ctx, "severityMapping"))
+	return
+}
+
+// parseSeverityMapping parses a comma-separated list of original:normalized level pairs,
+// such as "warning:WARN,crit:FATAL"
+func parseSeverityMapping(str string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if len(strings.TrimSpace(str)) == 0 {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("invalid severityMapping entry: %s. It should follow the format original:normalized", pair)
+		}
+		mapping[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.ToUpper(strings.TrimSpace(parts[1]))
+	}
+	return mapping, nil
+}
+
 func parseProxyConfig(ctx unsafe.Pointer) (cfg ProxyConfig, err error) {
 	cfg.IgnoreSystemProxy, err = optBool(ctx, "ignoreSystemProxy", false)
 	if err != nil {
@@ -157,7 +1118,10 @@ func checkDeprecatedConfigFields(ctx unsafe.Pointer) {
 }
 
 func optBool(ctx unsafe.Pointer, keyName string, defaultValue bool) (bool, error) {
-	rawVal := output.FLBPluginConfigKey(ctx, keyName)
+	return parseBool(keyName, output.FLBPluginConfigKey(ctx, keyName), defaultValue)
+}
+
+func parseBool(keyName string, rawVal string, defaultValue bool) (bool, error) {
 	if len(rawVal) == 0 {
 		return defaultValue, nil
 	} else {
@@ -169,6 +1133,14 @@ func optBool(ctx unsafe.Pointer, keyName string, defaultValue bool) (bool, error
 	}
 }
 
+func optString(ctx unsafe.Pointer, keyName string, defaultValue string) string {
+	rawVal := output.FLBPluginConfigKey(ctx, keyName)
+	if len(rawVal) == 0 {
+		return defaultValue
+	}
+	return rawVal
+}
+
 func optInt(ctx unsafe.Pointer, keyName string, defaultValue int) (int, error) {
 	rawVal := output.FLBPluginConfigKey(ctx, keyName)
 	if len(rawVal) == 0 {
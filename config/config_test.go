@@ -0,0 +1,166 @@
+package config
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Types config", func() {
+	typesToExpected := map[string]struct {
+		types    string
+		expected map[string]AttributeType
+		ok       bool
+	}{
+		"no types":                   {"", map[string]AttributeType{}, true},
+		"blank types":                {"  ", map[string]AttributeType{}, true},
+		"every type":                 {"a:int,b:float,c:bool,d:string,e:duration", map[string]AttributeType{"a": IntType, "b": FloatType, "c": BoolType, "d": StringType, "e": DurationType}, true},
+		"nested attributes":          {"request.size:int", map[string]AttributeType{"request.size": IntType}, true},
+		"surrounding whitespace":     {" status : int , cached:bool ", map[string]AttributeType{"status": IntType, "cached": BoolType}, true},
+		"empty entries":              {"status:int,, ,cached:bool,", map[string]AttributeType{"status": IntType, "cached": BoolType}, true},
+		"unknown type":               {"status:number", nil, false},
+		"uppercase type":             {"status:INT", nil, false},
+		"missing type":               {"status", nil, false},
+		"empty type":                 {"status:", nil, false},
+		"missing key":                {":int", nil, false},
+		"duplicated key":             {"status:int,status:float", nil, false},
+		"duplicated key with spaces": {"status:int, status :int", nil, false},
+	}
+
+	for description, testCase := range typesToExpected {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		testCase := testCase
+
+		It("parses "+description, func() {
+			types, err := parseTypes(testCase.types)
+
+			if testCase.ok {
+				Expect(err).To(BeNil())
+			} else {
+				Expect(err).NotTo(BeNil())
+			}
+			Expect(types).To(Equal(testCase.expected))
+		})
+	}
+
+	It("parses the action for the values that can't be coerced", func() {
+		actions := map[string]CoercionFailureAction{
+			"":     CoercionKeep,
+			"keep": CoercionKeep,
+			"drop": CoercionDrop,
+			"raw":  CoercionRaw,
+		}
+		for str, expected := range actions {
+			action, err := parseCoercionFailureAction(str)
+			Expect(err).To(BeNil())
+			Expect(action).To(Equal(expected))
+		}
+
+		for _, str := range []string{"discard", "Keep", " raw"} {
+			_, err := parseCoercionFailureAction(str)
+			Expect(err).NotTo(BeNil(), str)
+		}
+	})
+
+	It("parses the attribute types", func() {
+		attributeTypes := map[string]AttributeType{
+			"int":      IntType,
+			"float":    FloatType,
+			"bool":     BoolType,
+			"string":   StringType,
+			"duration": DurationType,
+		}
+		for str, expected := range attributeTypes {
+			attributeType, err := parseAttributeType(str)
+			Expect(err).To(BeNil())
+			Expect(attributeType).To(Equal(expected))
+		}
+
+		// Unlike the actions, there's no default type
+		for _, str := range []string{"", "integer", "Bool"} {
+			_, err := parseAttributeType(str)
+			Expect(err).NotTo(BeNil(), str)
+		}
+	})
+})
+
+var _ = Describe("Logs to metrics config", func() {
+	It("parses the metric types", func() {
+		metricTypes := map[string]LogToMetricType{
+			"":        LogToMetricCount,
+			"count":   LogToMetricCount,
+			"gauge":   LogToMetricGauge,
+			"summary": LogToMetricSummary,
+		}
+		for str, expected := range metricTypes {
+			metricType, err := parseLogToMetricType(str)
+			Expect(err).To(BeNil())
+			Expect(metricType).To(Equal(expected))
+		}
+
+		for _, str := range []string{"histogram", "Gauge", " count"} {
+			_, err := parseLogToMetricType(str)
+			Expect(err).NotTo(BeNil(), str)
+		}
+	})
+
+	optionsToExpected := map[string]struct {
+		options  map[string]string
+		expected LogToMetricConfig
+		ok       bool
+	}{
+		"a count with the default options": {
+			map[string]string{"match": "status~^5"},
+			LogToMetricConfig{Name: "l2m.1", Match: "status~^5", Metric: "http.errors", Type: LogToMetricCount},
+			true,
+		},
+		"a summary with every option": {
+			map[string]string{"name": "latency", "match": "service=checkout", "type": "summary", "value": "duration_ms", "dimensions": "service,status", "dropLogs": "true"},
+			LogToMetricConfig{Name: "latency", Match: "service=checkout", Metric: "http.errors", Type: LogToMetricSummary, ValueKey: "duration_ms", Dimensions: []string{"service", "status"}, DropLogs: true},
+			true,
+		},
+		"the dimensions with whitespace and empty entries": {
+			map[string]string{"match": "status~^5", "dimensions": " service , ,status,"},
+			LogToMetricConfig{Name: "l2m.1", Match: "status~^5", Metric: "http.errors", Type: LogToMetricCount, Dimensions: []string{"service", "status"}},
+			true,
+		},
+		"a missing match": {
+			map[string]string{"type": "count"},
+			LogToMetricConfig{},
+			false,
+		},
+		"an unknown type": {
+			map[string]string{"match": "status~^5", "type": "histogram", "value": "duration_ms"},
+			LogToMetricConfig{},
+			false,
+		},
+		"a gauge without value": {
+			map[string]string{"match": "status~^5", "type": "gauge"},
+			LogToMetricConfig{},
+			false,
+		},
+		"an invalid dropLogs": {
+			map[string]string{"match": "status~^5", "dropLogs": "sometimes"},
+			LogToMetricConfig{},
+			false,
+		},
+	}
+
+	for description, testCase := range optionsToExpected {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		testCase := testCase
+
+		It("parses "+description, func() {
+			rule, err := parseLogToMetric(1, "l2m.1.", "http.errors", func(key string) string {
+				return testCase.options[key]
+			})
+
+			if testCase.ok {
+				Expect(err).To(BeNil())
+				Expect(rule).To(Equal(testCase.expected))
+			} else {
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("l2m.1."))
+			}
+		})
+	}
+})
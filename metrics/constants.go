@@ -7,6 +7,47 @@ const (
 	TotalSendTime        = "logs.fb.total.send.time"
 	PayloadCountPerChunk = "logs.fb.payload.count"
 	PayloadSize          = "logs.fb.payload.size"
+
+	RateLimitedRecords        = "logs.fb.ratelimit.limited.records"
+	RateLimitedBytes          = "logs.fb.ratelimit.limited.bytes"
+	RateLimitAvailableRecords = "logs.fb.ratelimit.available.records"
+	RateLimitAvailableBytes   = "logs.fb.ratelimit.available.bytes"
+	RateLimitSpillSize        = "logs.fb.ratelimit.spill.size"
+
+	ActiveEndpoint = "logs.fb.endpoint.active"
+
+	MirrorDroppedPayloads = "logs.fb.mirror.dropped.payloads"
+
+	CircuitBreakerState           = "logs.fb.circuitbreaker.state"
+	CircuitBreakerRejectedRecords = "logs.fb.circuitbreaker.rejected.records"
+
+	RecordsReceived    = "logs.fb.records.received"
+	RecordsSent        = "logs.fb.records.sent"
+	RecordsDropped     = "logs.fb.records.dropped"
+	RecordsRetried     = "logs.fb.records.retried"
+	RecordsSpilled     = "logs.fb.records.spilled"
+	RecordsQuarantined = "logs.fb.records.quarantined"
+	ChunkSize          = "logs.fb.chunk.size"
+	FlushCount         = "logs.fb.flush.count"
+	FlushPanics        = "logs.fb.flush.panics"
+	ResponseCount      = "logs.fb.response.count"
+	UncompressedSize   = "logs.fb.payload.uncompressed.size"
+	CompressionRatio   = "logs.fb.compression.ratio"
+
+	InvalidUtf8Values = "logs.fb.invalid_utf8.values"
+)
+
+// Reasons why records were dropped or handed back to Fluent Bit to be retried
+const (
+	ReasonPackagingError     = "packaging_error"
+	ReasonTooLarge           = "too_large"
+	ReasonRateLimited        = "rate_limited"
+	ReasonNonRetryableStatus = "non_retryable_status"
+	ReasonSendError          = "send_error"
+	ReasonCircuitOpen        = "circuit_open"
+	ReasonShuttingDown       = "shutting_down"
+	ReasonConvertedToMetrics = "converted_to_metrics"
+	ReasonRouteBacklogFull   = "route_backlog_full"
 )
 
 // API URLs
@@ -17,6 +58,11 @@ const (
 	logsUsProdUrl     = "https://log-api.newrelic.com/log/v1"
 	logsEuProdUrl     = "https://log-api.eu.newrelic.com/log/v1"
 	logsStagingUrl    = "https://staging-log-api.newrelic.com/log/v1"
+	otlpUsProdUrl     = "https://otlp.nr-data.net/v1/logs"
+	otlpEuProdUrl     = "https://otlp.eu01.nr-data.net/v1/logs"
+	eventsUsProdUrl   = "https://insights-collector.newrelic.com/v1/accounts/"
+	eventsEuProdUrl   = "https://insights-collector.eu01.nr-data.net/v1/accounts/"
+	eventsStagingUrl  = "https://staging-insights-collector.newrelic.com/v1/accounts/"
 )
 
 // Maps the Metrics API URL that corresponds to the same environment as the provided
@@ -25,4 +71,14 @@ var logsToMetricsUrlMapping = map[string]string{
 	logsUsProdUrl:  metricsUsProdUrl,
 	logsEuProdUrl:  metricsEuProdUrl,
 	logsStagingUrl: metricsStagingUrl,
+	otlpUsProdUrl:  metricsUsProdUrl,
+	otlpEuProdUrl:  metricsEuProdUrl,
+}
+
+// Maps the Metrics API URL that corresponds to the same environment as the provided
+// Event API URL prefix, which is followed by the account ID and /events.
+var eventsToMetricsUrlMapping = map[string]string{
+	eventsUsProdUrl:  metricsUsProdUrl,
+	eventsEuProdUrl:  metricsEuProdUrl,
+	eventsStagingUrl: metricsStagingUrl,
 }
@@ -1,19 +1,44 @@
 package metrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	defaultHarvestPeriod = 5 * time.Second
+
+	apiKeyHeader     = "Api-Key"
+	licenseKeyHeader = "X-License-Key"
+)
+
 type Client interface {
 	SendSummaryDuration(metricName string, attributes map[string]interface{}, duration time.Duration)
 	SendSummaryValue(metricName string, attributes map[string]interface{}, value float64)
+	// SendCount increases a counter, reported as a delta for each harvest period
+	SendCount(metricName string, attributes map[string]interface{}, value float64)
+	// SendGauge records the current value of a gauge, only the last one of each harvest period being reported
+	SendGauge(metricName string, attributes map[string]interface{}, value float64)
+	// Shutdown stops the periodic harvest and sends the metrics recorded since the last one. It returns when they
+	// have been sent or the context is done.
+	Shutdown(ctx context.Context)
 }
 
 type wrappedMetricAggregator struct {
+	harvester        *telemetry.Harvester
 	metricAggregator *telemetry.MetricAggregator
+	stop             chan struct{}
+	stopped          chan struct{}
+	shutdownOnce     sync.Once
 }
 
 func (m *wrappedMetricAggregator) SendSummaryDuration(metricName string, attributes map[string]interface{}, duration time.Duration) {
@@ -24,6 +49,42 @@ func (m *wrappedMetricAggregator) SendSummaryValue(metricName string, attributes
 	m.metricAggregator.Summary(metricName, attributes).Record(value)
 }
 
+func (m *wrappedMetricAggregator) SendCount(metricName string, attributes map[string]interface{}, value float64) {
+	m.metricAggregator.Count(metricName, attributes).Increase(value)
+}
+
+func (m *wrappedMetricAggregator) SendGauge(metricName string, attributes map[string]interface{}, value float64) {
+	m.metricAggregator.Gauge(metricName, attributes).Value(value)
+}
+
+func (m *wrappedMetricAggregator) Shutdown(ctx context.Context) {
+	m.shutdownOnce.Do(func() {
+		close(m.stop)
+		select {
+		case <-m.stopped:
+		case <-ctx.Done():
+			return
+		}
+		m.harvester.HarvestNow(ctx)
+	})
+}
+
+// harvestLoop replaces the harvest goroutine of the telemetry SDK, which can't be stopped
+func (m *wrappedMetricAggregator) harvestLoop(period time.Duration) {
+	defer close(m.stopped)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.harvester.HarvestNow(context.Background())
+		case <-m.stop:
+			return
+		}
+	}
+}
+
 type noopMetricAggregator struct{}
 
 func (*noopMetricAggregator) SendSummaryDuration(metricName string, attributes map[string]interface{}, duration time.Duration) {
@@ -32,34 +93,160 @@ func (*noopMetricAggregator) SendSummaryDuration(metricName string, attributes m
 func (*noopMetricAggregator) SendSummaryValue(metricName string, attributes map[string]interface{}, value float64) {
 }
 
-// Return a new metrics client. If sendMetrics is true and a valid Logs API URL is supplied, a real client is returned.
-// If sendMetrics is true or no Metrics API URL mapping exists for the supplied Logs API URL, a noop client is returned.
-func NewClient(nrClientConfig config.NRClientConfig) (Client, error) {
+func (*noopMetricAggregator) SendCount(metricName string, attributes map[string]interface{}, value float64) {
+}
+
+func (*noopMetricAggregator) SendGauge(metricName string, attributes map[string]interface{}, value float64) {
+}
+
+func (*noopMetricAggregator) Shutdown(ctx context.Context) {
+}
+
+// Return a new metrics client. If sendMetrics is true and a valid Logs API URL is supplied, a client sending the
+// metrics to New Relic using the supplied HTTP client is returned. If a Prometheus listen address is configured, a
+// client exposing the metrics in Prometheus format is returned, or both of them if both are enabled. Otherwise, or if
+// no Metrics API URL mapping exists for the supplied Logs API URL, a noop client is returned.
+func NewClient(nrClientConfig config.NRClientConfig, httpClient *http.Client) (Client, error) {
+	client, err := newNewRelicClient(nrClientConfig, httpClient)
+	if !nrClientConfig.Prometheus.Enabled() {
+		return client, err
+	}
+
+	prometheusClient, prometheusErr := newPrometheusClient(nrClientConfig.Prometheus)
+	if prometheusErr != nil {
+		return client, errors.Join(err, prometheusErr)
+	}
+	if _, ok := client.(*noopMetricAggregator); ok {
+		return prometheusClient, err
+	}
+	return &fanoutClient{clients: []Client{client, prometheusClient}}, err
+}
+
+// NewLogsToMetricsClient returns a client sending the metrics derived from the log records to New Relic, using the
+// supplied HTTP client, regardless of sendMetrics. They are sent to the same Metric API endpoint as the troubleshooting
+// metrics.
+func NewLogsToMetricsClient(nrClientConfig config.NRClientConfig, httpClient *http.Client) (Client, error) {
+	nrClientConfig.SendMetrics = true
+	return newNewRelicClient(nrClientConfig, httpClient)
+}
+
+// newNewRelicClient returns a client sending the metrics to the metricsEndpoint, if configured, or to the Metric API
+// endpoint of the same environment as the Logs API endpoint otherwise
+func newNewRelicClient(nrClientConfig config.NRClientConfig, httpClient *http.Client) (Client, error) {
 	metricReportingEnabled := nrClientConfig.SendMetrics
 	logsApiUrl := nrClientConfig.Endpoint
-	metricsApiUrl, ok := logsToMetricsUrlMapping[logsApiUrl]
+	metricsApiUrl, ok := inferMetricsUrl(logsApiUrl)
+	if override := nrClientConfig.MetricsEndpoint; len(override.Endpoint) > 0 {
+		metricsApiUrl, ok = override.Endpoint, true
+		if override.HasCredentials() {
+			nrClientConfig.ApiKey, nrClientConfig.LicenseKey, nrClientConfig.UseApiKey = override.ApiKey, override.LicenseKey, override.UseApiKey
+		}
+	}
 	if metricReportingEnabled && !ok {
-		return newNoopMetricAggregator(), fmt.Errorf("no Metrics API URL can be inferred out ot the Logs API URL %s", logsApiUrl)
+		return newNoopMetricAggregator(), fmt.Errorf("no Metrics API URL can be inferred out ot the Logs API URL %s. Please set the metricsEndpoint option", logsApiUrl)
 	}
 
 	if metricReportingEnabled {
-		licenseKey := nrClientConfig.GetNewRelicKey()
-		return newWrappedMetricAggregator(metricsApiUrl, licenseKey)
+		httpClient, err := newMetricsHTTPClient(httpClient, metricsApiUrl, !nrClientConfig.UseApiKey)
+		if err != nil {
+			return newNoopMetricAggregator(), err
+		}
+
+		harvestPeriod := nrClientConfig.MetricsHarvestPeriod
+		if harvestPeriod <= 0 {
+			harvestPeriod = defaultHarvestPeriod
+		}
+
+		aggregator, err := newWrappedMetricAggregator(metricsApiUrl, nrClientConfig.GetNewRelicKey(), httpClient, harvestPeriod)
+		if err != nil {
+			return newNoopMetricAggregator(), err
+		}
+		return aggregator, nil
 	}
 	return newNoopMetricAggregator(), nil
 }
 
-func newWrappedMetricAggregator(metricsApiUrl string, licenseKey string) (*wrappedMetricAggregator, error) {
+// inferMetricsUrl returns the Metric API URL of the same New Relic environment as the Logs, OTLP or Event API URL
+func inferMetricsUrl(logsApiUrl string) (string, bool) {
+	if metricsApiUrl, ok := logsToMetricsUrlMapping[logsApiUrl]; ok {
+		return metricsApiUrl, true
+	}
+	for eventsApiUrl, metricsApiUrl := range eventsToMetricsUrlMapping {
+		if strings.HasPrefix(logsApiUrl, eventsApiUrl) && strings.HasSuffix(logsApiUrl, "/events") {
+			return metricsApiUrl, true
+		}
+	}
+	return "", false
+}
+
+func newWrappedMetricAggregator(metricsApiUrl string, key string, httpClient *http.Client, harvestPeriod time.Duration) (*wrappedMetricAggregator, error) {
 	metricHarvester, err := telemetry.NewHarvester(
 		telemetry.ConfigMetricsURLOverride(metricsApiUrl),
-		telemetry.ConfigAPIKey(licenseKey))
+		telemetry.ConfigAPIKey(key),
+		telemetry.ConfigHarvestPeriod(0),
+		func(cfg *telemetry.Config) {
+			cfg.Client = httpClient
+			cfg.ErrorLogger = logHarvestError
+		})
 	if err != nil {
 		return nil, fmt.Errorf("can't create metrics harvester: %v", err)
 	}
 
-	return &wrappedMetricAggregator{
+	aggregator := &wrappedMetricAggregator{
+		harvester:        metricHarvester,
 		metricAggregator: metricHarvester.MetricAggregator(),
-	}, nil
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+	go aggregator.harvestLoop(harvestPeriod)
+	return aggregator, nil
+}
+
+func logHarvestError(fields map[string]interface{}) {
+	log.WithFields(fields).Warn("Error sending troubleshooting metrics")
+}
+
+// metricsTransport adapts the requests built by the telemetry SDK, which only honors the scheme and host of the
+// Metric API URL and always sends the key in the Api-Key header. It sends them to the full Metric API URL and, for
+// license keys, moves the key to the X-License-Key header.
+type metricsTransport struct {
+	base          http.RoundTripper
+	url           *url.URL
+	useLicenseKey bool
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	metricsUrl := *t.url
+	req.URL = &metricsUrl
+	req.Host = metricsUrl.Host
+	if t.useLicenseKey {
+		req.Header.Set(licenseKeyHeader, req.Header.Get(apiKeyHeader))
+		req.Header.Del(apiKeyHeader)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func newMetricsHTTPClient(httpClient *http.Client, metricsApiUrl string, useLicenseKey bool) (*http.Client, error) {
+	parsedUrl, err := url.Parse(metricsApiUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Metric API URL %s: %v", metricsApiUrl, err)
+	}
+
+	client := http.Client{}
+	if httpClient != nil {
+		client = *httpClient
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &metricsTransport{
+		base:          base,
+		url:           parsedUrl,
+		useLicenseKey: useLicenseKey,
+	}
+	return &client, nil
 }
 
 func newNoopMetricAggregator() *noopMetricAggregator {
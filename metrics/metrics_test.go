@@ -1,9 +1,14 @@
 package metrics
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
 )
 
 var _ = Describe("metrics", func() {
@@ -12,7 +17,7 @@ var _ = Describe("metrics", func() {
 			SendMetrics: false,
 		}
 
-		metricsClient, err := NewClient(nrClientConfig)
+		metricsClient, err := NewClient(nrClientConfig, nil)
 
 		Expect(err).To(BeNil())
 		Expect(metricsClient).To(BeAssignableToTypeOf(&noopMetricAggregator{}))
@@ -24,7 +29,7 @@ var _ = Describe("metrics", func() {
 			SendMetrics: true,
 		}
 
-		metricsClient, err := NewClient(nrClientConfig)
+		metricsClient, err := NewClient(nrClientConfig, nil)
 
 		Expect(err).NotTo(BeNil())
 		Expect(metricsClient).To(BeAssignableToTypeOf(&noopMetricAggregator{}))
@@ -36,7 +41,7 @@ var _ = Describe("metrics", func() {
 			SendMetrics: false,
 		}
 
-		metricsClient, err := NewClient(nrClientConfig)
+		metricsClient, err := NewClient(nrClientConfig, nil)
 
 		Expect(err).To(BeNil())
 		Expect(metricsClient).To(BeAssignableToTypeOf(&noopMetricAggregator{}))
@@ -49,9 +54,128 @@ var _ = Describe("metrics", func() {
 			SendMetrics: true,
 		}
 
-		metricsClient, err := NewClient(nrClientConfig)
+		metricsClient, err := NewClient(nrClientConfig, nil)
 
 		Expect(err).To(BeNil())
 		Expect(metricsClient).To(BeAssignableToTypeOf(&wrappedMetricAggregator{}))
 	})
+
+	It("Infers the Metric API URL from the Logs, OTLP and Event API URLs", func() {
+		urls := map[string]string{
+			"https://log-api.eu.newrelic.com/log/v1":                                   "https://metric-api.eu.newrelic.com/metric/v1",
+			"https://otlp.nr-data.net/v1/logs":                                         "https://metric-api.newrelic.com/metric/v1",
+			"https://insights-collector.newrelic.com/v1/accounts/12345/events":         "https://metric-api.newrelic.com/metric/v1",
+			"https://insights-collector.eu01.nr-data.net/v1/accounts/12345/events":     "https://metric-api.eu.newrelic.com/metric/v1",
+			"https://staging-insights-collector.newrelic.com/v1/accounts/12345/events": "https://staging-metric-api.newrelic.com/metric/v1",
+		}
+		for logsApiUrl, expected := range urls {
+			metricsApiUrl, ok := inferMetricsUrl(logsApiUrl)
+			Expect(ok).To(BeTrue())
+			Expect(metricsApiUrl).To(Equal(expected))
+		}
+
+		_, ok := inferMetricsUrl("https://insights-collector.newrelic.com/v1/accounts/12345/query")
+		Expect(ok).To(BeFalse())
+		_, ok = inferMetricsUrl("invalidOnPurpose")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Sends the pending metrics when shutting down", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/metric/v1"),
+			ghttp.RespondWith(202, nil)))
+		metricsClient, err := newWrappedMetricAggregator(server.URL()+"/metric/v1", "dummy", &http.Client{}, time.Minute)
+		Expect(err).To(BeNil())
+		metricsClient.SendSummaryDuration(PackagingTime, nil, time.Second)
+
+		metricsClient.Shutdown(context.Background())
+
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Eventually(metricsClient.stopped).Should(BeClosed())
+	})
+
+	It("Sends the license key using the X-License-Key header", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("X-License-Key", "some-license-key"),
+			func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.Header.Get("Api-Key")).To(BeEmpty())
+			},
+			ghttp.RespondWith(202, nil)))
+		httpClient, err := newMetricsHTTPClient(&http.Client{}, server.URL()+"/metric/v1", true)
+		Expect(err).To(BeNil())
+		metricsClient, err := newWrappedMetricAggregator(server.URL()+"/metric/v1", "some-license-key", httpClient, time.Minute)
+		Expect(err).To(BeNil())
+		metricsClient.SendSummaryValue(PayloadSize, nil, 1)
+
+		metricsClient.Shutdown(context.Background())
+
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("Harvests the metrics periodically using the configured period", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.SetAllowUnhandledRequests(true)
+		server.SetUnhandledRequestStatusCode(202)
+		metricsClient, err := newWrappedMetricAggregator(server.URL()+"/metric/v1", "dummy", &http.Client{}, 50*time.Millisecond)
+		Expect(err).To(BeNil())
+		defer metricsClient.Shutdown(context.Background())
+
+		metricsClient.SendSummaryValue(PayloadSize, nil, 1)
+
+		Eventually(server.ReceivedRequests).Should(HaveLen(1))
+	})
+
+	It("Sends the metrics to the metricsEndpoint using its own credentials when provided", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/relay/metric/v1"),
+			ghttp.VerifyHeaderKV("Api-Key", "metrics-insert-key"),
+			ghttp.RespondWith(202, nil)))
+		nrClientConfig := config.NRClientConfig{
+			Endpoint:    "https://logs-relay.example.com/log/v1",
+			LicenseKey:  "some-license-key",
+			SendMetrics: true,
+			MetricsEndpoint: config.MetricsEndpointConfig{
+				Endpoint:  server.URL() + "/relay/metric/v1",
+				ApiKey:    "metrics-insert-key",
+				UseApiKey: true,
+			},
+		}
+
+		metricsClient, err := NewClient(nrClientConfig, nil)
+		Expect(err).To(BeNil())
+		metricsClient.SendSummaryValue(PayloadSize, nil, 1)
+		metricsClient.Shutdown(context.Background())
+
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("Sends the metrics to the metricsEndpoint using the logs credentials by default", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("X-License-Key", "some-license-key"),
+			ghttp.RespondWith(202, nil)))
+		nrClientConfig := config.NRClientConfig{
+			Endpoint:    "https://log-api.newrelic.com/log/v1",
+			LicenseKey:  "some-license-key",
+			SendMetrics: true,
+			MetricsEndpoint: config.MetricsEndpointConfig{
+				Endpoint: server.URL() + "/metric/v1",
+			},
+		}
+
+		metricsClient, err := NewClient(nrClientConfig, nil)
+		Expect(err).To(BeNil())
+		metricsClient.SendSummaryValue(PayloadSize, nil, 1)
+		metricsClient.Shutdown(context.Background())
+
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
 })
@@ -0,0 +1,297 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const prometheusPath = "/metrics"
+
+type prometheusKind int
+
+const (
+	prometheusCounter prometheusKind = iota
+	prometheusGauge
+	prometheusSummary
+)
+
+func (k prometheusKind) String() string {
+	switch k {
+	case prometheusCounter:
+		return "counter"
+	case prometheusGauge:
+		return "gauge"
+	default:
+		return "summary"
+	}
+}
+
+type prometheusSeries struct {
+	name   string
+	kind   prometheusKind
+	labels string
+	value  float64
+	count  float64
+}
+
+// prometheusRegistry holds the series of all the clients sharing a listen address, and serves them in Prometheus
+// text format. It is shut down when the last client sharing it is shut down.
+type prometheusRegistry struct {
+	mu       sync.Mutex
+	address  string
+	series   map[string]*prometheusSeries
+	listener net.Listener
+	server   *http.Server
+	clients  int
+}
+
+var (
+	prometheusRegistriesMu sync.Mutex
+	prometheusRegistries   = make(map[string]*prometheusRegistry)
+)
+
+// acquirePrometheusRegistry returns the registry listening on the address, starting it if needed
+func acquirePrometheusRegistry(address string) (*prometheusRegistry, error) {
+	prometheusRegistriesMu.Lock()
+	defer prometheusRegistriesMu.Unlock()
+
+	registry, ok := prometheusRegistries[address]
+	if !ok {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("can't listen on %s to expose Prometheus metrics: %v", address, err)
+		}
+
+		registry = &prometheusRegistry{
+			address:  address,
+			series:   make(map[string]*prometheusSeries),
+			listener: listener,
+		}
+		mux := http.NewServeMux()
+		mux.Handle(prometheusPath, registry)
+		registry.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := registry.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.WithField("address", address).WithField("error", err).Error("Error serving Prometheus metrics")
+			}
+		}()
+		prometheusRegistries[address] = registry
+		log.WithField("address", listener.Addr().String()).Info("Exposing Prometheus metrics")
+	}
+	registry.clients++
+	return registry, nil
+}
+
+func (r *prometheusRegistry) release(ctx context.Context) {
+	prometheusRegistriesMu.Lock()
+	defer prometheusRegistriesMu.Unlock()
+
+	r.clients--
+	if r.clients > 0 {
+		return
+	}
+	delete(prometheusRegistries, r.address)
+	if err := r.server.Shutdown(ctx); err != nil {
+		log.WithField("address", r.address).WithField("error", err).Warn("Error stopping the Prometheus listener")
+	}
+}
+
+func (r *prometheusRegistry) record(name string, kind prometheusKind, labels string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := name + labels
+	series, ok := r.series[key]
+	if !ok {
+		series = &prometheusSeries{name: name, kind: kind, labels: labels}
+		r.series[key] = series
+	}
+
+	switch kind {
+	case prometheusCounter:
+		series.value += value
+	case prometheusGauge:
+		series.value = value
+	case prometheusSummary:
+		series.value += value
+		series.count++
+	}
+}
+
+func (r *prometheusRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.render(w)
+}
+
+// render writes all the series in Prometheus text format, grouped by metric name
+func (r *prometheusRegistry) render(w io.Writer) {
+	r.mu.Lock()
+	series := make([]prometheusSeries, 0, len(r.series))
+	for _, s := range r.series {
+		series = append(series, *s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	var lastName string
+	for _, s := range series {
+		if s.name != lastName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.kind)
+			lastName = s.name
+		}
+		if s.kind == prometheusSummary {
+			fmt.Fprintf(w, "%s_sum%s %v\n", s.name, s.labels, s.value)
+			fmt.Fprintf(w, "%s_count%s %v\n", s.name, s.labels, s.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %v\n", s.name, s.labels, s.value)
+		}
+	}
+}
+
+// prometheusClient is a Client that exposes the metrics through a local HTTP listener in Prometheus text format.
+// Metric names are converted to the Prometheus conventions (e.g. logs.fb.records.sent becomes
+// logs_fb_records_sent_total), and durations are exposed in seconds.
+type prometheusClient struct {
+	registry     *prometheusRegistry
+	labels       map[string]string
+	shutdownOnce sync.Once
+}
+
+func newPrometheusClient(cfg config.PrometheusConfig) (*prometheusClient, error) {
+	registry, err := acquirePrometheusRegistry(cfg.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &prometheusClient{
+		registry: registry,
+		labels:   cfg.Labels,
+	}, nil
+}
+
+func (c *prometheusClient) SendSummaryDuration(metricName string, attributes map[string]interface{}, duration time.Duration) {
+	c.registry.record(prometheusName(metricName)+"_seconds", prometheusSummary, c.renderLabels(attributes), duration.Seconds())
+}
+
+func (c *prometheusClient) SendSummaryValue(metricName string, attributes map[string]interface{}, value float64) {
+	c.registry.record(prometheusName(metricName), prometheusSummary, c.renderLabels(attributes), value)
+}
+
+func (c *prometheusClient) SendCount(metricName string, attributes map[string]interface{}, value float64) {
+	c.registry.record(prometheusName(metricName)+"_total", prometheusCounter, c.renderLabels(attributes), value)
+}
+
+func (c *prometheusClient) SendGauge(metricName string, attributes map[string]interface{}, value float64) {
+	c.registry.record(prometheusName(metricName), prometheusGauge, c.renderLabels(attributes), value)
+}
+
+func (c *prometheusClient) Shutdown(ctx context.Context) {
+	c.shutdownOnce.Do(func() {
+		c.registry.release(ctx)
+	})
+}
+
+// renderLabels merges the labels of the client with the attributes of a metric, rendering them sorted by name
+func (c *prometheusClient) renderLabels(attributes map[string]interface{}) string {
+	labels := make(map[string]string, len(c.labels)+len(attributes))
+	for name, value := range c.labels {
+		labels[prometheusName(name)] = value
+	}
+	for name, value := range attributes {
+		labels[prometheusName(name)] = fmt.Sprint(value)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(labels[name]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusName replaces the characters not allowed in Prometheus metric and label names by underscores
+func prometheusName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// fanoutClient sends the metrics to several clients
+type fanoutClient struct {
+	clients []Client
+}
+
+func (f *fanoutClient) SendSummaryDuration(metricName string, attributes map[string]interface{}, duration time.Duration) {
+	for _, c := range f.clients {
+		c.SendSummaryDuration(metricName, attributes, duration)
+	}
+}
+
+func (f *fanoutClient) SendSummaryValue(metricName string, attributes map[string]interface{}, value float64) {
+	for _, c := range f.clients {
+		c.SendSummaryValue(metricName, attributes, value)
+	}
+}
+
+func (f *fanoutClient) SendCount(metricName string, attributes map[string]interface{}, value float64) {
+	for _, c := range f.clients {
+		c.SendCount(metricName, attributes, value)
+	}
+}
+
+func (f *fanoutClient) SendGauge(metricName string, attributes map[string]interface{}, value float64) {
+	for _, c := range f.clients {
+		c.SendGauge(metricName, attributes, value)
+	}
+}
+
+func (f *fanoutClient) Shutdown(ctx context.Context) {
+	for _, c := range f.clients {
+		c.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Prometheus client", func() {
+	var client *prometheusClient
+
+	BeforeEach(func() {
+		var err error
+		client, err = newPrometheusClient(config.PrometheusConfig{
+			ListenAddress: "127.0.0.1:0",
+			Labels:        map[string]string{"output": "newrelic.0"},
+		})
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		client.Shutdown(context.Background())
+	})
+
+	render := func() string {
+		var buf bytes.Buffer
+		client.registry.render(&buf)
+		return buf.String()
+	}
+
+	It("exposes counters, gauges and summaries with the instance labels", func() {
+		// When
+		client.SendCount(RecordsSent, nil, 2)
+		client.SendCount(RecordsSent, nil, 3)
+		client.SendGauge(CompressionRatio, map[string]interface{}{"compression": "gzip"}, 4)
+		client.SendGauge(CompressionRatio, map[string]interface{}{"compression": "gzip"}, 5)
+		client.SendSummaryValue(PayloadSize, map[string]interface{}{"statusCode": 202, "hasError": false}, 100)
+		client.SendSummaryValue(PayloadSize, map[string]interface{}{"statusCode": 202, "hasError": false}, 50)
+		client.SendSummaryDuration(PackagingTime, nil, 1500*time.Millisecond)
+
+		// Then
+		Expect(render()).To(Equal(`# TYPE logs_fb_compression_ratio gauge
+logs_fb_compression_ratio{compression="gzip",output="newrelic.0"} 5
+# TYPE logs_fb_packaging_time_seconds summary
+logs_fb_packaging_time_seconds_sum{output="newrelic.0"} 1.5
+logs_fb_packaging_time_seconds_count{output="newrelic.0"} 1
+# TYPE logs_fb_payload_size summary
+logs_fb_payload_size_sum{hasError="false",output="newrelic.0",statusCode="202"} 150
+logs_fb_payload_size_count{hasError="false",output="newrelic.0",statusCode="202"} 2
+# TYPE logs_fb_records_sent_total counter
+logs_fb_records_sent_total{output="newrelic.0"} 5
+`))
+	})
+
+	It("escapes label values", func() {
+		// When
+		client.SendCount(RecordsDropped, map[string]interface{}{"reason": "a \"quoted\"\nvalue"}, 1)
+
+		// Then
+		Expect(render()).To(ContainSubstring(`reason="a \"quoted\"\nvalue"`))
+	})
+
+	It("serves the metrics over HTTP, sharing the listener between clients", func() {
+		// Given
+		otherClient, err := newPrometheusClient(config.PrometheusConfig{
+			ListenAddress: "127.0.0.1:0",
+			Labels:        map[string]string{"output": "newrelic.1"},
+		})
+		Expect(err).To(BeNil())
+		Expect(otherClient.registry).To(BeIdenticalTo(client.registry))
+		client.SendCount(RecordsReceived, nil, 1)
+		otherClient.SendCount(RecordsReceived, nil, 2)
+
+		// When
+		resp, err := http.Get("http://" + client.registry.listener.Addr().String() + "/metrics")
+
+		// Then
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(ContainSubstring(`logs_fb_records_received_total{output="newrelic.0"} 1`))
+		Expect(string(body)).To(ContainSubstring(`logs_fb_records_received_total{output="newrelic.1"} 2`))
+
+		// The listener is kept open until the last client is shut down
+		otherClient.Shutdown(context.Background())
+		_, err = http.Get("http://" + client.registry.listener.Addr().String() + "/metrics")
+		Expect(err).To(BeNil())
+	})
+
+	It("is combined with the New Relic client when both are enabled", func() {
+		// When
+		metricsClient, err := NewClient(config.NRClientConfig{
+			Endpoint:    "https://log-api.newrelic.com/log/v1",
+			LicenseKey:  "dummy",
+			SendMetrics: true,
+			Prometheus:  config.PrometheusConfig{ListenAddress: "127.0.0.1:0"},
+		}, nil)
+		defer metricsClient.Shutdown(context.Background())
+
+		// Then
+		Expect(err).To(BeNil())
+		Expect(metricsClient).To(BeAssignableToTypeOf(&fanoutClient{}))
+	})
+})
@@ -0,0 +1,147 @@
+package nrclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	log "github.com/sirupsen/logrus"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+type circuitResult int
+
+const (
+	circuitSuccess circuitResult = iota
+	circuitFailure
+	// circuitIgnored is reported when the request didn't reach the endpoint for reasons unrelated to its
+	// health (e.g. rate limiting), so it must not change the state of the circuit breaker
+	circuitIgnored
+)
+
+// circuitBreaker stops sending requests to New Relic after a number of consecutive failures. While it is open,
+// requests are rejected immediately. After the cooldown period it becomes half-open, letting a single trial
+// request through: if it succeeds the circuit is closed again, otherwise it is reopened.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+	now                 func() time.Time
+}
+
+// newCircuitBreaker returns nil when the circuit breaker is disabled
+func newCircuitBreaker(cfg config.CircuitBreakerConfig) *circuitBreaker {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: cfg.Threshold,
+		cooldown:  cfg.Cooldown,
+		state:     circuitClosed,
+		now:       time.Now,
+	}
+}
+
+// allow returns true if a request can be sent. Every allowed request must be followed by a call to report.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.transition(circuitHalfOpen)
+		cb.trialInFlight = true
+		return true
+	case circuitHalfOpen:
+		if cb.trialInFlight {
+			return false
+		}
+		cb.trialInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// rejecting returns true if allow would reject a request right now, without changing the state of the circuit breaker
+func (cb *circuitBreaker) rejecting() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		return cb.now().Sub(cb.openedAt) < cb.cooldown
+	case circuitHalfOpen:
+		return cb.trialInFlight
+	default:
+		return false
+	}
+}
+
+// report updates the state of the circuit breaker with the result of an allowed request
+func (cb *circuitBreaker) report(result circuitResult) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.trialInFlight = false
+	}
+
+	switch result {
+	case circuitSuccess:
+		cb.consecutiveFailures = 0
+		if cb.state == circuitHalfOpen {
+			cb.transition(circuitClosed)
+		}
+	case circuitFailure:
+		cb.consecutiveFailures++
+		if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.consecutiveFailures >= cb.threshold) {
+			cb.openedAt = cb.now()
+			cb.transition(circuitOpen)
+		}
+	}
+}
+
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// transition must be called holding the lock
+func (cb *circuitBreaker) transition(to circuitState) {
+	logger := log.WithField("from", cb.state.String()).WithField("to", to.String())
+	if to == circuitOpen {
+		logger.WithField("consecutiveFailures", cb.consecutiveFailures).WithField("cooldown", cb.cooldown).
+			Warn("Circuit breaker opened. Logs will be retried later without contacting New Relic")
+	} else {
+		logger.Info("Circuit breaker state changed")
+	}
+	cb.state = to
+}
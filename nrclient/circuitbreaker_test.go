@@ -0,0 +1,244 @@
+package nrclient
+
+import (
+	"os"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	var server *ghttp.Server
+	var nrClient *NRClient
+	var mockMetricsClient *mockMetricsAggregator
+	var now time.Time
+	httpSuccessCode := 202
+	httpServerErrorCode := 503
+	httpClientErrorCode := 400
+	logRecords := []record.LogRecord{
+		{
+			"timestamp": 1,
+			"message":   "Some message 1",
+		},
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.SetAllowUnhandledRequests(true)
+		server.SetUnhandledRequestStatusCode(httpServerErrorCode)
+
+		mockMetricsClient = newMockMetricsAggregatorProvider()
+		mockMetricsClient.On("SendSummaryDuration", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
+
+		var err error
+		nrClient, err = NewNRClient(config.NRClientConfig{
+			Endpoint:       server.URL() + "/v1/logs",
+			LicenseKey:     "some-license-key",
+			TimeoutSeconds: 2,
+			Compression:    config.Gzip,
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Threshold: 2,
+				Cooldown:  30 * time.Second,
+			},
+		}, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		now = time.Now()
+		nrClient.breaker.now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("opens after the configured consecutive failures and rejects chunks without sending them", func() {
+		// When
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		retry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(retry).To(BeTrue())
+		Expect(err).To(Equal(errCircuitOpen))
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitOpen))
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendSummaryValue", "logs.fb.circuitbreaker.rejected.records", mock.Anything, float64(1))
+		mockMetricsClient.AssertNotCalled(GinkgoT(), "SendSummaryValue", "logs.fb.payload.count", mock.Anything, float64(3))
+	})
+
+	It("doesn't package the records while open, and packages them when sending once the cooldown has elapsed", func() {
+		// Given
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+
+		// When
+		batch := nrClient.Package(logRecords)
+
+		// Then
+		Expect(batch.packaged).To(BeFalse())
+		Expect(batch.payloads).To(BeNil())
+		retry, err := nrClient.SendBatch(batch)
+		Expect(retry).To(BeTrue())
+		Expect(err).To(Equal(errCircuitOpen))
+		Expect(batch.packaged).To(BeFalse())
+
+		// When the cooldown elapses before the batch is sent
+		batch = nrClient.Package(logRecords)
+		now = now.Add(30 * time.Second)
+		server.SetUnhandledRequestStatusCode(httpSuccessCode)
+		retry, err = nrClient.SendBatch(batch)
+
+		// Then
+		Expect(retry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(batch.packaged).To(BeTrue())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("does not open when the failures are not consecutive", func() {
+		// Given
+		nrClient.Send(logRecords)
+		server.AppendHandlers(ghttp.RespondWith(httpSuccessCode, nil))
+		nrClient.Send(logRecords)
+
+		// When
+		nrClient.Send(logRecords)
+
+		// Then
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitClosed))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("does not count non-retryable errors as failures", func() {
+		// Given
+		server.SetUnhandledRequestStatusCode(httpClientErrorCode)
+
+		// When
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+
+		// Then
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitClosed))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("closes after a successful trial request once the cooldown has elapsed", func() {
+		// Given
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		now = now.Add(30 * time.Second)
+		server.SetUnhandledRequestStatusCode(httpSuccessCode)
+
+		// When
+		retry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(retry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitClosed))
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendSummaryValue", "logs.fb.circuitbreaker.state",
+			map[string]interface{}{"state": "half-open"}, float64(1))
+	})
+
+	It("reopens after a failed trial request", func() {
+		// Given
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		now = now.Add(30 * time.Second)
+		nrClient.Send(logRecords)
+
+		// When
+		now = now.Add(29 * time.Second)
+		retry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(retry).To(BeTrue())
+		Expect(err).To(Equal(errCircuitOpen))
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitOpen))
+	})
+
+	for _, action := range []config.RateLimitAction{config.RateLimitDrop, config.RateLimitSpill} {
+		action := action
+		It("stays half-open when the trial chunk is rate limited with the "+action.String()+" action", func() {
+			// Given
+			spillDir, err := os.MkdirTemp("", "nr-spill")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(spillDir)
+			nrClient.config.RateLimit = config.RateLimitConfig{
+				RecordsPerSecond: 1,
+				Action:           action,
+				SpillDir:         spillDir,
+				SpillMaxBytes:    1 << 20,
+			}
+			nrClient.rateLimiter = newRateLimiter(nrClient.config.RateLimit)
+			limiterNow := now
+			nrClient.rateLimiter.now = func() time.Time { return limiterNow }
+			nrClient.rateLimiter.records.take(1)
+			if action == config.RateLimitSpill {
+				nrClient.spillQueue, err = newSpillQueue(spillDir, 1<<20)
+				Expect(err).To(BeNil())
+			}
+			nrClient.breaker.report(circuitFailure)
+			nrClient.breaker.report(circuitFailure)
+			now = now.Add(30 * time.Second)
+
+			// When
+			retry, err := nrClient.Send(logRecords)
+
+			// Then
+			Expect(retry).To(BeFalse())
+			Expect(err).To(BeNil())
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+			Expect(nrClient.breaker.currentState()).To(Equal(circuitHalfOpen))
+			Expect(nrClient.breaker.rejecting()).To(BeFalse())
+		})
+	}
+
+	It("stays half-open when the trial chunk has no payload to send", func() {
+		// Given
+		nrClient.breaker.report(circuitFailure)
+		nrClient.breaker.report(circuitFailure)
+		now = now.Add(30 * time.Second)
+		batch := &Batch{records: 1, packaged: true}
+
+		// When
+		retry, err := nrClient.SendBatch(batch)
+
+		// Then
+		Expect(retry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+		Expect(nrClient.breaker.currentState()).To(Equal(circuitHalfOpen))
+	})
+
+	It("lets a single trial request through while half-open", func() {
+		// Given
+		breaker := nrClient.breaker
+		breaker.report(circuitFailure)
+		breaker.report(circuitFailure)
+		now = now.Add(30 * time.Second)
+
+		// When
+		firstAllowed := breaker.allow()
+		secondAllowed := breaker.allow()
+		breaker.report(circuitIgnored)
+		thirdAllowed := breaker.allow()
+
+		// Then
+		Expect(firstAllowed).To(BeTrue())
+		Expect(secondAllowed).To(BeFalse())
+		Expect(thirdAllowed).To(BeTrue())
+		Expect(breaker.currentState()).To(Equal(circuitHalfOpen))
+	})
+})
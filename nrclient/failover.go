@@ -0,0 +1,121 @@
+package nrclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// failover switches from the primary to the secondary endpoint after a number of consecutive failures on the
+// primary one. While the secondary endpoint is active, the primary one is periodically probed by sending it a
+// single payload, switching back to it as soon as a probe succeeds.
+type failover struct {
+	mu                  sync.Mutex
+	primary             config.NRClientConfig
+	secondary           config.NRClientConfig
+	threshold           int
+	probeInterval       time.Duration
+	consecutiveFailures int
+	onSecondary         bool
+	lastProbe           time.Time
+	now                 func() time.Time
+}
+
+// newFailover returns nil when no secondary endpoint has been configured
+func newFailover(cfg config.NRClientConfig) *failover {
+	if !cfg.Failover.Enabled() {
+		return nil
+	}
+
+	secondary := cfg
+	secondary.Endpoint = cfg.Failover.Endpoint
+	if len(cfg.Failover.ApiKey) > 0 || len(cfg.Failover.LicenseKey) > 0 {
+		secondary.ApiKey = cfg.Failover.ApiKey
+		secondary.LicenseKey = cfg.Failover.LicenseKey
+		secondary.UseApiKey = cfg.Failover.UseApiKey
+	}
+
+	return &failover{
+		primary:       cfg,
+		secondary:     secondary,
+		threshold:     cfg.Failover.Threshold,
+		probeInterval: cfg.Failover.ProbeInterval,
+		now:           time.Now,
+	}
+}
+
+// target returns the configuration of the endpoint the next payload must be sent to. probing is true if the
+// payload is being used to probe the primary endpoint while the secondary one is active.
+func (f *failover) target() (cfg config.NRClientConfig, probing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.onSecondary {
+		return f.primary, false
+	}
+
+	if now := f.now(); now.Sub(f.lastProbe) >= f.probeInterval {
+		f.lastProbe = now
+		return f.primary, true
+	}
+	return f.secondary, false
+}
+
+// report updates the failover state with the result of sending a payload to the endpoint returned by target.
+// It returns true if the active endpoint changed.
+func (f *failover) report(cfg config.NRClientConfig, probing bool, failed bool) (switched bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cfg.Endpoint != f.primary.Endpoint {
+		return false
+	}
+
+	if probing {
+		if !failed {
+			f.onSecondary = false
+			f.consecutiveFailures = 0
+			log.WithField("endpoint", f.primary.Endpoint).Info("Primary endpoint recovered. Switching back to it")
+			return true
+		}
+		log.WithField("endpoint", f.primary.Endpoint).Debug("Primary endpoint is still failing")
+		return false
+	}
+
+	if !failed {
+		f.consecutiveFailures = 0
+		return false
+	}
+
+	f.consecutiveFailures++
+	if f.onSecondary || f.consecutiveFailures < f.threshold {
+		return false
+	}
+
+	f.onSecondary = true
+	f.lastProbe = f.now()
+	log.WithField("endpoint", f.primary.Endpoint).
+		WithField("failoverEndpoint", f.secondary.Endpoint).
+		WithField("consecutiveFailures", f.consecutiveFailures).
+		Warn("Primary endpoint keeps failing. Switching to the failover endpoint")
+	return true
+}
+
+// active returns the endpoint currently in use and its role (primary or secondary)
+func (f *failover) active() (endpoint string, role string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.onSecondary {
+		return f.secondary.Endpoint, "secondary"
+	}
+	return f.primary.Endpoint, "primary"
+}
+
+// isFailoverError returns true for the errors that count as a failure of the endpoint: connection errors and
+// 5XX HTTP status codes.
+func isFailoverError(statusCode int, err error) bool {
+	return err != nil || statusCode/100 == 5
+}
@@ -0,0 +1,150 @@
+package nrclient
+
+import (
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Failover", func() {
+	var primaryServer, secondaryServer *ghttp.Server
+	var nrClient *NRClient
+	var mockMetricsClient *mockMetricsAggregator
+	var now time.Time
+	httpSuccessCode := 202
+	httpServerErrorCode := 503
+	httpClientErrorCode := 400
+	logRecords := []record.LogRecord{
+		{
+			"timestamp": 1,
+			"message":   "Some message 1",
+		},
+	}
+
+	BeforeEach(func() {
+		primaryServer = ghttp.NewServer()
+		secondaryServer = ghttp.NewServer()
+		primaryServer.SetAllowUnhandledRequests(true)
+		primaryServer.SetUnhandledRequestStatusCode(httpServerErrorCode)
+		secondaryServer.SetAllowUnhandledRequests(true)
+		secondaryServer.SetUnhandledRequestStatusCode(httpSuccessCode)
+
+		mockMetricsClient = newMockMetricsAggregatorProvider()
+		mockMetricsClient.On("SendSummaryDuration", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
+
+		var err error
+		nrClient, err = NewNRClient(config.NRClientConfig{
+			Endpoint:       primaryServer.URL() + "/v1/logs",
+			LicenseKey:     "some-license-key",
+			TimeoutSeconds: 2,
+			Compression:    config.Gzip,
+			Failover: config.FailoverConfig{
+				Endpoint:      secondaryServer.URL() + "/v1/logs",
+				Threshold:     2,
+				ProbeInterval: time.Minute,
+			},
+		}, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		now = time.Now()
+		nrClient.failover.now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		primaryServer.Close()
+		secondaryServer.Close()
+	})
+
+	It("switches to the secondary endpoint after the configured consecutive failures", func() {
+		// When
+		firstRetry, _ := nrClient.Send(logRecords)
+		secondRetry, secondErr := nrClient.Send(logRecords)
+		thirdRetry, thirdErr := nrClient.Send(logRecords)
+
+		// Then
+		Expect(firstRetry).To(BeTrue())
+		// The payload that triggered the switch is delivered to the secondary endpoint
+		Expect(secondRetry).To(BeFalse())
+		Expect(secondErr).To(BeNil())
+		Expect(thirdRetry).To(BeFalse())
+		Expect(thirdErr).To(BeNil())
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(2))
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(2))
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendGauge", "logs.fb.endpoint.active",
+			map[string]interface{}{"endpoint": secondaryServer.URL() + "/v1/logs", "role": "secondary"}, float64(1))
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendGauge", "logs.fb.endpoint.active",
+			map[string]interface{}{"endpoint": primaryServer.URL() + "/v1/logs", "role": "primary"}, float64(0))
+	})
+
+	It("doesn't switch on non-5XX HTTP status codes", func() {
+		// Given
+		primaryServer.SetUnhandledRequestStatusCode(httpClientErrorCode)
+
+		// When
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+
+		// Then
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(3))
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(0))
+	})
+
+	It("probes the primary endpoint periodically and switches back to it when it recovers", func() {
+		// Given
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(1))
+
+		// When the primary endpoint is probed while still failing
+		now = now.Add(time.Minute)
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then the payload is delivered to the secondary endpoint
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(3))
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(2))
+
+		// When the primary endpoint is probed after recovering
+		primaryServer.SetUnhandledRequestStatusCode(httpSuccessCode)
+		now = now.Add(time.Minute)
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+
+		// Then it is used again
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(5))
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(2))
+		endpoint, role := nrClient.failover.active()
+		Expect(endpoint).To(Equal(primaryServer.URL() + "/v1/logs"))
+		Expect(role).To(Equal("primary"))
+	})
+
+	It("sends the payload of a failed probe straight to the secondary endpoint", func() {
+		// Given
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(2))
+
+		// When a new probe would be due every time the failover checks the time
+		nrClient.failover.now = func() time.Time {
+			now = now.Add(time.Minute)
+			return now
+		}
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then the primary endpoint is probed only once
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(3))
+		Expect(secondaryServer.ReceivedRequests()).To(HaveLen(2))
+	})
+})
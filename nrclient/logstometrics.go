@@ -0,0 +1,109 @@
+package nrclient
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	log "github.com/sirupsen/logrus"
+)
+
+type logToMetricRule struct {
+	config.LogToMetricConfig
+	matcher *record.Matcher
+}
+
+// LogsToMetrics derives metrics from the records matching a set of rules, optionally dropping those records
+type LogsToMetrics struct {
+	rules         []logToMetricRule
+	metricsClient metrics.Client
+}
+
+// DerivedMetric is a metric value derived from a record, reported once the chunk of the record has been processed
+type DerivedMetric struct {
+	rule       *logToMetricRule
+	dimensions map[string]interface{}
+	value      float64
+}
+
+func NewLogsToMetrics(cfgs []config.LogToMetricConfig, metricsClient metrics.Client) (*LogsToMetrics, error) {
+	logsToMetrics := &LogsToMetrics{metricsClient: metricsClient}
+	for _, cfg := range cfgs {
+		matcher, err := record.NewMatcher(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cfg.Name, err)
+		}
+		logsToMetrics.rules = append(logsToMetrics.rules, logToMetricRule{LogToMetricConfig: cfg, matcher: matcher})
+	}
+	return logsToMetrics, nil
+}
+
+// Derive evaluates the rules against the records, returning the derived metrics and the records to be sent (the
+// ones not matching any rule that drops them). Every rule a record matches derives a metric.
+func (l *LogsToMetrics) Derive(logRecords []record.LogRecord, tag string) (kept []record.LogRecord, derived []DerivedMetric) {
+	kept = make([]record.LogRecord, 0, len(logRecords))
+	for _, logRecord := range logRecords {
+		drop := false
+		for i := range l.rules {
+			rule := &l.rules[i]
+			if !rule.matcher.Matches(logRecord, tag) {
+				continue
+			}
+			drop = drop || rule.DropLogs
+
+			value := 1.0
+			if len(rule.ValueKey) > 0 {
+				rawValue, _ := record.LookupAttribute(logRecord, rule.ValueKey)
+				var ok bool
+				if value, ok = record.AsFloat(rawValue); !ok {
+					log.WithField("rule", rule.Name).WithField("attribute", rule.ValueKey).Debug("Record matching a logs to metrics rule has no numeric value")
+					continue
+				}
+			}
+
+			derived = append(derived, DerivedMetric{
+				rule:       rule,
+				dimensions: dimensionsOf(logRecord, rule.Dimensions),
+				value:      value,
+			})
+		}
+		if !drop {
+			kept = append(kept, logRecord)
+		}
+	}
+	return kept, derived
+}
+
+// Report sends the derived metrics
+func (l *LogsToMetrics) Report(derived []DerivedMetric) {
+	for _, metric := range derived {
+		switch metric.rule.Type {
+		case config.LogToMetricCount:
+			l.metricsClient.SendCount(metric.rule.Metric, metric.dimensions, metric.value)
+		case config.LogToMetricGauge:
+			l.metricsClient.SendGauge(metric.rule.Metric, metric.dimensions, metric.value)
+		case config.LogToMetricSummary:
+			l.metricsClient.SendSummaryValue(metric.rule.Metric, metric.dimensions, metric.value)
+		}
+	}
+}
+
+// Close sends the metrics derived since the last harvest
+func (l *LogsToMetrics) Close(ctx context.Context) {
+	l.metricsClient.Shutdown(ctx)
+}
+
+func dimensionsOf(logRecord record.LogRecord, keys []string) map[string]interface{} {
+	if len(keys) == 0 {
+		return nil
+	}
+	dimensions := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := record.LookupAttribute(logRecord, key); ok {
+			dimensions[key] = fmt.Sprint(value)
+		}
+	}
+	return dimensions
+}
@@ -0,0 +1,103 @@
+package nrclient
+
+import (
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	"github.com/stretchr/testify/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logs to metrics", func() {
+	var mockMetricsClient *mockMetricsAggregator
+	logRecords := []record.LogRecord{
+		{"service": "checkout", "status": "500", "duration_ms": 120},
+		{"service": "checkout", "status": "200", "duration_ms": "30.5"},
+		{"service": "payments", "status": "503"},
+	}
+
+	BeforeEach(func() {
+		mockMetricsClient = newMockMetricsAggregatorProvider()
+		mockMetricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
+	})
+
+	It("derives counts and summaries with dimensions out of the matching records", func() {
+		logsToMetrics, err := NewLogsToMetrics([]config.LogToMetricConfig{
+			{Name: "errors", Match: "status~^5", Metric: "http.errors", Type: config.LogToMetricCount, Dimensions: []string{"service"}},
+			{Name: "latency", Match: "service=checkout", Metric: "http.duration", Type: config.LogToMetricSummary, ValueKey: "duration_ms"},
+		}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		kept, derived := logsToMetrics.Derive(logRecords, "tag")
+		logsToMetrics.Report(derived)
+
+		testingT := GinkgoT()
+		Expect(kept).To(Equal(logRecords))
+		mockMetricsClient.AssertCalled(testingT, "SendCount", "http.errors", map[string]interface{}{"service": "checkout"}, float64(1))
+		mockMetricsClient.AssertCalled(testingT, "SendCount", "http.errors", map[string]interface{}{"service": "payments"}, float64(1))
+		mockMetricsClient.AssertCalled(testingT, "SendSummaryValue", "http.duration", map[string]interface{}(nil), float64(120))
+		mockMetricsClient.AssertCalled(testingT, "SendSummaryValue", "http.duration", map[string]interface{}(nil), 30.5)
+		mockMetricsClient.AssertNumberOfCalls(testingT, "SendCount", 2)
+		mockMetricsClient.AssertNumberOfCalls(testingT, "SendSummaryValue", 2)
+	})
+
+	It("skips the records without a numeric value", func() {
+		logsToMetrics, err := NewLogsToMetrics([]config.LogToMetricConfig{
+			{Name: "latency", Match: "service=payments", Metric: "http.duration", Type: config.LogToMetricGauge, ValueKey: "duration_ms"},
+		}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		_, derived := logsToMetrics.Derive(logRecords, "tag")
+
+		Expect(derived).To(BeEmpty())
+	})
+
+	It("skips the records whose value isn't a finite number", func() {
+		logsToMetrics, err := NewLogsToMetrics([]config.LogToMetricConfig{
+			{Name: "latency", Match: "service=checkout", Metric: "http.duration", Type: config.LogToMetricGauge, ValueKey: "duration_ms"},
+		}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		_, derived := logsToMetrics.Derive([]record.LogRecord{
+			{"service": "checkout", "duration_ms": "NaN"},
+			{"service": "checkout", "duration_ms": "Inf"},
+			{"service": "checkout", "duration_ms": "+Infinity"},
+		}, "tag")
+
+		Expect(derived).To(BeEmpty())
+	})
+
+	It("drops the records matching a rule configured to drop them", func() {
+		logsToMetrics, err := NewLogsToMetrics([]config.LogToMetricConfig{
+			{Name: "ok", Match: "status=200", Metric: "http.ok", Type: config.LogToMetricCount, DropLogs: true},
+		}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		kept, derived := logsToMetrics.Derive(logRecords, "tag")
+
+		Expect(kept).To(Equal([]record.LogRecord{logRecords[0], logRecords[2]}))
+		Expect(derived).To(HaveLen(1))
+	})
+
+	It("doesn't report anything until Report is called", func() {
+		logsToMetrics, err := NewLogsToMetrics([]config.LogToMetricConfig{
+			{Name: "all", Match: "$tag=tag", Metric: "records", Type: config.LogToMetricCount},
+		}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		_, derived := logsToMetrics.Derive(logRecords, "tag")
+
+		Expect(derived).To(HaveLen(3))
+		testingT := GinkgoT()
+		mockMetricsClient.AssertNotCalled(testingT, "SendCount", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	It("fails to build rules with invalid match expressions", func() {
+		_, err := NewLogsToMetrics([]config.LogToMetricConfig{{Name: "invalid", Match: "status", Metric: "m"}}, mockMetricsClient)
+
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,142 @@
+package nrclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorQueueSize is the maximum amount of payloads waiting to be sent to each mirror
+const mirrorQueueSize = 64
+
+// mirror is an additional endpoint, with its own credentials, HTTP client and metrics, that receives a copy of every
+// payload accepted by the primary endpoint. Payloads are sent in the background, one at a time, so that a slow mirror
+// never delays the flushes.
+type mirror struct {
+	name          string
+	config        config.NRClientConfig
+	client        *http.Client
+	metricsClient metrics.Client
+	queue         chan []byte
+	done          chan struct{}
+
+	// closeMu guards closed, ensuring nothing is queued once the queue has been closed
+	closeMu sync.Mutex
+	closed  bool
+}
+
+// newMirrors creates the mirrors of a client and starts sending their payloads in the background
+func newMirrors(mirrorConfigs []config.MirrorConfig, proxyCfg config.ProxyConfig) ([]*mirror, error) {
+	var mirrors []*mirror
+	for _, mirrorCfg := range mirrorConfigs {
+		httpClient, err := newHttpClient(mirrorCfg.NRClientConfig, proxyCfg)
+		if err != nil {
+			for _, m := range mirrors {
+				m.close(context.Background())
+			}
+			return nil, fmt.Errorf("mirror %s: %v", mirrorCfg.Name, err)
+		}
+
+		metricsClient, err := metrics.NewClient(mirrorCfg.NRClientConfig, httpClient)
+		if err != nil {
+			log.WithField("mirror", mirrorCfg.Name).WithField("error", err).Error("Error creating Metrics client")
+		}
+
+		m := &mirror{
+			name:          mirrorCfg.Name,
+			config:        mirrorCfg.NRClientConfig,
+			client:        httpClient,
+			metricsClient: metricsClient,
+			queue:         make(chan []byte, mirrorQueueSize),
+			done:          make(chan struct{}),
+		}
+		go m.run()
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
+
+// mirrorPayload queues a copy of the payload for each mirror. Errors are only logged, since a failure on a mirror
+// must not affect the delivery to the primary endpoint. When the queue of a mirror is full, the payload is discarded
+// for that mirror.
+func (nrClient *NRClient) mirrorPayload(payload []byte) {
+	for _, m := range nrClient.mirrors {
+		if !m.enqueue(payload) {
+			log.WithField("mirror", m.name).Warn("Mirror queue is full. Logs were not sent to the mirror.")
+			dimensions := map[string]interface{}{
+				"mirror": m.name,
+			}
+			m.metricsClient.SendCount(metrics.MirrorDroppedPayloads, dimensions, 1)
+		}
+	}
+}
+
+// enqueue adds a payload to the queue, returning false if it is full or closed
+func (m *mirror) enqueue(payload []byte) bool {
+	m.closeMu.Lock()
+	defer m.closeMu.Unlock()
+
+	if m.closed {
+		return false
+	}
+	select {
+	case m.queue <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends the queued payloads until the queue is closed
+func (m *mirror) run() {
+	defer close(m.done)
+
+	for payload := range m.queue {
+		sendStart := time.Now()
+		statusCode, err := sendPacket(m.client, payload, m.config)
+		sendTime := time.Since(sendStart)
+
+		dimensions := map[string]interface{}{
+			"statusCode":  statusCode,
+			"compression": m.config.Compression.String(),
+			"hasError":    err != nil,
+			"mirror":      m.name,
+		}
+		m.metricsClient.SendSummaryValue(metrics.PayloadSize, dimensions, float64(len(payload)))
+		m.metricsClient.SendSummaryDuration(metrics.PayloadSendTime, dimensions, sendTime)
+
+		if err != nil {
+			log.WithField("mirror", m.name).WithField("error", err).Warn("Error sending logs to mirror")
+		} else if statusCode/100 != 2 {
+			log.WithField("mirror", m.name).WithField("statusCode", statusCode).Warn("Received non-2XX HTTP status code from mirror")
+		}
+	}
+}
+
+// close stops accepting payloads and waits for the queued ones to be sent until the context is done. Then it sends
+// the last harvest of metrics and closes the idle HTTP connections.
+func (m *mirror) close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.closeMu.Unlock()
+
+	var err error
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		err = fmt.Errorf("mirror %s: waiting for queued payloads: %w", m.name, ctx.Err())
+	}
+
+	m.metricsClient.Shutdown(ctx)
+	m.client.CloseIdleConnections()
+	return err
+}
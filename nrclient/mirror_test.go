@@ -0,0 +1,160 @@
+package nrclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Mirrors", func() {
+	var primaryServer, mirrorServer *ghttp.Server
+	var clientConfig config.NRClientConfig
+	var mockMetricsClient *mockMetricsAggregator
+	httpSuccessCode := 202
+	httpRetryableErrorCode := 503
+	logRecords := []record.LogRecord{
+		{
+			"timestamp": 1,
+			"message":   "Some message 1",
+		},
+	}
+
+	BeforeEach(func() {
+		primaryServer = ghttp.NewServer()
+		mirrorServer = ghttp.NewServer()
+
+		clientConfig = config.NRClientConfig{
+			Endpoint:       primaryServer.URL() + "/v1/logs",
+			LicenseKey:     "primary-license-key",
+			TimeoutSeconds: 2,
+			Compression:    config.Gzip,
+		}
+		mirrorConfig := clientConfig
+		mirrorConfig.Endpoint = mirrorServer.URL() + "/v1/logs"
+		mirrorConfig.LicenseKey = ""
+		mirrorConfig.ApiKey = "mirror-insert-key"
+		mirrorConfig.UseApiKey = true
+		clientConfig.Mirrors = []config.MirrorConfig{{Name: "eu", NRClientConfig: mirrorConfig}}
+
+		mockMetricsClient = newMockMetricsAggregatorProvider()
+		mockMetricsClient.On("SendSummaryDuration", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("Shutdown", mock.Anything).Return()
+	})
+
+	AfterEach(func() {
+		primaryServer.Close()
+		mirrorServer.Close()
+	})
+
+	It("sends the same payload to the mirrors using their own credentials", func() {
+		// Given
+		var primaryBody, mirrorBody []byte
+		primaryServer.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeader(http.Header{"X-License-Key": []string{"primary-license-key"}}),
+			func(w http.ResponseWriter, req *http.Request) { primaryBody, _ = readBody(req) },
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, "")))
+		mirrorServer.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyHeader(http.Header{"X-Insert-Key": []string{"mirror-insert-key"}}),
+			func(w http.ResponseWriter, req *http.Request) { mirrorBody, _ = readBody(req) },
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, "")))
+		nrClient, err := NewNRClient(clientConfig, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(primaryServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(nrClient.Close(context.Background())).To(Succeed())
+		Expect(mirrorServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(mirrorBody).NotTo(BeEmpty())
+		Expect(mirrorBody).To(Equal(primaryBody))
+	})
+
+	It("doesn't affect the primary result when a mirror fails", func() {
+		// Given
+		primaryServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		mirrorServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""))
+		nrClient, err := NewNRClient(clientConfig, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Eventually(mirrorServer.ReceivedRequests).Should(HaveLen(1))
+	})
+
+	It("doesn't wait for slow mirrors", func() {
+		// Given
+		mirrorReleased := make(chan struct{})
+		primaryServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		mirrorServer.AppendHandlers(ghttp.CombineHandlers(
+			func(w http.ResponseWriter, req *http.Request) { <-mirrorReleased },
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, "")))
+		nrClient, err := NewNRClient(clientConfig, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Eventually(mirrorServer.ReceivedRequests).Should(HaveLen(1))
+		close(mirrorReleased)
+		Expect(nrClient.Close(context.Background())).To(Succeed())
+	})
+
+	It("discards the payloads for a mirror when its queue is full", func() {
+		// Given
+		m := &mirror{name: "eu", metricsClient: mockMetricsClient, queue: make(chan []byte, 1)}
+		nrClient := &NRClient{mirrors: []*mirror{m}}
+
+		// When
+		nrClient.mirrorPayload([]byte("first"))
+		nrClient.mirrorPayload([]byte("second"))
+
+		// Then
+		Expect(m.queue).To(HaveLen(1))
+		Expect(<-m.queue).To(Equal([]byte("first")))
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendCount", metrics.MirrorDroppedPayloads, map[string]interface{}{"mirror": "eu"}, 1.0)
+	})
+
+	It("doesn't send to the mirrors the payloads the primary didn't accept, so that retries aren't mirrored twice", func() {
+		// Given
+		primaryServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""))
+		mirrorServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		nrClient, err := NewNRClient(clientConfig, config.ProxyConfig{}, mockMetricsClient)
+		Expect(err).To(BeNil())
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeTrue())
+		Expect(err).NotTo(BeNil())
+		Expect(nrClient.Close(context.Background())).To(Succeed())
+		Expect(mirrorServer.ReceivedRequests()).To(BeEmpty())
+	})
+})
+
+func readBody(req *http.Request) ([]byte, error) {
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
@@ -2,11 +2,15 @@ package nrclient
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/newrelic/newrelic-fluent-bit-output/record"
@@ -25,50 +29,318 @@ var retryableCodesSet = map[int]struct{}{
 	599: {},
 }
 
+var (
+	errRateLimited = errors.New("throughput rate limit exceeded")
+	errCircuitOpen = errors.New("circuit breaker is open")
+	errClosed      = errors.New("client is shutting down")
+)
+
 type NRClient struct {
 	client        *http.Client
 	config        config.NRClientConfig
 	metricsClient metrics.Client
+	rateLimiter   *rateLimiter
+	spillQueue    *spillQueue
+	mirrors       []*mirror
+	failover      *failover
+	breaker       *circuitBreaker
+
+	// closeMu guards closed, ensuring no new sends are added to inFlight once Close has been called
+	closeMu  sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
 }
 
 func NewNRClient(cfg config.NRClientConfig, proxyCfg config.ProxyConfig, metricsClient metrics.Client) (*NRClient, error) {
-	httpTransport, err := buildHttpTransport(proxyCfg, cfg.Endpoint)
+	httpClient, err := newHttpClient(cfg, proxyCfg)
 	if err != nil {
-		return nil, fmt.Errorf("building HTTP transport: %v", err)
+		return nil, err
+	}
+
+	mirrors, err := newMirrors(cfg.Mirrors, proxyCfg)
+	if err != nil {
+		return nil, err
 	}
 
 	nrClient := &NRClient{
-		client: &http.Client{
-			Transport: httpTransport,
-			Timeout:   time.Second * time.Duration(cfg.TimeoutSeconds),
-		},
+		client:        httpClient,
 		config:        cfg,
 		metricsClient: metricsClient,
+		rateLimiter:   newRateLimiter(cfg.RateLimit),
+		mirrors:       mirrors,
+		failover:      newFailover(cfg),
+		breaker:       newCircuitBreaker(cfg.CircuitBreaker),
+	}
+
+	if nrClient.rateLimiter != nil && cfg.RateLimit.Action == config.RateLimitSpill {
+		nrClient.spillQueue, err = newSpillQueue(cfg.RateLimit.SpillDir, cfg.RateLimit.SpillMaxBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return nrClient, nil
 }
 
+// newHttpClient returns an HTTP client sending the requests to the endpoint of the configuration through the
+// configured proxy, with the configured TLS settings and timeout
+func newHttpClient(cfg config.NRClientConfig, proxyCfg config.ProxyConfig) (*http.Client, error) {
+	httpTransport, err := buildHttpTransport(proxyCfg, cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("building HTTP transport: %v", err)
+	}
+
+	return &http.Client{
+		Transport: httpTransport,
+		Timeout:   time.Second * time.Duration(cfg.TimeoutSeconds),
+	}, nil
+}
+
+// NewMetricsClient returns a metrics client sending the troubleshooting metrics through the same proxy, with the
+// same TLS settings and timeout, used to send the logs
+func NewMetricsClient(cfg config.NRClientConfig, proxyCfg config.ProxyConfig) (metrics.Client, error) {
+	httpClient, err := newHttpClient(cfg, proxyCfg)
+	if err != nil {
+		// The metrics can still be sent without the proxy and TLS settings
+		metricsClient, _ := metrics.NewClient(cfg, nil)
+		return metricsClient, err
+	}
+
+	return metrics.NewClient(cfg, httpClient)
+}
+
+// NewLogsToMetricsClient returns a metrics client sending the metrics derived from the logs through the same proxy,
+// with the same TLS settings and timeout, used to send the logs
+func NewLogsToMetricsClient(cfg config.NRClientConfig, proxyCfg config.ProxyConfig) (metrics.Client, error) {
+	httpClient, err := newHttpClient(cfg, proxyCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics.NewLogsToMetricsClient(cfg, httpClient)
+}
+
 func (nrClient *NRClient) Send(logRecords []record.LogRecord) (retry bool, err error) {
-	packaging_start := time.Now()
-	payloads, err := record.PackageRecords(logRecords, nrClient.config.Compression)
-	packaging_time := time.Since(packaging_start)
+	return nrClient.SendBatch(nrClient.Package(logRecords))
+}
+
+// SendEncoded works as Send, with records already encoded as JSON objects. Encoded records can only be sent using the
+// JSON output format.
+func (nrClient *NRClient) SendEncoded(records []json.RawMessage) (retry bool, err error) {
+	if nrClient.config.OutputFormat != config.JsonFormat {
+		return false, fmt.Errorf("encoded records can't be sent using the %s output format", nrClient.config.OutputFormat)
+	}
+	return nrClient.SendBatch(nrClient.PackageEncoded(records))
+}
+
+// Batch holds records packaged by a client, ready to be sent by the same client
+type Batch struct {
+	records        int
+	packageRecords func() ([]record.PackagedRecords, record.PackagingStats, error)
+	packaged       bool
+	payloads       []record.PackagedRecords
+	stats          record.PackagingStats
+	duration       time.Duration
+	err            error
+}
+
+// Package packages the records as Send does, without sending them nor reporting any metric. When the client would
+// reject them (because the circuit breaker is open or the client is closed), packaging is deferred until they are
+// sent, so that the rejected chunks don't pay for it.
+func (nrClient *NRClient) Package(logRecords []record.LogRecord) *Batch {
+	return nrClient.newBatch(len(logRecords), func() ([]record.PackagedRecords, record.PackagingStats, error) {
+		return nrClient.packageRecords(logRecords)
+	})
+}
+
+// PackageEncoded packages the encoded records as SendEncoded does, in the same way as Package
+func (nrClient *NRClient) PackageEncoded(records []json.RawMessage) *Batch {
+	return nrClient.newBatch(len(records), func() ([]record.PackagedRecords, record.PackagingStats, error) {
+		if nrClient.config.OutputFormat != config.JsonFormat {
+			return nil, record.PackagingStats{}, fmt.Errorf("encoded records can't be sent using the %s output format", nrClient.config.OutputFormat)
+		}
+		return record.PackageEncodedRecords(records, nrClient.config.Compression, nrClient.config.CompressionLevel)
+	})
+}
+
+func (nrClient *NRClient) newBatch(records int, packageRecords func() ([]record.PackagedRecords, record.PackagingStats, error)) *Batch {
+	batch := &Batch{
+		records:        records,
+		packageRecords: packageRecords,
+	}
+	if !nrClient.rejecting() {
+		batch.pack()
+	}
+	return batch
+}
+
+// pack packages the records of the batch, unless they are already packaged
+func (batch *Batch) pack() {
+	if batch.packaged {
+		return
+	}
+	packagingStart := time.Now()
+	batch.payloads, batch.stats, batch.err = batch.packageRecords()
+	batch.duration = time.Since(packagingStart)
+	batch.packaged = true
+}
+
+// rejecting returns true if a send would be rejected right now without packaging the records
+func (nrClient *NRClient) rejecting() bool {
+	nrClient.closeMu.Lock()
+	closed := nrClient.closed
+	nrClient.closeMu.Unlock()
+
+	return closed || (nrClient.breaker != nil && nrClient.breaker.rejecting())
+}
+
+// SendBatch delivers the records packaged by Package or PackageEncoded, applying the circuit breaker, rate limiting,
+// failover and mirroring policies
+func (nrClient *NRClient) SendBatch(batch *Batch) (retry bool, err error) {
+	records := batch.records
+	if !nrClient.startSend() {
+		nrClient.countRecords(metrics.RecordsRetried, metrics.ReasonShuttingDown, records)
+		return true, errClosed
+	}
+	defer nrClient.inFlight.Done()
+
+	// requested tells whether any request was made to the endpoint, since only then the result says anything about
+	// its health
+	requested := false
+	if nrClient.breaker != nil && records > 0 {
+		allowed := nrClient.breaker.allow()
+		nrClient.reportCircuitBreakerState()
+		if !allowed {
+			nrClient.metricsClient.SendSummaryValue(metrics.CircuitBreakerRejectedRecords, nil, float64(records))
+			nrClient.countRecords(metrics.RecordsRetried, metrics.ReasonCircuitOpen, records)
+			return true, errCircuitOpen
+		}
+		defer func() {
+			nrClient.breaker.report(circuitResultOf(requested, retry, err))
+			nrClient.reportCircuitBreakerState()
+		}()
+	}
+
+	// The records are packaged here if the circuit breaker was still open when the batch was created
+	batch.pack()
+	payloads, stats, err := batch.payloads, batch.stats, batch.err
 	compression := nrClient.config.Compression.String()
 	dimensions := map[string]interface{}{
 		"hasError":    err != nil,
 		"compression": compression,
 	}
-	nrClient.metricsClient.SendSummaryDuration(metrics.PackagingTime, dimensions, packaging_time)
+	nrClient.metricsClient.SendSummaryDuration(metrics.PackagingTime, dimensions, batch.duration)
 	if err != nil {
 		log.WithField("error", err).Error("Error packaging request")
+		nrClient.countRecords(metrics.RecordsDropped, metrics.ReasonPackagingError, records)
 		return false, err
 	}
+	nrClient.countRecords(metrics.RecordsDropped, metrics.ReasonTooLarge, stats.DiscardedRecords)
+	if stats.CompressedBytes > 0 {
+		dimensions := map[string]interface{}{
+			"compression": compression,
+		}
+		nrClient.metricsClient.SendSummaryValue(metrics.UncompressedSize, dimensions, float64(stats.UncompressedBytes))
+		nrClient.metricsClient.SendGauge(metrics.CompressionRatio, dimensions, stats.CompressionRatio())
+	}
+
+	if nrClient.rateLimiter != nil {
+		nrClient.replaySpilledPayloads()
+		allowed := nrClient.rateLimiter.allow(records, payloadsSize(payloads))
+		nrClient.reportRateLimiterState()
+		if !allowed {
+			return nrClient.handleRateLimited(payloads, records)
+		}
+	}
+
+	requested = len(payloads) > 0
+	retry, err = nrClient.sendPayloads(payloads)
+	switch {
+	case err == nil:
+		nrClient.countRecords(metrics.RecordsSent, "", records-stats.DiscardedRecords)
+	case retry:
+		nrClient.countRecords(metrics.RecordsRetried, metrics.ReasonSendError, records)
+	default:
+		nrClient.countRecords(metrics.RecordsDropped, metrics.ReasonNonRetryableStatus, records)
+	}
+
+	if nrClient.failover != nil {
+		nrClient.reportActiveEndpoint()
+	}
+	return retry, err
+}
+
+// reportActiveEndpoint sets the active endpoint gauge to 1 for the endpoint currently in use and to 0 for the other one
+func (nrClient *NRClient) reportActiveEndpoint() {
+	_, activeRole := nrClient.failover.active()
+	endpoints := map[string]string{
+		"primary":   nrClient.failover.primary.Endpoint,
+		"secondary": nrClient.failover.secondary.Endpoint,
+	}
+	for role, endpoint := range endpoints {
+		dimensions := map[string]interface{}{
+			"endpoint": endpoint,
+			"role":     role,
+		}
+		value := 0.0
+		if role == activeRole {
+			value = 1
+		}
+		nrClient.metricsClient.SendGauge(metrics.ActiveEndpoint, dimensions, value)
+	}
+}
+
+// startSend registers a new in-flight send, returning false if the client has been closed
+func (nrClient *NRClient) startSend() bool {
+	nrClient.closeMu.Lock()
+	defer nrClient.closeMu.Unlock()
+
+	if nrClient.closed {
+		return false
+	}
+	nrClient.inFlight.Add(1)
+	return true
+}
+
+// Close shuts the client down in order: it stops accepting new sends, waits for the in-flight ones until the
+// context is done, closes the mirrors (waiting for their queued payloads), sends the last harvest of metrics and
+// closes the idle HTTP connections. It returns an error if the in-flight sends or the queued payloads of the mirrors
+// didn't finish in time.
+func (nrClient *NRClient) Close(ctx context.Context) (err error) {
+	nrClient.closeMu.Lock()
+	nrClient.closed = true
+	nrClient.closeMu.Unlock()
+
+	sendsDone := make(chan struct{})
+	go func() {
+		nrClient.inFlight.Wait()
+		close(sendsDone)
+	}()
+	select {
+	case <-sendsDone:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for in-flight sends: %w", ctx.Err())
+	}
+
+	errs := []error{err}
+	for _, m := range nrClient.mirrors {
+		errs = append(errs, m.close(ctx))
+	}
+	nrClient.metricsClient.Shutdown(ctx)
+	nrClient.client.CloseIdleConnections()
+
+	return errors.Join(errs...)
+}
+
+func (nrClient *NRClient) sendPayloads(payloads []record.PackagedRecords) (retry bool, err error) {
+	compression := nrClient.config.Compression.String()
 
 	payloadSendStart := time.Now()
 	for _, payload := range payloads {
 		payloadSize := payload.Len()
+		data := payload.Bytes()
 		sendStart := time.Now()
-		statusCode, err := nrClient.sendPacket(payload, nrClient.config.Compression)
+		statusCode, err := nrClient.deliver(data)
 		sendTime := time.Since(sendStart)
 
 		dimensions := map[string]interface{}{
@@ -78,6 +350,7 @@ func (nrClient *NRClient) Send(logRecords []record.LogRecord) (retry bool, err e
 		}
 		nrClient.metricsClient.SendSummaryValue(metrics.PayloadSize, dimensions, float64(payloadSize))
 		nrClient.metricsClient.SendSummaryDuration(metrics.PayloadSendTime, dimensions, sendTime)
+		nrClient.metricsClient.SendCount(metrics.ResponseCount, dimensions, 1)
 
 		// If we receive any error, we'll always retry sending the logs...
 		if err != nil {
@@ -88,9 +361,12 @@ func (nrClient *NRClient) Send(logRecords []record.LogRecord) (retry bool, err e
 		if statusCode/100 != 2 {
 			return isStatusCodeRetryable(statusCode), fmt.Errorf("received non-2XX HTTP status code: %d", statusCode)
 		}
+
+		// Only the accepted payloads are mirrored, so that the mirrors don't receive them again when retried
+		nrClient.mirrorPayload(data)
 	}
 	payloadSendTime := time.Since(payloadSendStart)
-	dimensions = map[string]interface{}{
+	dimensions := map[string]interface{}{
 		"compression": compression,
 	}
 	nrClient.metricsClient.SendSummaryDuration(metrics.TotalSendTime, dimensions, payloadSendTime)
@@ -99,19 +375,57 @@ func (nrClient *NRClient) Send(logRecords []record.LogRecord) (retry bool, err e
 	return false, nil
 }
 
-func (nrClient *NRClient) sendPacket(buffer *bytes.Buffer, compressionType config.CompressionType) (status int, err error) {
-	req, err := http.NewRequest("POST", nrClient.config.Endpoint, buffer)
+// packageRecords encodes the records in the configured output format
+func (nrClient *NRClient) packageRecords(logRecords []record.LogRecord) ([]record.PackagedRecords, record.PackagingStats, error) {
+	switch nrClient.config.OutputFormat {
+	case config.OtlpFormat:
+		return record.PackageRecordsAsOtlp(logRecords, nrClient.config.Compression, nrClient.config.CompressionLevel)
+	case config.EventFormat:
+		return record.PackageRecordsAsEvents(logRecords, nrClient.config.Compression, nrClient.config.CompressionLevel, nrClient.config.Event)
+	default:
+		return record.PackageRecordsWithStats(logRecords, nrClient.config.Compression, nrClient.config.CompressionLevel)
+	}
+}
+
+// deliver sends a payload to the active endpoint. When failover is configured and the payload couldn't be
+// delivered to the primary endpoint, either because it was a failed probe or because it made the client switch,
+// it is sent again to the secondary endpoint.
+func (nrClient *NRClient) deliver(payload []byte) (status int, err error) {
+	if nrClient.failover == nil {
+		return sendPacket(nrClient.client, payload, nrClient.config)
+	}
+
+	target, probing := nrClient.failover.target()
+	status, err = sendPacket(nrClient.client, payload, target)
+	failed := isFailoverError(status, err)
+	switched := nrClient.failover.report(target, probing, failed)
+	if failed && (probing || switched) {
+		status, err = sendPacket(nrClient.client, payload, nrClient.failover.secondary)
+	}
+	return status, err
+}
+
+// sendPacket posts a payload with the HTTP client to the endpoint of the provided configuration, using its
+// credentials
+func sendPacket(client *http.Client, payload []byte, cfg config.NRClientConfig) (status int, err error) {
+	req, err := http.NewRequest("POST", cfg.Endpoint, bytes.NewReader(payload))
 	if err != nil {
 		return 0, err
 	}
-	if nrClient.config.UseApiKey {
-		req.Header.Add("X-Insert-Key", nrClient.config.ApiKey)
+	if cfg.OutputFormat == config.OtlpFormat {
+		req.Header.Add("Api-Key", cfg.GetNewRelicKey())
+		req.Header.Add("Content-Type", "application/x-protobuf")
+	} else if cfg.UseApiKey {
+		req.Header.Add("X-Insert-Key", cfg.ApiKey)
+		req.Header.Add("Content-Type", "application/json")
 	} else {
-		req.Header.Add("X-License-Key", nrClient.config.LicenseKey)
+		req.Header.Add("X-License-Key", cfg.LicenseKey)
+		req.Header.Add("Content-Type", "application/json")
+	}
+	if encoding := cfg.Compression.ContentEncoding(); len(encoding) > 0 {
+		req.Header.Add("Content-Encoding", encoding)
 	}
-	req.Header.Add("Content-Encoding", compressionType.String())
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := nrClient.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -122,6 +436,118 @@ func (nrClient *NRClient) sendPacket(buffer *bytes.Buffer, compressionType confi
 	return resp.StatusCode, nil
 }
 
+// handleRateLimited applies the configured over-limit action to a chunk that exceeded the throughput limits
+func (nrClient *NRClient) handleRateLimited(payloads []record.PackagedRecords, records int) (retry bool, err error) {
+	action := nrClient.config.RateLimit.Action
+	dimensions := map[string]interface{}{
+		"action": action.String(),
+	}
+	nrClient.metricsClient.SendSummaryValue(metrics.RateLimitedRecords, dimensions, float64(records))
+	nrClient.metricsClient.SendSummaryValue(metrics.RateLimitedBytes, dimensions, float64(payloadsSize(payloads)))
+
+	switch action {
+	case config.RateLimitDrop:
+		log.WithField("records", records).Warn("Throughput rate limit exceeded. Logs were discarded.")
+		nrClient.countRecords(metrics.RecordsDropped, metrics.ReasonRateLimited, records)
+		return false, nil
+	case config.RateLimitSpill:
+		if err := nrClient.spillQueue.push(payloads, records); err != nil {
+			log.WithField("error", err).Warn("Can't spill logs to disk. Will retry to send them later.")
+			nrClient.countRecords(metrics.RecordsRetried, metrics.ReasonRateLimited, records)
+			return true, errRateLimited
+		}
+		nrClient.metricsClient.SendSummaryValue(metrics.RateLimitSpillSize, nil, float64(nrClient.spillQueue.spilledBytes()))
+		nrClient.countRecords(metrics.RecordsSpilled, "", records)
+		return false, nil
+	default:
+		nrClient.countRecords(metrics.RecordsRetried, metrics.ReasonRateLimited, records)
+		return true, errRateLimited
+	}
+}
+
+// replaySpilledPayloads sends, oldest first, the payloads spilled to disk while the rate limiter allows it
+func (nrClient *NRClient) replaySpilledPayloads() {
+	if nrClient.spillQueue == nil || nrClient.spillQueue.spilledBytes() == 0 {
+		return
+	}
+
+	err := nrClient.spillQueue.drain(func(payload *bytes.Buffer, records int) spillOutcome {
+		if !nrClient.rateLimiter.allow(records, payload.Len()) {
+			return spillPending
+		}
+		statusCode, err := nrClient.deliver(payload.Bytes())
+		if err == nil && statusCode/100 == 2 {
+			nrClient.mirrorPayload(payload.Bytes())
+			return spillSent
+		}
+
+		// The payload wasn't accepted, so it doesn't count towards the throughput
+		nrClient.rateLimiter.refund(records, payload.Len())
+		if err == nil && !isStatusCodeRetryable(statusCode) {
+			log.WithField("statusCode", statusCode).Error("Spilled logs were rejected with a non-retryable status code. Logs were discarded.")
+			nrClient.countRecords(metrics.RecordsDropped, metrics.ReasonNonRetryableStatus, records)
+			return spillRejected
+		}
+		return spillPending
+	})
+	if err != nil {
+		log.WithField("error", err).Warn("Error sending logs spilled to disk")
+	}
+	nrClient.metricsClient.SendSummaryValue(metrics.RateLimitSpillSize, nil, float64(nrClient.spillQueue.spilledBytes()))
+}
+
+func (nrClient *NRClient) reportRateLimiterState() {
+	records, bytes := nrClient.rateLimiter.available()
+	if records >= 0 {
+		nrClient.metricsClient.SendSummaryValue(metrics.RateLimitAvailableRecords, nil, records)
+	}
+	if bytes >= 0 {
+		nrClient.metricsClient.SendSummaryValue(metrics.RateLimitAvailableBytes, nil, bytes)
+	}
+}
+
+func (nrClient *NRClient) reportCircuitBreakerState() {
+	state := nrClient.breaker.currentState()
+	dimensions := map[string]interface{}{
+		"state": state.String(),
+	}
+	nrClient.metricsClient.SendSummaryValue(metrics.CircuitBreakerState, dimensions, float64(state))
+}
+
+// circuitResultOf classifies the result of sending a chunk: only the retryable errors reaching (or trying to reach)
+// the endpoint are considered failures. When no request was made (e.g. the chunk was rate limited or couldn't be
+// packaged) the result is ignored.
+func circuitResultOf(requested bool, retry bool, err error) circuitResult {
+	if !requested {
+		return circuitIgnored
+	}
+	if retry && err != nil {
+		return circuitFailure
+	}
+	return circuitSuccess
+}
+
+// countRecords increases a records counter, with the reason as dimension if provided
+func (nrClient *NRClient) countRecords(metricName string, reason string, records int) {
+	if records <= 0 {
+		return
+	}
+	var dimensions map[string]interface{}
+	if reason != "" {
+		dimensions = map[string]interface{}{
+			"reason": reason,
+		}
+	}
+	nrClient.metricsClient.SendCount(metricName, dimensions, float64(records))
+}
+
+func payloadsSize(payloads []record.PackagedRecords) (size int) {
+	for _, payload := range payloads {
+		size += payload.Len()
+	}
+	return
+}
+
 func isStatusCodeRetryable(statusCode int) bool {
 	_, ok := retryableCodesSet[statusCode]
 	return ok
@@ -1,14 +1,18 @@
 package nrclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/mock"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"time"
 
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
 	"github.com/newrelic/newrelic-fluent-bit-output/record"
 	"github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo"
@@ -31,6 +35,18 @@ func (m *mockMetricsAggregator) SendSummaryValue(metricName string, attributes m
 	m.Called(metricName, attributes, value)
 }
 
+func (m *mockMetricsAggregator) SendCount(metricName string, attributes map[string]interface{}, value float64) {
+	m.Called(metricName, attributes, value)
+}
+
+func (m *mockMetricsAggregator) SendGauge(metricName string, attributes map[string]interface{}, value float64) {
+	m.Called(metricName, attributes, value)
+}
+
+func (m *mockMetricsAggregator) Shutdown(ctx context.Context) {
+	m.Called(ctx)
+}
+
 var _ = Describe("NR Client", func() {
 
 	// This lets the matching library (gomega) be able to notify the testing framework (ginkgo)
@@ -85,6 +101,8 @@ var _ = Describe("NR Client", func() {
 		mockMetricsClient = newMockMetricsAggregatorProvider()
 		mockMetricsClient.On("SendSummaryDuration", mock.Anything, mock.Anything, mock.Anything).Return()
 		mockMetricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		mockMetricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
 	})
 
 	AfterEach(func() {
@@ -357,6 +375,39 @@ var _ = Describe("NR Client", func() {
 			"SendSummaryValue", "logs.fb.payload.count", expectedOverallDimensions, mock.AnythingOfType("float64"))
 		mockMetricsClient.AssertCalled(testingT,
 			"SendSummaryValue", "logs.fb.payload.size", expectedPayloadSendDimensions, mock.AnythingOfType("float64"))
+		mockMetricsClient.AssertCalled(testingT,
+			"SendCount", "logs.fb.response.count", expectedPayloadSendDimensions, float64(1))
+		mockMetricsClient.AssertCalled(testingT,
+			"SendCount", "logs.fb.records.sent", map[string]interface{}(nil), float64(2))
+		mockMetricsClient.AssertCalled(testingT,
+			"SendSummaryValue", "logs.fb.payload.uncompressed.size", expectedOverallDimensions, mock.AnythingOfType("float64"))
+		mockMetricsClient.AssertCalled(testingT,
+			"SendGauge", "logs.fb.compression.ratio", expectedOverallDimensions, mock.AnythingOfType("float64"))
+	})
+
+	It("Counts the records dropped or retried by reason", func() {
+		// Given
+		server.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpNonRetryableErrorCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""))
+
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+
+		// Then
+		testingT := GinkgoT()
+		mockMetricsClient.AssertCalled(testingT,
+			"SendCount", "logs.fb.records.dropped", map[string]interface{}{"reason": "non_retryable_status"}, float64(2))
+		mockMetricsClient.AssertCalled(testingT,
+			"SendCount", "logs.fb.records.retried", map[string]interface{}{"reason": "send_error"}, float64(2))
+		mockMetricsClient.AssertNotCalled(testingT,
+			"SendCount", "logs.fb.records.sent", mock.Anything, mock.Anything)
 	})
 
 	It("Uses the appropriate compression header when using Zstd", func() {
@@ -385,4 +436,300 @@ var _ = Describe("NR Client", func() {
 		Expect(err).To(BeNil())
 		Expect(server.ReceivedRequests()).To(HaveLen(1))
 	})
+
+	It("Omits the compression header when compression is disabled", func() {
+		// Given
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+				ghttp.VerifyRequest("POST", "/v1/logs"),
+				ghttp.VerifyJSON(`[{"message":"Some message 1","timestamp":1},{"message":"Some message 2","timestamp":2}]`)))
+
+		insertKeyConfig.Compression = config.NoCompression
+		nrClient, err := NewNRClient(insertKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Expect(server.ReceivedRequests()[0].Header).NotTo(HaveKey("Content-Encoding"))
+	})
+
+	It("Sends records already encoded as JSON", func() {
+		// Given
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+				ghttp.VerifyRequest("POST", "/v1/logs"),
+				ghttp.VerifyJSON(`[{"message":"Some message 1","timestamp":1},{"message":"Some message 2","timestamp":2}]`)))
+
+		insertKeyConfig.Compression = config.NoCompression
+		nrClient, err := NewNRClient(insertKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		shouldRetry, err := nrClient.SendEncoded([]json.RawMessage{
+			json.RawMessage(`{"message":"Some message 1","timestamp":1}`),
+			json.RawMessage(`{"message":"Some message 2","timestamp":2}`),
+		})
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("Refuses to send encoded records using other output formats", func() {
+		// Given
+		licenseKeyConfig.OutputFormat = config.OtlpFormat
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		shouldRetry, err := nrClient.SendEncoded([]json.RawMessage{json.RawMessage(`{"message":"Some message 1"}`)})
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(0))
+	})
+
+	It("Sends protobuf payloads with the Api-Key header when using the OTLP output format", func() {
+		// Given
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+				ghttp.VerifyRequest("POST", "/v1/logs"),
+				ghttp.VerifyHeader(http.Header{
+					"Api-Key":          []string{licenseKey},
+					"Content-Type":     []string{"application/x-protobuf"},
+					"Content-Encoding": []string{"gzip"},
+				})))
+
+		licenseKeyConfig.OutputFormat = config.OtlpFormat
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Expect(server.ReceivedRequests()[0].Header.Get("X-License-Key")).To(BeEmpty())
+	})
+
+	It("Returns retry=true without sending when the rate limit is exceeded and the action is retry", func() {
+		// Given
+		server.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		licenseKeyConfig.RateLimit = config.RateLimitConfig{
+			RecordsPerSecond: 3,
+			Action:           config.RateLimitRetry,
+		}
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		firstRetry, firstErr := nrClient.Send(logRecords)
+		secondRetry, secondErr := nrClient.Send(logRecords)
+
+		// Then
+		Expect(firstRetry).To(BeFalse())
+		Expect(firstErr).To(BeNil())
+		Expect(secondRetry).To(BeTrue())
+		Expect(secondErr).To(MatchError(errRateLimited))
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		mockMetricsClient.AssertCalled(GinkgoT(),
+			"SendSummaryValue", "logs.fb.ratelimit.limited.records", map[string]interface{}{"action": "retry"}, float64(2))
+	})
+
+	It("Discards the logs when the rate limit is exceeded and the action is drop", func() {
+		// Given
+		server.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		licenseKeyConfig.RateLimit = config.RateLimitConfig{
+			RecordsPerSecond: 3,
+			Action:           config.RateLimitDrop,
+		}
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		nrClient.Send(logRecords)
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("Spills the logs to disk when the rate limit is exceeded and sends them once there is capacity", func() {
+		// Given
+		server.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		spillDir, err := os.MkdirTemp("", "nr-spill")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(spillDir)
+		licenseKeyConfig.RateLimit = config.RateLimitConfig{
+			RecordsPerSecond: 3,
+			Action:           config.RateLimitSpill,
+			SpillDir:         spillDir,
+			SpillMaxBytes:    1 << 20,
+		}
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+		now := time.Now()
+		nrClient.rateLimiter.now = func() time.Time { return now }
+
+		// When
+		nrClient.Send(logRecords)
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Expect(nrClient.spillQueue.spilledBytes()).To(BeNumerically(">", 0))
+
+		// When capacity is available again, the spilled payload is sent in the next flush
+		now = now.Add(2 * time.Second)
+		shouldRetry, err = nrClient.Send(nil)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+		Expect(nrClient.spillQueue.spilledBytes()).To(BeZero())
+	})
+
+	It("Discards the spilled logs rejected with a non-retryable status code, instead of blocking the spill queue", func() {
+		// Given
+		httpBadRequestCode := 400
+		server.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpBadRequestCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		spillDir, err := os.MkdirTemp("", "nr-spill")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(spillDir)
+		licenseKeyConfig.RateLimit = config.RateLimitConfig{
+			RecordsPerSecond: 3,
+			Action:           config.RateLimitSpill,
+			SpillDir:         spillDir,
+			SpillMaxBytes:    1 << 20,
+		}
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+		now := time.Now()
+		nrClient.rateLimiter.now = func() time.Time { return now }
+		nrClient.Send(logRecords)
+		nrClient.Send(logRecords)
+		Expect(nrClient.spillQueue.spilledBytes()).To(BeNumerically(">", 0))
+
+		// When
+		now = now.Add(2 * time.Second)
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+		Expect(nrClient.spillQueue.spilledBytes()).To(BeZero())
+		mockMetricsClient.AssertCalled(GinkgoT(), "SendCount", metrics.RecordsDropped, map[string]interface{}{"reason": metrics.ReasonNonRetryableStatus}, float64(len(logRecords)))
+		// The tokens of the rejected payload were given back, so the new chunk was sent
+		records, _ := nrClient.rateLimiter.available()
+		Expect(records).To(Equal(float64(3 - len(logRecords))))
+	})
+
+	It("Rejects new sends with retry=true once closed, and flushes the metrics", func() {
+		// Given
+		mockMetricsClient.On("Shutdown", mock.Anything).Return()
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+
+		// When
+		closeErr := nrClient.Close(context.Background())
+		shouldRetry, err := nrClient.Send(logRecords)
+
+		// Then
+		Expect(closeErr).To(BeNil())
+		Expect(shouldRetry).To(BeTrue())
+		Expect(err).To(Equal(errClosed))
+		Expect(server.ReceivedRequests()).To(HaveLen(0))
+		mockMetricsClient.AssertCalled(GinkgoT(), "Shutdown", mock.Anything)
+	})
+
+	It("Waits for the in-flight sends when closing", func() {
+		// Given
+		mockMetricsClient.On("Shutdown", mock.Anything).Return()
+		server.RouteToHandler("POST", "/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(httpSuccessCode)
+		})
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+		sendDone := make(chan error)
+		go func() {
+			_, err := nrClient.Send(logRecords)
+			sendDone <- err
+		}()
+		Eventually(server.ReceivedRequests).Should(HaveLen(1))
+
+		// When
+		closeErr := nrClient.Close(context.Background())
+
+		// Then
+		Expect(closeErr).To(BeNil())
+		Expect(sendDone).To(Receive(BeNil()))
+	})
+
+	It("Stops waiting for the in-flight sends when the context is done", func() {
+		// Given
+		mockMetricsClient.On("Shutdown", mock.Anything).Return()
+		server.RouteToHandler("POST", "/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+			w.WriteHeader(httpSuccessCode)
+		})
+		nrClient, err := NewNRClient(licenseKeyConfig, noProxy, mockMetricsClient)
+		if err != nil {
+			Fail("Could not initialize the NRClient")
+		}
+		go nrClient.Send(logRecords)
+		Eventually(server.ReceivedRequests).Should(HaveLen(1))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		// When
+		closeErr := nrClient.Close(ctx)
+
+		// Then
+		Expect(closeErr).To(MatchError(context.DeadlineExceeded))
+		mockMetricsClient.AssertCalled(GinkgoT(), "Shutdown", mock.Anything)
+	})
 })
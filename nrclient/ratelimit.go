@@ -0,0 +1,131 @@
+package nrclient
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+)
+
+// tokenBucket is a classic token bucket that is refilled at a constant rate, up to a capacity of one
+// second worth of tokens.
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(ratePerSecond int, now time.Time) *tokenBucket {
+	if ratePerSecond <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:     float64(ratePerSecond),
+		capacity: float64(ratePerSecond),
+		tokens:   float64(ratePerSecond),
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+	}
+	// If the clock went backwards, we just start counting again from the current time
+	b.last = now
+}
+
+// canTake returns true if the bucket holds enough tokens for a request of size n. Requests bigger than the
+// bucket capacity are accepted once the bucket is full, leaving it in debt, so that a single big chunk can
+// never be blocked forever.
+func (b *tokenBucket) canTake(n float64) bool {
+	if b == nil {
+		return true
+	}
+	return b.tokens >= math.Min(n, b.capacity)
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// refund gives back n tokens, without exceeding the capacity of the bucket
+func (b *tokenBucket) refund(n float64) {
+	if b != nil {
+		b.tokens = math.Min(b.capacity, b.tokens+n)
+	}
+}
+
+// rateLimiter limits the throughput of an NRClient both in records per second and in (compressed) bytes
+// per second. It is safe to use from concurrent flushes.
+type rateLimiter struct {
+	mu      sync.Mutex
+	records *tokenBucket
+	bytes   *tokenBucket
+	now     func() time.Time
+}
+
+// newRateLimiter returns nil when no limit has been configured.
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	if !cfg.Enabled() {
+		return nil
+	}
+	now := time.Now()
+	return &rateLimiter{
+		records: newTokenBucket(cfg.RecordsPerSecond, now),
+		bytes:   newTokenBucket(cfg.BytesPerSecond, now),
+		now:     time.Now,
+	}
+}
+
+// allow consumes the tokens required to send the given amount of records and bytes. If any of the
+// buckets doesn't hold enough tokens, nothing is consumed and false is returned.
+func (l *rateLimiter) allow(records int, bytes int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.records != nil {
+		l.records.refill(now)
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+	}
+
+	if !l.records.canTake(float64(records)) || !l.bytes.canTake(float64(bytes)) {
+		return false
+	}
+	l.records.take(float64(records))
+	l.bytes.take(float64(bytes))
+	return true
+}
+
+// refund gives back the tokens consumed by allow for a request that wasn't sent after all
+func (l *rateLimiter) refund(records int, bytes int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records.refund(float64(records))
+	l.bytes.refund(float64(bytes))
+}
+
+// available returns the amount of tokens currently held by each bucket. Unlimited dimensions are
+// reported as -1.
+func (l *rateLimiter) available() (records float64, bytes float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records, bytes = -1, -1
+	if l.records != nil {
+		records = l.records.tokens
+	}
+	if l.bytes != nil {
+		bytes = l.bytes.tokens
+	}
+	return
+}
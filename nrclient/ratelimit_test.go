@@ -0,0 +1,214 @@
+package nrclient
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limiter", func() {
+	var now time.Time
+	clock := func() time.Time { return now }
+
+	BeforeEach(func() {
+		now = time.Unix(1234567890, 0)
+	})
+
+	It("is not created when no limit is configured", func() {
+		Expect(newRateLimiter(config.RateLimitConfig{Action: config.RateLimitDrop})).To(BeNil())
+	})
+
+	It("limits the amount of records per second", func() {
+		limiter := newRateLimiter(config.RateLimitConfig{RecordsPerSecond: 10})
+		limiter.now = clock
+
+		Expect(limiter.allow(6, 1000000)).To(BeTrue())
+		Expect(limiter.allow(6, 1000000)).To(BeFalse())
+
+		now = now.Add(500 * time.Millisecond)
+		Expect(limiter.allow(6, 1000000)).To(BeTrue())
+	})
+
+	It("limits the amount of bytes per second", func() {
+		limiter := newRateLimiter(config.RateLimitConfig{BytesPerSecond: 1000})
+		limiter.now = clock
+
+		Expect(limiter.allow(1000, 800)).To(BeTrue())
+		Expect(limiter.allow(1, 800)).To(BeFalse())
+
+		now = now.Add(time.Second)
+		Expect(limiter.allow(1, 800)).To(BeTrue())
+	})
+
+	It("doesn't consume tokens from any bucket when one of them is exhausted", func() {
+		limiter := newRateLimiter(config.RateLimitConfig{RecordsPerSecond: 10, BytesPerSecond: 1000})
+		limiter.now = clock
+
+		Expect(limiter.allow(1, 2000)).To(BeTrue())
+		Expect(limiter.allow(1, 1)).To(BeFalse())
+
+		records, _ := limiter.available()
+		Expect(records).To(Equal(float64(9)))
+	})
+
+	It("gives back the tokens of the requests that weren't sent, up to the capacity", func() {
+		limiter := newRateLimiter(config.RateLimitConfig{RecordsPerSecond: 10})
+		limiter.now = clock
+
+		Expect(limiter.allow(6, 1)).To(BeTrue())
+		limiter.refund(6, 1)
+		Expect(limiter.allow(10, 1)).To(BeTrue())
+
+		limiter.refund(100, 1)
+		records, bytes := limiter.available()
+		Expect(records).To(Equal(float64(10)))
+		Expect(bytes).To(Equal(float64(-1)))
+	})
+
+	It("accepts requests bigger than the bucket capacity once the bucket is full", func() {
+		limiter := newRateLimiter(config.RateLimitConfig{BytesPerSecond: 1000})
+		limiter.now = clock
+
+		Expect(limiter.allow(1, 5000)).To(BeTrue())
+
+		// The bucket is now in debt for 4 seconds
+		now = now.Add(4 * time.Second)
+		Expect(limiter.allow(1, 1)).To(BeFalse())
+		now = now.Add(time.Second)
+		Expect(limiter.allow(1, 1)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Spill queue", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "nr-spill")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("drains the spilled payloads in insertion order", func() {
+		queue, err := newSpillQueue(dir, 1<<20)
+		Expect(err).To(BeNil())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("first")}, 1)).To(Succeed())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("second")}, 2)).To(Succeed())
+
+		var drained []string
+		var records []int
+		err = queue.drain(func(payload *bytes.Buffer, r int) spillOutcome {
+			drained = append(drained, payload.String())
+			records = append(records, r)
+			return spillSent
+		})
+
+		Expect(err).To(BeNil())
+		Expect(drained).To(Equal([]string{"first", "second"}))
+		Expect(records).To(Equal([]int{1, 2}))
+		Expect(queue.spilledBytes()).To(BeZero())
+	})
+
+	It("keeps the payloads that could not be sent", func() {
+		queue, err := newSpillQueue(dir, 1<<20)
+		Expect(err).To(BeNil())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("first")}, 1)).To(Succeed())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("second")}, 1)).To(Succeed())
+
+		err = queue.drain(func(payload *bytes.Buffer, _ int) spillOutcome {
+			if payload.String() == "first" {
+				return spillSent
+			}
+			return spillPending
+		})
+
+		Expect(err).To(BeNil())
+		Expect(queue.spilledBytes()).To(Equal(int64(len("second"))))
+
+		// A new queue on the same directory picks up the pending payloads
+		reopened, err := newSpillQueue(dir, 1<<20)
+		Expect(err).To(BeNil())
+		Expect(reopened.spilledBytes()).To(Equal(int64(len("second"))))
+	})
+
+	It("removes the rejected payloads and keeps draining", func() {
+		queue, err := newSpillQueue(dir, 1<<20)
+		Expect(err).To(BeNil())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("rejected")}, 1)).To(Succeed())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("sent")}, 1)).To(Succeed())
+
+		var drained []string
+		err = queue.drain(func(payload *bytes.Buffer, _ int) spillOutcome {
+			drained = append(drained, payload.String())
+			if payload.String() == "rejected" {
+				return spillRejected
+			}
+			return spillSent
+		})
+
+		Expect(err).To(BeNil())
+		Expect(drained).To(Equal([]string{"rejected", "sent"}))
+		Expect(queue.spilledBytes()).To(BeZero())
+	})
+
+	It("accepts new payloads while draining", func() {
+		queue, err := newSpillQueue(dir, 1<<20)
+		Expect(err).To(BeNil())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("first")}, 1)).To(Succeed())
+
+		err = queue.drain(func(payload *bytes.Buffer, _ int) spillOutcome {
+			// A concurrent flush would block here if the lock were held during the send
+			Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("second")}, 1)).To(Succeed())
+			// Only one flush drains the queue at a time
+			Expect(queue.drain(func(*bytes.Buffer, int) spillOutcome {
+				Fail("drained concurrently")
+				return spillSent
+			})).To(Succeed())
+			return spillPending
+		})
+
+		Expect(err).To(BeNil())
+		Expect(queue.spilledBytes()).To(Equal(int64(len("first") + len("second"))))
+	})
+
+	It("refuses payloads exceeding the maximum spill size", func() {
+		queue, err := newSpillQueue(dir, 8)
+		Expect(err).To(BeNil())
+
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("12345")}, 1)).To(Succeed())
+		Expect(queue.push([]*bytes.Buffer{bytes.NewBufferString("12345")}, 1)).NotTo(Succeed())
+	})
+
+	It("stores all the payloads of a chunk, apportioning its records, or none of them", func() {
+		queue, err := newSpillQueue(dir, 10)
+		Expect(err).To(BeNil())
+
+		// When the payloads don't fit
+		err = queue.push([]*bytes.Buffer{bytes.NewBufferString("123456"), bytes.NewBufferString("123456")}, 4)
+
+		// Then
+		Expect(err).NotTo(BeNil())
+		Expect(queue.spilledBytes()).To(BeZero())
+		Expect(queue.store.Files()).To(BeEmpty())
+
+		// When they fit
+		err = queue.push([]*bytes.Buffer{bytes.NewBufferString("123"), bytes.NewBufferString("123456")}, 6)
+
+		// Then
+		Expect(err).To(BeNil())
+		var records []int
+		err = queue.drain(func(_ *bytes.Buffer, r int) spillOutcome {
+			records = append(records, r)
+			return spillSent
+		})
+		Expect(err).To(BeNil())
+		Expect(records).To(Equal([]int{2, 4}))
+	})
+})
@@ -0,0 +1,284 @@
+package nrclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRouteName = "default"
+
+// maxRouteBacklogRecords is the maximum amount of records kept by each route to be sent again
+const maxRouteBacklogRecords = 10000
+
+// Route sends the records matching an expression using its own NRClient
+type Route struct {
+	Name    string
+	Matcher *record.Matcher
+	Client  *NRClient
+}
+
+// Router splits the records of a Fluent Bit chunk between several routes. Each record is sent through the
+// first route whose expression it matches, or through the default route if none matches.
+type Router struct {
+	routes       []Route
+	defaultRoute Route
+	// backlogs holds the records of each route (indexed as routeIndex) that failed with a retryable error while
+	// other routes accepted their records, so they can't be retried by Fluent Bit
+	backlogs []*routeBacklog
+}
+
+// routeBacklog holds the records to be sent again through a route, before the records of the next chunk
+type routeBacklog struct {
+	mu      sync.Mutex
+	records []record.LogRecord
+}
+
+func NewRouter(defaultClient *NRClient, routes []Route) *Router {
+	backlogs := make([]*routeBacklog, len(routes)+1)
+	for i := range backlogs {
+		backlogs[i] = new(routeBacklog)
+	}
+	return &Router{
+		routes: routes,
+		defaultRoute: Route{
+			Name:   defaultRouteName,
+			Client: defaultClient,
+		},
+		backlogs: backlogs,
+	}
+}
+
+// RoutedBatch holds the records of a chunk split by route (indexed as routeIndex) and packaged by the client of each
+// route, ready to be sent
+type RoutedBatch struct {
+	records [][]record.LogRecord
+	batches []*Batch
+}
+
+// Package splits the records by route and packages them as the client of each route would when sending them, without
+// sending them nor reporting any metric. The records that couldn't be packaged are reported when sending the batch.
+func (router *Router) Package(logRecords []record.LogRecord, tag string) (*RoutedBatch, error) {
+	routed := &RoutedBatch{
+		records: router.split(logRecords, tag),
+		batches: make([]*Batch, len(router.routes)+1),
+	}
+
+	var errs []error
+	for i, records := range routed.records {
+		if len(records) == 0 && len(router.routes) > 0 {
+			continue
+		}
+
+		route := router.route(i)
+		routed.batches[i] = route.Client.Package(records)
+		if err := routed.batches[i].err; err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, err))
+		}
+	}
+	return routed, errors.Join(errs...)
+}
+
+// PackageEncoded packages the encoded records as the default route would when sending them. Encoded records can't
+// be matched against the route expressions, so it fails if any route is configured.
+func (router *Router) PackageEncoded(records []json.RawMessage) (*RoutedBatch, error) {
+	if len(router.routes) > 0 {
+		return nil, errors.New("encoded records can't be routed")
+	}
+
+	batch := router.defaultRoute.Client.PackageEncoded(records)
+	return &RoutedBatch{batches: []*Batch{batch}}, batch.err
+}
+
+// Send delivers each record through its route, as SendBatch does
+func (router *Router) Send(logRecords []record.LogRecord, tag string) (retry bool, err error) {
+	routed, _ := router.Package(logRecords, tag)
+	return router.SendBatch(routed)
+}
+
+// SendEncoded delivers records already encoded as JSON through the default route. Encoded records can't be matched
+// against the route expressions, so it fails if any route is configured.
+func (router *Router) SendEncoded(records []json.RawMessage) (retry bool, err error) {
+	routed, err := router.PackageEncoded(records)
+	if routed == nil {
+		return false, err
+	}
+	return router.SendBatch(routed)
+}
+
+// SendBatch delivers the records of each route. Every route is attempted, even if a previous one failed, and the
+// failure of a route doesn't change the outcome of the others: when any route accepts its records, the records of the
+// routes that failed with a retryable error are kept to be sent again through them with the next chunk (instead of
+// asking Fluent Bit to retry the whole chunk, which would send the accepted records twice), and the ones that failed
+// with a non-retryable error are discarded. Only when no route accepts its records is the error returned, asking
+// Fluent Bit to retry the chunk if any route can retry it.
+func (router *Router) SendBatch(routed *RoutedBatch) (retry bool, err error) {
+	if len(router.routes) == 0 {
+		return router.defaultRoute.Client.SendBatch(routed.batches[len(routed.batches)-1])
+	}
+
+	type routeResult struct {
+		records   []record.LogRecord
+		backlog   int
+		retry     bool
+		err       error
+		attempted bool
+	}
+	results := make([]routeResult, len(router.routes)+1)
+	accepted := false
+	for i, records := range routed.records {
+		// The records kept from previous chunks go first, so they are packaged again along with the ones of the chunk
+		backlog := router.backlogs[i].take()
+		if len(records) == 0 && len(backlog) == 0 {
+			continue
+		}
+
+		route := router.route(i)
+		var routeRetry bool
+		var routeErr error
+		if len(backlog) > 0 {
+			records = append(backlog, records...)
+			routeRetry, routeErr = route.Client.Send(records)
+		} else {
+			routeRetry, routeErr = route.Client.SendBatch(routed.batches[i])
+		}
+		if routeErr != nil {
+			log.WithField("route", route.Name).WithField("error", routeErr).Warn("Error sending logs through route")
+		} else {
+			accepted = true
+		}
+		results[i] = routeResult{records: records, backlog: len(backlog), retry: routeRetry, err: routeErr, attempted: true}
+	}
+
+	var errs []error
+	for i, result := range results {
+		if !result.attempted || result.err == nil {
+			continue
+		}
+
+		route := router.route(i)
+		switch {
+		case accepted && result.retry:
+			router.keep(i, result.records)
+		case result.retry:
+			// Fluent Bit retries the records of the chunk, but not the ones kept from previous chunks
+			router.keep(i, result.records[:result.backlog])
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, result.err))
+			retry = true
+		case !accepted:
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, result.err))
+		}
+	}
+
+	return retry, errors.Join(errs...)
+}
+
+// Close closes the clients of all the routes concurrently, so that all of them share the deadline of the context,
+// and then discards the records kept in the backlogs
+func (router *Router) Close(ctx context.Context) error {
+	routes := append([]Route{router.defaultRoute}, router.routes...)
+	errs := make([]error, len(routes))
+
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func(i int, route Route) {
+			defer wg.Done()
+			if err := route.Client.Close(ctx); err != nil {
+				errs[i] = fmt.Errorf("route %s: %w", route.Name, err)
+			}
+		}(i, route)
+	}
+	wg.Wait()
+
+	// The backlogs are emptied once no more records can be kept, so that closing the router again doesn't discard
+	// them twice
+	for i, backlog := range router.backlogs {
+		if pending := len(backlog.take()); pending > 0 {
+			route := router.route(i)
+			log.WithField("route", route.Name).WithField("records", pending).Warn("Logs kept to be sent again through route were discarded on shutdown")
+			route.Client.countRecords(metrics.RecordsDropped, metrics.ReasonShuttingDown, pending)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// keep adds the records to the backlog of a route, discarding the ones exceeding its maximum size
+func (router *Router) keep(i int, records []record.LogRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	route := router.route(i)
+	discarded := router.backlogs[i].add(records, maxRouteBacklogRecords)
+	log.WithField("route", route.Name).WithField("records", len(records)-discarded).Info("Keeping logs to send them again through route with the next chunk")
+	if discarded > 0 {
+		log.WithField("route", route.Name).WithField("records", discarded).Warn("Route backlog is full. Logs were discarded.")
+		route.Client.countRecords(metrics.RecordsDropped, metrics.ReasonRouteBacklogFull, discarded)
+	}
+}
+
+// take empties the backlog, returning its records
+func (b *routeBacklog) take() []record.LogRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := b.records
+	b.records = nil
+	return records
+}
+
+// add appends the records to the backlog, up to max records, returning the amount of records that didn't fit
+func (b *routeBacklog) add(records []record.LogRecord, max int) (discarded int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if free := max - len(b.records); len(records) > free {
+		discarded = len(records) - free
+		records = records[:free]
+	}
+	b.records = append(b.records, records...)
+	return discarded
+}
+
+// size returns the amount of records in the backlog
+func (b *routeBacklog) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.records)
+}
+
+// split groups the records by route, the last group being the default route
+func (router *Router) split(logRecords []record.LogRecord, tag string) [][]record.LogRecord {
+	routedRecords := make([][]record.LogRecord, len(router.routes)+1)
+	for _, logRecord := range logRecords {
+		i := router.routeIndex(logRecord, tag)
+		routedRecords[i] = append(routedRecords[i], logRecord)
+	}
+	return routedRecords
+}
+
+// route returns the route at an index returned by routeIndex
+func (router *Router) route(i int) Route {
+	if i < len(router.routes) {
+		return router.routes[i]
+	}
+	return router.defaultRoute
+}
+
+// routeIndex returns the index of the route a record belongs to, len(routes) being the default route
+func (router *Router) routeIndex(logRecord record.LogRecord, tag string) int {
+	for i, route := range router.routes {
+		if route.Matcher.Matches(logRecord, tag) {
+			return i
+		}
+	}
+	return len(router.routes)
+}
@@ -0,0 +1,251 @@
+package nrclient
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
+	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/stretchr/testify/mock"
+)
+
+var _ = Describe("Router", func() {
+	var defaultServer, paymentsServer *ghttp.Server
+	var defaultClient, paymentsClient *NRClient
+	httpSuccessCode := 202
+	httpRetryableErrorCode := 503
+
+	newClient := func(server *ghttp.Server) *NRClient {
+		metricsClient := newMockMetricsAggregatorProvider()
+		metricsClient.On("SendSummaryDuration", mock.Anything, mock.Anything, mock.Anything).Return()
+		metricsClient.On("SendSummaryValue", mock.Anything, mock.Anything, mock.Anything).Return()
+		metricsClient.On("SendCount", mock.Anything, mock.Anything, mock.Anything).Return()
+		metricsClient.On("SendGauge", mock.Anything, mock.Anything, mock.Anything).Return()
+		metricsClient.On("Shutdown", mock.Anything).Return()
+		client, err := NewNRClient(config.NRClientConfig{
+			Endpoint:       server.URL() + "/v1/logs",
+			LicenseKey:     "some-license-key",
+			TimeoutSeconds: 2,
+			Compression:    config.Gzip,
+		}, config.ProxyConfig{}, metricsClient)
+		Expect(err).To(BeNil())
+		return client
+	}
+
+	newRouter := func() *Router {
+		matcher, err := record.NewMatcher("kubernetes.namespace_name=payments")
+		Expect(err).To(BeNil())
+		return NewRouter(defaultClient, []Route{{Name: "payments", Matcher: matcher, Client: paymentsClient}})
+	}
+
+	paymentsRecord := record.LogRecord{
+		"message":    "Payment accepted",
+		"kubernetes": map[string]interface{}{"namespace_name": "payments"},
+	}
+	otherRecord := record.LogRecord{
+		"message":    "Hello",
+		"kubernetes": map[string]interface{}{"namespace_name": "frontend"},
+	}
+
+	BeforeEach(func() {
+		defaultServer = ghttp.NewServer()
+		paymentsServer = ghttp.NewServer()
+		defaultClient = newClient(defaultServer)
+		paymentsClient = newClient(paymentsServer)
+	})
+
+	AfterEach(func() {
+		defaultServer.Close()
+		paymentsServer.Close()
+	})
+
+	It("sends each record through its matching route and the rest through the default route", func() {
+		// Given
+		defaultServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		paymentsServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+
+		// When
+		shouldRetry, err := newRouter().Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("doesn't call routes without records", func() {
+		// Given
+		defaultServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+
+		// When
+		shouldRetry, err := newRouter().Send([]record.LogRecord{otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(0))
+	})
+
+	It("keeps the records of a route failing with a retryable error and sends them with the next chunk, without retrying the others", func() {
+		// Given
+		defaultServer.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		paymentsServer.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		router := newRouter()
+
+		// When
+		shouldRetry, err := router.Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(1))
+		Expect(router.backlogs[0].size()).To(Equal(1))
+
+		// When
+		shouldRetry, err = router.Send([]record.LogRecord{otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(2))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(2))
+		Expect(router.backlogs[0].size()).To(BeZero())
+	})
+
+	It("doesn't fail the chunk when a route fails with a non-retryable error and others succeed", func() {
+		// Given
+		httpBadRequestCode := 400
+		defaultServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		paymentsServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpBadRequestCode, ""))
+		router := newRouter()
+
+		// When
+		shouldRetry, err := router.Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(router.backlogs[0].size()).To(BeZero())
+	})
+
+	It("requests a retry when no route accepts its records, keeping only the records of previous chunks", func() {
+		// Given
+		defaultServer.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""))
+		paymentsServer.AppendHandlers(
+			ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""),
+			ghttp.RespondWithJSONEncodedPtr(&httpRetryableErrorCode, ""))
+		router := newRouter()
+		router.Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// When
+		shouldRetry, err := router.Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// Then
+		Expect(shouldRetry).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("route payments")))
+		Expect(err).To(MatchError(ContainSubstring("route default")))
+		Expect(router.backlogs[0].size()).To(Equal(1))
+		Expect(router.backlogs[1].size()).To(BeZero())
+	})
+
+	It("discards the records exceeding the maximum backlog size", func() {
+		backlog := new(routeBacklog)
+
+		Expect(backlog.add(make([]record.LogRecord, 3), 5)).To(BeZero())
+		Expect(backlog.add(make([]record.LogRecord, 3), 5)).To(Equal(1))
+		Expect(backlog.take()).To(HaveLen(5))
+		Expect(backlog.size()).To(BeZero())
+	})
+
+	It("closes the clients of all the routes", func() {
+		// Given
+		router := newRouter()
+
+		// When
+		err := router.Close(context.Background())
+		shouldRetry, sendErr := router.Send([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+
+		// Then
+		Expect(err).To(BeNil())
+		Expect(shouldRetry).To(BeTrue())
+		Expect(sendErr).To(MatchError(errClosed))
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(0))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(0))
+	})
+
+	It("discards the records kept in the backlogs only once when closed twice", func() {
+		// Given
+		router := newRouter()
+		router.keep(0, []record.LogRecord{paymentsRecord})
+		metricsClient := paymentsClient.metricsClient.(*mockMetricsAggregator)
+
+		// When
+		Expect(router.Close(context.Background())).To(Succeed())
+		Expect(router.Close(context.Background())).To(Succeed())
+
+		// Then
+		Expect(router.backlogs[0].size()).To(BeZero())
+		metricsClient.AssertCalled(GinkgoT(), "SendCount", metrics.RecordsDropped, map[string]interface{}{"reason": metrics.ReasonShuttingDown}, float64(1))
+		dropped := 0
+		for _, call := range metricsClient.Calls {
+			if call.Method == "SendCount" && call.Arguments.Get(0) == metrics.RecordsDropped {
+				dropped++
+			}
+		}
+		Expect(dropped).To(Equal(1))
+	})
+
+	It("sends encoded records through the default route", func() {
+		// Given
+		defaultServer.AppendHandlers(ghttp.RespondWithJSONEncodedPtr(&httpSuccessCode, ""))
+		router := NewRouter(defaultClient, nil)
+
+		// When
+		shouldRetry, err := router.SendEncoded([]json.RawMessage{json.RawMessage(`{"message":"Hello"}`)})
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(BeNil())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(1))
+	})
+
+	It("refuses to send encoded records when routes are configured", func() {
+		// When
+		shouldRetry, err := newRouter().SendEncoded([]json.RawMessage{json.RawMessage(`{"message":"Hello"}`)})
+
+		// Then
+		Expect(shouldRetry).To(BeFalse())
+		Expect(err).To(HaveOccurred())
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(0))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(0))
+	})
+
+	It("packages the records of every route without sending them", func() {
+		// When
+		routed, err := newRouter().Package([]record.LogRecord{paymentsRecord, otherRecord}, "kube.logs")
+		encoded, encodedErr := NewRouter(defaultClient, nil).PackageEncoded([]json.RawMessage{json.RawMessage(`{"message":"Hello"}`)})
+
+		// Then
+		Expect(err).To(BeNil())
+		Expect(routed.records).To(Equal([][]record.LogRecord{{paymentsRecord}, {otherRecord}}))
+		Expect(routed.batches[0].payloads).To(HaveLen(1))
+		Expect(routed.batches[1].payloads).To(HaveLen(1))
+		Expect(encodedErr).To(BeNil())
+		Expect(encoded.batches[0].records).To(Equal(1))
+		Expect(defaultServer.ReceivedRequests()).To(HaveLen(0))
+		Expect(paymentsServer.ReceivedRequests()).To(HaveLen(0))
+	})
+})
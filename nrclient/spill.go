@@ -0,0 +1,98 @@
+package nrclient
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/utils"
+)
+
+const spillFileExtension = ".spill"
+
+// spillQueue stores already packaged (compressed) payloads on disk, so that they can be sent later on when
+// the rate limiter has capacity again. Each payload is stored in its own file, whose name keeps the
+// insertion order and the amount of records it contains: <unix nanos>-<sequence>-<records>.spill
+type spillQueue struct {
+	store *utils.DiskStore
+	// drainMu is held while draining the queue
+	drainMu sync.Mutex
+}
+
+// newSpillQueue returns a queue holding the payloads already stored in dir, which are still pending to be sent
+func newSpillQueue(dir string, maxBytes int64) (*spillQueue, error) {
+	store, err := utils.NewDiskStore(dir, spillFileExtension, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("spill directory: %v", err)
+	}
+	return &spillQueue{store: store}, nil
+}
+
+// push stores the payloads of a chunk on disk, each one in its own file. Since they are sent independently, the
+// records of the chunk are apportioned by payload size. Either all the payloads are stored or none, so that the chunk
+// can be retried without duplicating any of them. It fails if storing them would exceed the maximum spill size.
+func (q *spillQueue) push(payloads []*bytes.Buffer, records int) error {
+	totalSize := payloadsSize(payloads)
+	suffixes := make([]string, len(payloads))
+	data := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		suffixes[i] = strconv.Itoa(records * payload.Len() / totalSize)
+		data[i] = payload.Bytes()
+	}
+	if err := q.store.WriteAll(suffixes, data); err != nil {
+		return fmt.Errorf("can't spill payloads to disk: %v", err)
+	}
+	return nil
+}
+
+// spillOutcome is the result of trying to send a spilled payload
+type spillOutcome int
+
+const (
+	// spillSent means the payload was delivered, so it is removed
+	spillSent spillOutcome = iota
+	// spillRejected means the payload can never be delivered, so it is removed as well
+	spillRejected
+	// spillPending means the payload couldn't be sent yet, which stops draining the queue
+	spillPending
+)
+
+// drain iterates over the spilled payloads, from the oldest to the newest one, removing the payloads that were sent
+// or rejected. Iteration stops at the first payload that is still pending. The payloads are sent without locking the
+// store, so that other flushes can keep spilling meanwhile, and a single flush drains the queue at a time.
+func (q *spillQueue) drain(send func(payload *bytes.Buffer, records int) spillOutcome) error {
+	if !q.drainMu.TryLock() {
+		return nil
+	}
+	defer q.drainMu.Unlock()
+
+	files, err := q.store.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("can't read spilled payload %s: %v", f, err)
+		}
+
+		records, _ := strconv.Atoi(q.store.Suffix(f))
+		if send(bytes.NewBuffer(data), records) == spillPending {
+			return nil
+		}
+
+		if err := q.store.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spilledBytes returns the total size of the payloads currently stored on disk
+func (q *spillQueue) spilledBytes() int64 {
+	return q.store.Size()
+}
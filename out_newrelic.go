@@ -2,19 +2,29 @@ package main
 
 import (
 	"C"
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
 	"github.com/newrelic/newrelic-fluent-bit-output/metrics"
 	"github.com/newrelic/newrelic-fluent-bit-output/nrclient"
 	"github.com/newrelic/newrelic-fluent-bit-output/record"
+	"github.com/newrelic/newrelic-fluent-bit-output/utils"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"time"
 	"unsafe"
 )
 
 var (
-	nrClientRepo         = make(map[string]*nrclient.NRClient)
+	routerRepo           = make(map[string]*nrclient.Router)
 	dataFormatConfigRepo = make(map[string]config.DataFormatConfig)
+	shutdownTimeoutRepo  = make(map[string]time.Duration)
+	metricsClientRepo    = make(map[string]metrics.Client)
+	logsToMetricsRepo    = make(map[string]*nrclient.LogsToMetrics)
+	transcodeRepo        = make(map[string]bool)
+	quarantineRepo       = make(map[string]*record.Quarantine)
 )
 
 //export FLBPluginRegister
@@ -30,7 +40,7 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 		return output.FLB_ERROR
 	}
 
-	metricsClient, err := metrics.NewClient(cfg.NRClientConfig)
+	metricsClient, err := nrclient.NewMetricsClient(cfg.NRClientConfig, cfg.ProxyConfig)
 	if err != nil {
 		log.WithField("error", err).Error("Error creating Metrics client")
 	}
@@ -38,60 +48,413 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 	nrClient, err := nrclient.NewNRClient(cfg.NRClientConfig, cfg.ProxyConfig, metricsClient)
 	if err != nil {
 		log.WithField("error", err).Error("Error creating NewNRClient")
+		closeClients(cfg, metricsClient, nil, nil)
+		return output.FLB_ERROR
+	}
+
+	routes, err := buildRoutes(cfg)
+	if err != nil {
+		log.WithField("error", err).Error("Error creating routes")
+		closeClients(cfg, metricsClient, nrClient, nil)
+		return output.FLB_ERROR
+	}
+
+	logsToMetrics, err := buildLogsToMetrics(cfg)
+	if err != nil {
+		log.WithField("error", err).Error("Error creating logs to metrics rules")
+		closeClients(cfg, metricsClient, nrClient, routes)
+		return output.FLB_ERROR
+	}
+
+	var quarantine *record.Quarantine
+	if cfg.Quarantine.Enabled() {
+		quarantine, err = record.NewQuarantine(cfg.Quarantine.Dir, cfg.Quarantine.MaxBytes)
+		if err != nil {
+			log.WithField("error", err).Error("Error creating quarantine")
+			closeClients(cfg, metricsClient, nrClient, routes)
+			if logsToMetrics != nil {
+				logsToMetrics.Close(context.Background())
+			}
+			return output.FLB_ERROR
+		}
 	}
 
 	licenseKey := cfg.NRClientConfig.GetNewRelicKey()
-	nrClientRepo[licenseKey] = nrClient
+	routerRepo[licenseKey] = nrclient.NewRouter(nrClient, routes)
 	dataFormatConfigRepo[licenseKey] = cfg.DataFormatConfig
+	shutdownTimeoutRepo[licenseKey] = cfg.ShutdownTimeout
+	metricsClientRepo[licenseKey] = metricsClient
+	if logsToMetrics != nil {
+		logsToMetricsRepo[licenseKey] = logsToMetrics
+	}
+	transcodeRepo[licenseKey] = canTranscode(cfg)
+	if quarantine != nil {
+		quarantineRepo[licenseKey] = quarantine
+	}
 	output.FLBPluginSetContext(ctx, licenseKey)
 
 	return output.FLB_OK
 }
 
+// closeClients releases the clients of an output instance that failed to initialize, stopping their metrics
+// harvesters and Prometheus listeners
+func closeClients(cfg config.PluginConfig, metricsClient metrics.Client, nrClient *nrclient.NRClient, routes []nrclient.Route) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, route := range routes {
+		route.Client.Close(ctx)
+	}
+	// The client shuts down its metrics client when closed
+	if nrClient != nil {
+		nrClient.Close(ctx)
+	} else if metricsClient != nil {
+		metricsClient.Shutdown(ctx)
+	}
+}
+
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	// Create Fluent Bit decoder
-	dec := output.NewDecoder(data, int(length))
-
-	// Get New Relic Client
+	// Get the output instance
 	id := output.FLBPluginGetContext(ctx).(string)
-	nrClient := nrClientRepo[id]
+	// The chunk is read straight from the Fluent Bit buffer, which is only valid during the flush. Nothing keeps
+	// references to it afterwards: the decoded records and the payloads are copied out of it.
+	chunk := unsafe.Slice((*byte)(data), int(length))
+	return flushChunk(id, chunk, C.GoString(tag))
+}
+
+// preparedChunk holds the records of a chunk remapped and packaged, ready to be sent
+type preparedChunk struct {
+	batch      *nrclient.RoutedBatch
+	records    int
+	remapStats record.RemapStats
+	derived    []nrclient.DerivedMetric
+	// converted is the amount of records dropped after converting them to metrics
+	converted int
+	err       error
+}
+
+// flushChunk remaps, packages and sends the records of a chunk, recovering from any panic. Remapping and packaging
+// have no side effects, so when they panic the chunk is bisected to find the records causing it, which are
+// quarantined, and the rest of the chunk is prepared again. Sending is never repeated, since some records may have
+// already been delivered. The records of the clients whose circuit breaker is open are only packaged when sent, if
+// the breaker lets them through by then.
+func flushChunk(id string, chunk []byte, fbTag string) int {
+	metricsClient := metricsClientRepo[id]
+	metricsClient.SendSummaryValue(metrics.ChunkSize, nil, float64(len(chunk)))
+
+	prepared, result, ok := prepareIsolated(id, chunk, fbTag)
+	if !ok {
+		return result
+	}
+	if prepared.err != nil {
+		log.WithField("error", prepared.err).Error("Error transcoding records. Logs were discarded.")
+		countFlush(metricsClient, "error")
+		return output.FLB_ERROR
+	}
+
+	metricsClient.SendCount(metrics.RecordsReceived, nil, float64(prepared.records))
+	countRemapStats(metricsClient, dataFormatConfigRepo[id], prepared.remapStats)
+	if prepared.converted > 0 {
+		metricsClient.SendCount(metrics.RecordsDropped, map[string]interface{}{"reason": metrics.ReasonConvertedToMetrics}, float64(prepared.converted))
+	}
+
+	var retry bool
+	var err error
+	panicErr := utils.CatchPanic(func() {
+		retry, err = routerRepo[id].SendBatch(prepared.batch)
+		// The derived metrics are only reported once the chunk won't be retried, so that they are not counted twice
+		if logsToMetrics := logsToMetricsRepo[id]; !retry && logsToMetrics != nil {
+			logsToMetrics.Report(prepared.derived)
+		}
+	})
+	if panicErr != nil {
+		metricsClient.SendCount(metrics.FlushPanics, nil, 1)
+		logPanic(panicErr, fbTag, "Recovered from a panic sending a chunk. Logs may have been partially sent, so they won't be retried.")
+		countFlush(metricsClient, "error")
+		return output.FLB_ERROR
+	}
+	return flushResult(metricsClient, retry, err)
+}
+
+// prepareIsolated prepares a chunk, recovering from any panic by quarantining the records causing it. When the chunk
+// can't be prepared, it returns false along with the result to return to Fluent Bit.
+func prepareIsolated(id string, chunk []byte, fbTag string) (prepared preparedChunk, result int, ok bool) {
+	err := utils.CatchPanic(func() {
+		prepared = prepareChunk(id, chunk, fbTag)
+	})
+	if err == nil {
+		return prepared, 0, true
+	}
+
+	metricsClient := metricsClientRepo[id]
+	metricsClient.SendCount(metrics.FlushPanics, nil, 1)
+	logPanic(err, fbTag, "Recovered from a panic preparing a chunk. Looking for the records causing it.")
+
+	// The events are kept while bisecting and quarantining them, so they are copied out of the Fluent Bit buffer
+	events := record.SplitEvents(bytes.Clone(chunk))
+	poison := record.FindPoisonEvents(events, func(events [][]byte) {
+		prepareChunk(id, record.JoinEvents(events), fbTag)
+	})
+	if len(poison) == 0 || len(poison) == len(events) {
+		// When every record seems to be poison, the panic more likely comes from the plugin state than from the
+		// records, so none of them is quarantined and the chunk may succeed once the cause is gone
+		log.WithField("tag", fbTag).WithField("records", len(events)).WithField("poison", len(poison)).
+			Error("The panic can't be attributed to some of the records. Will retry to send the logs (if there are attempts remaining, check Retry_Limit option)")
+		countFlush(metricsClient, "retry")
+		return prepared, output.FLB_RETRY, false
+	}
+
+	var healthy [][]byte
+	for i, event := range events {
+		if cause, ok := poison[i]; ok {
+			quarantineEvent(id, event, fbTag, cause)
+		} else {
+			healthy = append(healthy, event)
+		}
+	}
+	err = utils.CatchPanic(func() {
+		prepared = prepareChunk(id, record.JoinEvents(healthy), fbTag)
+	})
+	if err != nil {
+		metricsClient.SendCount(metrics.FlushPanics, nil, 1)
+		logPanic(err, fbTag, "Recovered from a panic preparing the records left after quarantining. Logs were discarded.")
+		countFlush(metricsClient, "error")
+		return prepared, output.FLB_ERROR, false
+	}
+	return prepared, 0, true
+}
+
+// prepareChunk decodes, remaps and packages the records of a chunk, without sending them or reporting any metric, so
+// that it can be repeated to find out which records make the plugin panic
+func prepareChunk(id string, chunk []byte, fbTag string) preparedChunk {
+	router := routerRepo[id]
 	dataFormatConfig := dataFormatConfigRepo[id]
 
-	// Iterate, parse and accumulate records to be sent
+	if transcodeRepo[id] {
+		// Transcode the records straight from msgpack into JSON, skipping the intermediate maps
+		encoded, remapStats, err := record.TranscodeChunk(chunk, fbTag, VERSION, dataFormatConfig)
+		if err != nil {
+			return preparedChunk{err: err}
+		}
+		batch, _ := router.PackageEncoded(encoded)
+		return preparedChunk{batch: batch, records: len(encoded), remapStats: remapStats}
+	}
+
+	buffer, remapStats := remapChunk(chunk, fbTag, dataFormatConfig)
+	received := len(buffer)
+
+	var derived []nrclient.DerivedMetric
+	if logsToMetrics := logsToMetricsRepo[id]; logsToMetrics != nil {
+		buffer, derived = logsToMetrics.Derive(buffer, fbTag)
+	}
+
+	batch, _ := router.Package(buffer, fbTag)
+	return preparedChunk{
+		batch:      batch,
+		records:    received,
+		remapStats: remapStats,
+		derived:    derived,
+		converted:  received - len(buffer),
+	}
+}
+
+// remapChunk decodes and remaps the records of a chunk, returning the stats of the remapping
+func remapChunk(chunk []byte, fbTag string, dataFormatConfig config.DataFormatConfig) ([]record.LogRecord, record.RemapStats) {
 	var buffer []record.LogRecord
+	var remapStats record.RemapStats
+
+	// Create the decoder, which keeps the metadata of the Fluent Bit v2 events
+	dec := record.NewEventDecoder(chunk)
+
+	// Iterate, parse and accumulate records to be sent
 	for {
 		// Extract Record
-		ret, ts, fbRecord := output.GetRecord(dec)
-		if ret != 0 {
+		ts, fbRecord, ok := dec.Next()
+		if !ok {
 			break
 		}
 
-		buffer = append(buffer, record.RemapRecord(fbRecord, ts, VERSION, dataFormatConfig))
+		remapped, stats := record.RemapRecordWithStats(fbRecord, ts, fbTag, VERSION, dataFormatConfig)
+		remapStats.InvalidUtf8Values += stats.InvalidUtf8Values
+		buffer = append(buffer, remapped)
+	}
+	return buffer, remapStats
+}
+
+// quarantineEvent logs and counts an event making the plugin panic, storing it in the quarantine directory if
+// configured
+func quarantineEvent(id string, event []byte, fbTag string, cause error) {
+	fields := log.Fields{
+		"tag":         fbTag,
+		"fingerprint": record.Fingerprint(event),
+		"error":       cause,
+	}
+
+	stored := false
+	if quarantine, ok := quarantineRepo[id]; ok {
+		if err := quarantine.Store(event, fbTag, cause); err != nil {
+			log.WithFields(fields).WithField("quarantineError", err).Warn("Error storing quarantined record")
+		} else {
+			stored = true
+		}
+	}
+
+	log.WithFields(fields).WithField("stored", stored).Error("Quarantined a record making the plugin panic. It won't be sent.")
+	dimensions := map[string]interface{}{
+		"stored": stored,
+	}
+	metricsClientRepo[id].SendCount(metrics.RecordsQuarantined, dimensions, 1)
+}
+
+// logPanic logs a recovered panic, along with its stack trace when debugging
+func logPanic(err error, fbTag string, msg string) {
+	log.WithField("tag", fbTag).WithField("error", err).Error(msg)
+	if panicErr, ok := err.(*utils.PanicError); ok {
+		log.WithField("tag", fbTag).Debug(string(panicErr.Stack))
 	}
+}
 
+// flushResult logs and counts the result of sending a chunk, returning the corresponding Fluent Bit return code
+func flushResult(metricsClient metrics.Client, retry bool, err error) int {
 	// Return options:
 	//
 	// output.FLB_OK    = data have been processed.
 	// output.FLB_ERROR = unrecoverable error, do not try this again.
 	// output.FLB_RETRY = retry to flush later.
-	retry, err := nrClient.Send(buffer)
 	if retry {
 		log.WithField("error", err).Info("Retryable error received. Will retry to send the logs (if there are attempts remaining, check Retry_Limit option)")
+		countFlush(metricsClient, "retry")
 		return output.FLB_RETRY
 	}
 	if err != nil {
 		log.WithField("error", err).Error("Unexpected non-retryable error received. Logs were discarded.")
+		countFlush(metricsClient, "error")
 		return output.FLB_ERROR
 	}
+	countFlush(metricsClient, "ok")
+	return output.FLB_OK
+}
+
+// countRemapStats reports the values altered while remapping the records of a chunk
+func countRemapStats(metricsClient metrics.Client, dataFormatConfig config.DataFormatConfig, stats record.RemapStats) {
+	if stats.InvalidUtf8Values > 0 {
+		dimensions := map[string]interface{}{
+			"action": dataFormatConfig.InvalidUtf8.String(),
+		}
+		metricsClient.SendCount(metrics.InvalidUtf8Values, dimensions, float64(stats.InvalidUtf8Values))
+	}
+}
+
+func countFlush(metricsClient metrics.Client, result string) {
+	dimensions := map[string]interface{}{
+		"result": result,
+	}
+	metricsClient.SendCount(metrics.FlushCount, dimensions, 1)
+}
+
+// canTranscode returns whether the chunks can take the fast path, transcoding their records straight into JSON.
+// Routes and logs to metrics rules need the records as maps, and only the JSON output format can send them encoded.
+func canTranscode(cfg config.PluginConfig) bool {
+	return len(cfg.Routes) == 0 &&
+		len(cfg.LogsToMetrics) == 0 &&
+		cfg.NRClientConfig.OutputFormat == config.JsonFormat &&
+		record.SupportsTranscoding(cfg.DataFormatConfig)
+}
+
+// buildRoutes creates a New Relic client, with its own metrics client, for each of the configured routes
+func buildRoutes(cfg config.PluginConfig) ([]nrclient.Route, error) {
+	var routes []nrclient.Route
+	for _, routeCfg := range cfg.Routes {
+		matcher, err := record.NewMatcher(routeCfg.Match)
+		if err != nil {
+			closeClients(cfg, nil, nil, routes)
+			return nil, fmt.Errorf("route %s: %v", routeCfg.Name, err)
+		}
+
+		metricsClient, err := nrclient.NewMetricsClient(routeCfg.NRClientConfig, cfg.ProxyConfig)
+		if err != nil {
+			log.WithField("route", routeCfg.Name).WithField("error", err).Error("Error creating Metrics client")
+		}
+
+		nrClient, err := nrclient.NewNRClient(routeCfg.NRClientConfig, cfg.ProxyConfig, metricsClient)
+		if err != nil {
+			closeClients(cfg, metricsClient, nil, routes)
+			return nil, fmt.Errorf("route %s: %v", routeCfg.Name, err)
+		}
+
+		routes = append(routes, nrclient.Route{
+			Name:    routeCfg.Name,
+			Matcher: matcher,
+			Client:  nrClient,
+		})
+	}
+	return routes, nil
+}
+
+// buildLogsToMetrics creates the logs to metrics rules, sending the derived metrics to the Metric API. It returns nil
+// if no rules are configured.
+func buildLogsToMetrics(cfg config.PluginConfig) (*nrclient.LogsToMetrics, error) {
+	if len(cfg.LogsToMetrics) == 0 {
+		return nil, nil
+	}
+
+	metricsClient, err := nrclient.NewLogsToMetricsClient(cfg.NRClientConfig, cfg.ProxyConfig)
+	if err != nil {
+		return nil, err
+	}
+	logsToMetrics, err := nrclient.NewLogsToMetrics(cfg.LogsToMetrics, metricsClient)
+	if err != nil {
+		metricsClient.Shutdown(context.Background())
+		return nil, err
+	}
+	return logsToMetrics, nil
+}
+
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	id := output.FLBPluginGetContext(ctx).(string)
+	shutdown(id)
 	return output.FLB_OK
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	// Instances already shut down by FLBPluginExitCtx have been removed from the repos
+	for id := range routerRepo {
+		shutdown(id)
+	}
 	return output.FLB_OK
 }
 
+// shutdown stops an output instance: it stops accepting new chunks, waits for the in-flight sends up to the
+// configured timeout, sends the last harvest of metrics, closes the HTTP connections and removes the instance
+func shutdown(id string) {
+	router, ok := routerRepo[id]
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutRepo[id])
+	defer cancel()
+
+	if err := router.Close(ctx); err != nil {
+		log.WithField("error", err).Warn("Output instance didn't shut down cleanly")
+	}
+	if logsToMetrics, ok := logsToMetricsRepo[id]; ok {
+		logsToMetrics.Close(ctx)
+	}
+
+	// The instance is forgotten, so that FLBPluginExit doesn't shut it down again
+	delete(routerRepo, id)
+	delete(dataFormatConfigRepo, id)
+	delete(shutdownTimeoutRepo, id)
+	delete(metricsClientRepo, id)
+	delete(logsToMetricsRepo, id)
+	delete(transcodeRepo, id)
+	delete(quarantineRepo, id)
+}
+
 func main() {
 	logLevel, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if err != nil {
@@ -0,0 +1,131 @@
+package record
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+)
+
+// maxPooledBufferSize is the capacity above which buffers aren't returned to the pool, so that an occasional huge
+// chunk doesn't keep its memory allocated for the lifetime of the plugin
+const maxPooledBufferSize = 4 * maxPacketSize
+
+// bufferPool holds the buffers the records are encoded into before being compressed. Payloads aren't pooled, since
+// they are handed over to the HTTP client, which may still be reading a request body after returning.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// compressorPools holds a *sync.Pool of compressors for each compressorKey, since the level of a compressor can't
+// be changed once created. Compressors are reset before being reused, so they are safe to share among concurrent
+// flushes.
+var compressorPools sync.Map
+
+type compressorKey struct {
+	compressionType config.CompressionType
+	level           int
+}
+
+// compressor is implemented by the gzip, zlib and zstd writers, which can all be reset to write into a new buffer
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func getBuffer() *bytes.Buffer {
+	buff := bufferPool.Get().(*bytes.Buffer)
+	buff.Reset()
+	return buff
+}
+
+func putBuffer(buff *bytes.Buffer) {
+	if buff == nil || buff.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buff)
+}
+
+func isSupportedCompression(compressionType config.CompressionType) bool {
+	switch compressionType {
+	case config.Gzip, config.Zstd, config.Deflate, config.NoCompression:
+		return true
+	}
+	return false
+}
+
+// compress compresses the data into a new byte buffer using the provided codec and level, 0 being the default
+// level of the codec
+func compress(data []byte, compressionType config.CompressionType, level int) (*bytes.Buffer, error) {
+	if !isSupportedCompression(compressionType) {
+		return nil, fmt.Errorf("unknown compression method")
+	}
+
+	buff := new(bytes.Buffer)
+	if compressionType == config.NoCompression {
+		buff.Write(data)
+		return buff, nil
+	}
+
+	pool := compressorPool(compressorKey{compressionType: compressionType, level: level})
+	writer, ok := pool.Get().(compressor)
+	if ok {
+		writer.Reset(buff)
+	} else {
+		var err error
+		if writer, err = newCompressor(buff, compressionType, level); err != nil {
+			return nil, err
+		}
+	}
+
+	// A compressor that failed is left for the garbage collector, since its state is unknown
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	// Close already takes care of flushing the final output
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	// Pooled compressors must not keep the payload alive
+	writer.Reset(io.Discard)
+	pool.Put(writer)
+	return buff, nil
+}
+
+func compressorPool(key compressorKey) *sync.Pool {
+	if pool, ok := compressorPools.Load(key); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := compressorPools.LoadOrStore(key, new(sync.Pool))
+	return pool.(*sync.Pool)
+}
+
+func newCompressor(w io.Writer, compressionType config.CompressionType, level int) (compressor, error) {
+	switch compressionType {
+	case config.Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case config.Deflate:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	case config.Zstd:
+		encoderLevel := zstd.SpeedDefault
+		if level > 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	}
+	return nil, fmt.Errorf("unknown compression method")
+}
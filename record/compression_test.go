@@ -0,0 +1,160 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	compressionTypes := []config.CompressionType{config.Gzip, config.Zstd, config.Deflate}
+
+	for _, compressionType := range compressionTypes {
+		// Lock in current value (otherwise all tests will run with the last value)
+		compressionType := compressionType
+
+		It("reuses the "+compressionType.String()+" compressors safely among concurrent flushes", func() {
+			chunks := make([][]LogRecord, 8)
+			for i := range chunks {
+				chunks[i] = realisticChunk(int64(i), 200)
+			}
+
+			var wg sync.WaitGroup
+			results := make([]string, len(chunks))
+			errs := make([]error, len(chunks))
+			for i := range chunks {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for round := 0; round < 5; round++ {
+						payloads, err := PackageRecords(chunks[i], compressionType)
+						if err != nil {
+							errs[i] = err
+							return
+						}
+						Expect(payloads).To(HaveLen(1))
+						results[i], errs[i] = uncompressRecord(payloads[0], compressionType)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for i := range chunks {
+				Expect(errs[i]).To(BeNil())
+				expected, err := json.Marshal(chunks[i])
+				Expect(err).To(BeNil())
+				Expect(results[i]).To(MatchJSON(expected))
+			}
+		})
+	}
+
+	It("fails with invalid compression levels without poisoning the pool", func() {
+		_, _, err := PackageRecordsWithStats(realisticChunk(1, 1), config.Gzip, 42)
+		Expect(err).To(HaveOccurred())
+
+		payloads, _, err := PackageRecordsWithStats(realisticChunk(1, 1), config.Gzip, 0)
+		Expect(err).To(BeNil())
+		Expect(payloads).To(HaveLen(1))
+	})
+})
+
+// realisticChunk builds records resembling the ones of a Fluent Bit chunk tailing Kubernetes container logs
+func realisticChunk(seed int64, size int) []LogRecord {
+	random := rand.New(rand.NewSource(seed))
+	levels := []string{"DEBUG", "INFO", "INFO", "INFO", "WARN", "ERROR"}
+	paths := []string{"/api/v1/orders", "/api/v1/payments", "/healthz", "/api/v1/users/profile"}
+
+	records := make([]LogRecord, size)
+	for i := range records {
+		records[i] = LogRecord{
+			"message": fmt.Sprintf("%s request_id=%016x method=GET path=%s status=%d duration=%dms",
+				levels[random.Intn(len(levels))], random.Uint64(), paths[random.Intn(len(paths))],
+				200+100*random.Intn(4), random.Intn(2000)),
+			"stream":    "stdout",
+			"timestamp": int64(1700000000000 + i),
+			"kubernetes": map[string]interface{}{
+				"pod_name":       fmt.Sprintf("checkout-%08x", random.Uint32()),
+				"namespace_name": "production",
+				"container_name": "checkout",
+				"host":           fmt.Sprintf("ip-10-0-%d-%d.ec2.internal", random.Intn(255), random.Intn(255)),
+				"labels": map[string]interface{}{
+					"app":               "checkout",
+					"pod-template-hash": "5d8f7c9b6",
+				},
+			},
+			"plugin": map[string]interface{}{
+				"type":    "fluent-bit",
+				"version": "1.0.0",
+				"source":  "kubernetes",
+			},
+		}
+	}
+	return records
+}
+
+func benchmarkPackageRecords(b *testing.B, compressionType config.CompressionType) {
+	records := realisticChunk(1, 2000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := PackageRecords(records, compressionType); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkPackageRecordsParallel simulates several Fluent Bit workers flushing chunks at the same time
+func benchmarkPackageRecordsParallel(b *testing.B, compressionType config.CompressionType) {
+	records := realisticChunk(1, 2000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := PackageRecords(records, compressionType); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkPackageRecordsGzip(b *testing.B) {
+	benchmarkPackageRecords(b, config.Gzip)
+}
+
+func BenchmarkPackageRecordsZstd(b *testing.B) {
+	benchmarkPackageRecords(b, config.Zstd)
+}
+
+func BenchmarkPackageRecordsDeflate(b *testing.B) {
+	benchmarkPackageRecords(b, config.Deflate)
+}
+
+func BenchmarkPackageRecordsGzipParallel(b *testing.B) {
+	benchmarkPackageRecordsParallel(b, config.Gzip)
+}
+
+func BenchmarkPackageRecordsZstdParallel(b *testing.B) {
+	benchmarkPackageRecordsParallel(b, config.Zstd)
+}
+
+func BenchmarkPackageRecordsOtlpGzip(b *testing.B) {
+	records := realisticChunk(1, 2000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := PackageRecordsAsOtlp(records, config.Gzip, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package record
+
+import (
+	"reflect"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackHandle decodes the msgpack values as output.NewDecoder does, including the Fluent Bit timestamps
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	handle := new(codec.MsgpackHandle)
+	handle.SetBytesExt(reflect.TypeOf(output.FLBTime{}), 0, &output.FLBTime{})
+	return handle
+}
+
+// EventDecoder decodes the events of a Fluent Bit chunk as output.GetRecord does, except for the Fluent Bit v2 events
+// ([[TIMESTAMP, METADATA], MESSAGE]), whose whole [TIMESTAMP, METADATA] header is returned as the timestamp instead
+// of just TIMESTAMP, so that RemapRecord can merge their metadata. Unlike output.NewDecoder, it doesn't copy the
+// chunk, which must not be modified until decoding is over.
+type EventDecoder struct {
+	dec *codec.Decoder
+}
+
+func NewEventDecoder(chunk []byte) *EventDecoder {
+	return &EventDecoder{dec: codec.NewDecoderBytes(chunk, msgpackHandle)}
+}
+
+// Next decodes the next event of the chunk. It returns false once the chunk is over or when an event can't be
+// decoded, in which case the rest of the chunk is ignored.
+func (d *EventDecoder) Next() (ts interface{}, fbRecord FluentBitRecord, ok bool) {
+	var event interface{}
+	if err := d.dec.Decode(&event); err != nil {
+		return nil, nil, false
+	}
+
+	fields, isArray := event.([]interface{})
+	if !isArray || len(fields) != 2 {
+		return nil, nil, false
+	}
+
+	switch header := fields[0].(type) {
+	case output.FLBTime, uint64:
+	case []interface{}:
+		if len(header) < 2 {
+			return nil, nil, false
+		}
+	default:
+		return nil, nil, false
+	}
+
+	message, isMap := fields[1].(map[interface{}]interface{})
+	if !isMap {
+		return nil, nil, false
+	}
+	return fields[0], message, true
+}
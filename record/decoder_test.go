@@ -0,0 +1,78 @@
+package record
+
+import (
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event decoding", func() {
+	// A chunk such as the ones received from Fluent Bit v2, mixing events with and without metadata
+	chunk := encodeEvents(
+		[]interface{}{
+			[]interface{}{eventTime(1700000000, 123000000), map[string]interface{}{"otlp": map[string]interface{}{"severity_text": "INFO"}}},
+			map[string]interface{}{"log": "v2", "metadata.source": "original"},
+		},
+		[]interface{}{eventTime(1700000001, 0), map[string]interface{}{"log": "v1"}},
+		[]interface{}{uint64(1700000002), map[string]interface{}{"log": "integer timestamp"}},
+	)
+	// An event with an unsupported timestamp type, which ends the decoding
+	chunk = append(chunk, 0x92, 0x05, 0x80)
+	chunk = append(chunk, encodeEvents([]interface{}{eventTime(1700000003, 0), map[string]interface{}{"log": "ignored"}})...)
+
+	It("decodes the same records as output.GetRecord, keeping the Fluent Bit v2 event headers", func() {
+		var expectedTimestamps []interface{}
+		var expectedRecords []FluentBitRecord
+		dec := output.NewDecoder(unsafe.Pointer(&chunk[0]), len(chunk))
+		for {
+			ret, ts, fbRecord := output.GetRecord(dec)
+			if ret != 0 {
+				break
+			}
+			expectedTimestamps = append(expectedTimestamps, ts)
+			expectedRecords = append(expectedRecords, fbRecord)
+		}
+
+		var timestamps []interface{}
+		var records []FluentBitRecord
+		eventDecoder := NewEventDecoder(chunk)
+		for {
+			ts, fbRecord, ok := eventDecoder.Next()
+			if !ok {
+				break
+			}
+			timestamps = append(timestamps, ts)
+			records = append(records, fbRecord)
+		}
+
+		Expect(records).To(HaveLen(3))
+		Expect(records).To(Equal(expectedRecords))
+		Expect(timestamps[1:]).To(Equal(expectedTimestamps[1:]))
+		header, ok := timestamps[0].([]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(header).To(HaveLen(2))
+		Expect(header[0]).To(Equal(expectedTimestamps[0]))
+	})
+
+	It("lets RemapRecord merge the metadata of the Fluent Bit v2 events", func() {
+		dataFormatConfig := config.DataFormatConfig{IncludeEventMetadata: true, EventMetadataPrefix: "metadata."}
+
+		ts, fbRecord, ok := NewEventDecoder(chunk).Next()
+		Expect(ok).To(BeTrue())
+		remapped := RemapRecord(fbRecord, ts, "tag", "0.0.0", dataFormatConfig)
+
+		Expect(remapped["metadata.otlp"]).To(Equal(map[string]interface{}{"severity_text": "INFO"}))
+		Expect(remapped["metadata.source"]).To(Equal("original"))
+		Expect(remapped["timestamp"]).To(Equal(int64(1700000000123)))
+		Expect(remapped["message"]).To(Equal("v2"))
+	})
+
+	It("doesn't decode anything out of an empty chunk", func() {
+		_, _, ok := NewEventDecoder(nil).Next()
+
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,144 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event API limits
+const (
+	maxEventAttributes         = 255
+	maxEventAttributeNameLen   = 255
+	maxEventAttributeValueSize = 4096
+
+	eventTypeKey = "eventType"
+)
+
+// eventPriorityKeys are kept when an event exceeds the maximum amount of attributes
+var eventPriorityKeys = []string{eventTypeKey, "timestamp", "message"}
+
+// PackageRecordsAsEvents works as PackageRecordsWithStats, converting each record to an Event API custom event
+func PackageRecordsAsEvents(records []LogRecord, compressionType config.CompressionType, compressionLevel int, cfg config.EventConfig) (ret []PackagedRecords, stats PackagingStats, err error) {
+	events := make([]LogRecord, len(records))
+	for i, record := range records {
+		events[i] = toEvent(record, cfg)
+	}
+	return PackageRecordsWithStats(events, compressionType, compressionLevel)
+}
+
+// toEvent converts a record into a custom event following the Event API attribute rules:
+//   - the event type is taken from the EventTypeKey attribute if it holds a valid event type, or from the
+//     configured one otherwise
+//   - nested objects are flattened using dots to join the keys, arrays are sent as JSON strings and booleans as
+//     strings
+//   - attributes with null values or names longer than 255 characters are discarded, as well as non-numeric
+//     timestamps
+//   - string values are truncated to 4096 bytes
+//   - only the first 255 attributes (by name, the event type, timestamp and message taking precedence) are kept
+func toEvent(record LogRecord, cfg config.EventConfig) LogRecord {
+	event := make(LogRecord, len(record)+1)
+	for key, value := range record {
+		if key == cfg.EventTypeKey {
+			continue
+		}
+		flattenEventAttribute(event, key, value)
+	}
+
+	if timestamp, ok := event["timestamp"]; ok {
+		if _, isString := timestamp.(string); isString {
+			delete(event, "timestamp")
+		}
+	}
+
+	event[eventTypeKey] = cfg.EventType
+	if len(cfg.EventTypeKey) > 0 {
+		if eventType, ok := record[cfg.EventTypeKey].(string); ok && config.IsValidEventType(eventType) {
+			event[eventTypeKey] = eventType
+		}
+	}
+
+	if len(event) > maxEventAttributes {
+		log.WithField("attributes", len(event)).Debug("Event exceeds the maximum amount of attributes, discarding the extra ones")
+		event = truncateEventAttributes(event)
+	}
+	return event
+}
+
+func flattenEventAttribute(event LogRecord, key string, value interface{}) {
+	switch value := value.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		for k, v := range value {
+			flattenEventAttribute(event, key+"."+k, v)
+		}
+		return
+	case map[string]string:
+		for k, v := range value {
+			flattenEventAttribute(event, key+"."+k, v)
+		}
+		return
+	}
+
+	if len(key) > maxEventAttributeNameLen {
+		return
+	}
+
+	switch value := value.(type) {
+	case string:
+		event[key] = truncateEventValue(value)
+	case bool:
+		event[key] = strconv.FormatBool(value)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		event[key] = value
+	case []byte:
+		event[key] = truncateEventValue(string(value))
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			event[key] = truncateEventValue(fmt.Sprint(value))
+		} else {
+			event[key] = truncateEventValue(string(data))
+		}
+	}
+}
+
+// truncateEventValue truncates a string to the maximum attribute value size, without splitting UTF-8 characters
+func truncateEventValue(value string) string {
+	if len(value) <= maxEventAttributeValueSize {
+		return value
+	}
+	end := maxEventAttributeValueSize
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
+
+func truncateEventAttributes(event LogRecord) LogRecord {
+	truncated := make(LogRecord, maxEventAttributes)
+	for _, key := range eventPriorityKeys {
+		if value, ok := event[key]; ok {
+			truncated[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(event))
+	for key := range event {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(truncated) == maxEventAttributes {
+			break
+		}
+		truncated[key] = event[key]
+	}
+	return truncated
+}
@@ -0,0 +1,91 @@
+package record
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event conversion", func() {
+	eventCfg := config.EventConfig{EventType: "Deployment", EventTypeKey: "kind"}
+
+	It("uses the event type from the record attribute, falling back to the configured one", func() {
+		Expect(toEvent(LogRecord{"kind": "AuditEvent"}, eventCfg)).To(Equal(LogRecord{"eventType": "AuditEvent"}))
+		Expect(toEvent(LogRecord{"kind": "not valid!"}, eventCfg)).To(Equal(LogRecord{"eventType": "Deployment"}))
+		Expect(toEvent(LogRecord{"message": "hi"}, eventCfg)).To(Equal(LogRecord{"eventType": "Deployment", "message": "hi"}))
+	})
+
+	It("flattens nested objects and converts the values to the supported types", func() {
+		event := toEvent(LogRecord{
+			"timestamp":  int64(1700000000000),
+			"kubernetes": map[string]interface{}{"pod_name": "pod-1", "labels": map[string]interface{}{"app": "shop"}},
+			"plugin":     map[string]string{"type": "fluent-bit"},
+			"tags":       []interface{}{"a", "b"},
+			"success":    true,
+			"duration":   1.5,
+			"missing":    nil,
+		}, eventCfg)
+
+		Expect(event).To(Equal(LogRecord{
+			"eventType":             "Deployment",
+			"timestamp":             int64(1700000000000),
+			"kubernetes.pod_name":   "pod-1",
+			"kubernetes.labels.app": "shop",
+			"plugin.type":           "fluent-bit",
+			"tags":                  `["a","b"]`,
+			"success":               "true",
+			"duration":              1.5,
+		}))
+	})
+
+	It("discards non-numeric timestamps and long attribute names, and truncates long values", func() {
+		longName := strings.Repeat("k", 256)
+		event := toEvent(LogRecord{
+			"timestamp": "yesterday",
+			longName:    "value",
+			"message":   strings.Repeat("é", 3000),
+		}, eventCfg)
+
+		Expect(event).To(HaveLen(2))
+		Expect(event).To(HaveKeyWithValue("eventType", "Deployment"))
+		Expect(len(event["message"].(string))).To(Equal(4096))
+	})
+
+	It("keeps up to 255 attributes, including the event type, timestamp and message", func() {
+		record := LogRecord{"timestamp": int64(1), "message": "hi"}
+		for i := 0; i < 300; i++ {
+			record[fmt.Sprintf("attr%03d", i)] = i
+		}
+
+		event := toEvent(record, eventCfg)
+
+		Expect(event).To(HaveLen(255))
+		Expect(event).To(HaveKey("eventType"))
+		Expect(event).To(HaveKey("timestamp"))
+		Expect(event).To(HaveKey("message"))
+		Expect(event).To(HaveKey("attr000"))
+		Expect(event).NotTo(HaveKey("attr299"))
+	})
+
+	It("packages the events as a compressed JSON array", func() {
+		payloads, _, err := PackageRecordsAsEvents([]LogRecord{{"message": "hi"}}, config.Gzip, 0, eventCfg)
+
+		Expect(err).To(BeNil())
+		Expect(payloads).To(HaveLen(1))
+		reader, err := gzip.NewReader(bytes.NewReader(payloads[0].Bytes()))
+		Expect(err).To(BeNil())
+		data, err := io.ReadAll(reader)
+		Expect(err).To(BeNil())
+		var events []map[string]interface{}
+		Expect(json.Unmarshal(data, &events)).To(Succeed())
+		Expect(events).To(Equal([]map[string]interface{}{{"eventType": "Deployment", "message": "hi"}}))
+	})
+})
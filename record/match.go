@@ -0,0 +1,144 @@
+package record
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagMatchKey is the key used in match expressions to refer to the Fluent Bit tag of the record
+const TagMatchKey = "$tag"
+
+type matchOperator int
+
+const (
+	matchEquals matchOperator = iota
+	matchNotEquals
+	matchRegex
+)
+
+type matchCondition struct {
+	key      string
+	operator matchOperator
+	value    string
+	regex    *regexp.Regexp
+}
+
+// Matcher evaluates a match expression against a LogRecord and its Fluent Bit tag. An expression is a
+// comma-separated list of conditions that must all be met. Each condition can be:
+//
+//	key=value   the attribute value is equal to value
+//	key!=value  the attribute value is not equal to value (or the attribute is missing)
+//	key~regex   the attribute value matches the regular expression
+//
+// Keys can refer to nested attributes using dots (e.g. kubernetes.namespace_name), and $tag refers to the
+// Fluent Bit tag.
+type Matcher struct {
+	expression string
+	conditions []matchCondition
+}
+
+// NewMatcher compiles a match expression
+func NewMatcher(expression string) (*Matcher, error) {
+	matcher := &Matcher{expression: expression}
+
+	for _, rawCondition := range strings.Split(expression, ",") {
+		rawCondition = strings.TrimSpace(rawCondition)
+		if len(rawCondition) == 0 {
+			continue
+		}
+
+		condition, err := parseMatchCondition(rawCondition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match expression %q: %v", expression, err)
+		}
+		matcher.conditions = append(matcher.conditions, condition)
+	}
+
+	if len(matcher.conditions) == 0 {
+		return nil, fmt.Errorf("invalid match expression %q: no conditions found", expression)
+	}
+
+	return matcher, nil
+}
+
+func parseMatchCondition(rawCondition string) (condition matchCondition, err error) {
+	i := strings.IndexAny(rawCondition, "!=~")
+	if i <= 0 {
+		return condition, fmt.Errorf("condition %q should follow the format key=value, key!=value or key~regex", rawCondition)
+	}
+
+	condition.key = strings.TrimSpace(rawCondition[:i])
+	switch {
+	case strings.HasPrefix(rawCondition[i:], "!="):
+		condition.operator = matchNotEquals
+		condition.value = strings.TrimSpace(rawCondition[i+2:])
+	case rawCondition[i] == '=':
+		condition.operator = matchEquals
+		condition.value = strings.TrimSpace(rawCondition[i+1:])
+	case rawCondition[i] == '~':
+		condition.operator = matchRegex
+		condition.value = strings.TrimSpace(rawCondition[i+1:])
+		condition.regex, err = regexp.Compile(condition.value)
+	default:
+		err = fmt.Errorf("condition %q should follow the format key=value, key!=value or key~regex", rawCondition)
+	}
+	return
+}
+
+// Matches returns true if the record (and its Fluent Bit tag) meets all the conditions of the expression
+func (m *Matcher) Matches(logRecord LogRecord, tag string) bool {
+	for _, condition := range m.conditions {
+		var value interface{}
+		var found bool
+		if condition.key == TagMatchKey {
+			value, found = tag, true
+		} else {
+			value, found = LookupAttribute(logRecord, condition.key)
+		}
+
+		switch condition.operator {
+		case matchEquals:
+			if !found || fmt.Sprint(value) != condition.value {
+				return false
+			}
+		case matchNotEquals:
+			if found && fmt.Sprint(value) == condition.value {
+				return false
+			}
+		case matchRegex:
+			if !found || !condition.regex.MatchString(fmt.Sprint(value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *Matcher) String() string {
+	return m.expression
+}
+
+// LookupAttribute returns the value of an attribute, which can be either a top-level attribute whose name
+// contains dots (e.g. "plugin.source") or a nested attribute (e.g. "kubernetes" -> "namespace_name").
+func LookupAttribute(logRecord LogRecord, key string) (interface{}, bool) {
+	if value, ok := logRecord[key]; ok {
+		return value, true
+	}
+
+	var current map[string]interface{} = logRecord
+	for {
+		i := strings.IndexByte(key, '.')
+		if i < 0 {
+			return nil, false
+		}
+		nested, ok := current[key[:i]].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok := nested[key[i+1:]]; ok {
+			return value, true
+		}
+		current, key = nested, key[i+1:]
+	}
+}
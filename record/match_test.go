@@ -0,0 +1,57 @@
+package record
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Match expressions", func() {
+	logRecord := LogRecord{
+		"message":       "Payment accepted",
+		"status":        200,
+		"plugin.source": "BARE-METAL",
+		"kubernetes": map[string]interface{}{
+			"namespace_name": "payments",
+			"labels": map[string]interface{}{
+				"app": "checkout",
+			},
+		},
+	}
+
+	expressionToExpectedMatch := map[string]bool{
+		"kubernetes.namespace_name=payments": true,
+		"kubernetes.namespace_name=billing":  false,
+		"kubernetes.labels.app=checkout":     true,
+		"plugin.source=BARE-METAL":           true,
+		"status=200":                         true,
+		"status!=200":                        false,
+		"missing!=value":                     true,
+		"missing=value":                      false,
+		"message~^Payment":                   true,
+		"message~^Refund":                    false,
+		"$tag=kube.payments":                 true,
+		"$tag~^kube\\.":                      true,
+		"kubernetes.namespace_name=payments, $tag=kube.payments":  true,
+		"kubernetes.namespace_name=payments, $tag=kube.other-tag": false,
+	}
+
+	for expression, expectedMatch := range expressionToExpectedMatch {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		expr := expression
+		expected := expectedMatch
+
+		It("evaluates "+expr, func() {
+			matcher, err := NewMatcher(expr)
+
+			Expect(err).To(BeNil())
+			Expect(matcher.Matches(logRecord, "kube.payments")).To(Equal(expected))
+		})
+	}
+
+	It("rejects invalid expressions", func() {
+		for _, expression := range []string{"", "novalue", "=value", "message~[invalid"} {
+			_, err := NewMatcher(expression)
+			Expect(err).NotTo(BeNil(), expression)
+		}
+	})
+})
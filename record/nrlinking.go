@@ -0,0 +1,43 @@
+package record
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// Decoration appended by the New Relic APM agents to the log lines when local decoration is enabled:
+// NR-LINKING|entityGuid|hostname|traceId|spanId|entityName|
+var nrLinkingPattern = regexp.MustCompile(`[ \t]?NR-LINKING\|([^|\s]*)\|([^|\s]*)\|([^|\s]*)\|([^|\s]*)\|([^|\n]*)\|`)
+
+// Attributes set out of each of the fields of the NR-LINKING decoration, in order
+var nrLinkingKeys = []string{"entity.guid", "hostname", traceIdKey, spanIdKey, "entity.name"}
+
+// parseNrLinking looks for the NR-LINKING decoration in the message, sets the linking attributes out of it
+// (without overwriting existing ones) and strips the decoration from the message.
+func parseNrLinking(outputRecord LogRecord) {
+	message, ok := outputRecord["message"].(string)
+	if !ok {
+		return
+	}
+
+	match := nrLinkingPattern.FindStringSubmatchIndex(message)
+	if match == nil {
+		return
+	}
+
+	for i, key := range nrLinkingKeys {
+		value := message[match[2*i+2]:match[2*i+3]]
+		if _, exists := outputRecord[key]; exists || value == "" {
+			continue
+		}
+		// Agents URL-encode the entity name, since it could contain the separator character
+		if key == "entity.name" {
+			if unescaped, err := url.QueryUnescape(value); err == nil {
+				value = unescaped
+			}
+		}
+		outputRecord[key] = value
+	}
+
+	outputRecord["message"] = message[:match[0]] + message[match[1]:]
+}
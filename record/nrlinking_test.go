@@ -0,0 +1,57 @@
+package record
+
+import (
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NR-LINKING decoration", func() {
+	const pluginVersion = "0.0.0"
+	const decoration = "NR-LINKING|MTIzNDU2fEFQTXxBUFBMSUNBVElPTnw3ODkw|my-host|4bf92f3577b34da6a3ce929d0e0e4736|00f067aa0ba902b7|My%20Service|"
+	dataFormatConfig := config.DataFormatConfig{ParseNrLinking: true}
+
+	It("sets the linking attributes and strips the decoration from the message", func() {
+		inputMap := FluentBitRecord{"log": "Order processed " + decoration}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["message"]).To(Equal("Order processed"))
+		Expect(foundOutput["entity.guid"]).To(Equal("MTIzNDU2fEFQTXxBUFBMSUNBVElPTnw3ODkw"))
+		Expect(foundOutput["hostname"]).To(Equal("my-host"))
+		Expect(foundOutput["trace.id"]).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(foundOutput["span.id"]).To(Equal("00f067aa0ba902b7"))
+		Expect(foundOutput["entity.name"]).To(Equal("My Service"))
+	})
+
+	It("keeps the text following the decoration", func() {
+		inputMap := FluentBitRecord{"message": "Order processed " + decoration + "\n\tat com.example.Main"}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["message"]).To(Equal("Order processed\n\tat com.example.Main"))
+	})
+
+	It("doesn't set empty fields nor overwrite existing attributes", func() {
+		inputMap := FluentBitRecord{
+			"log":      "Started NR-LINKING|guid|my-host|||My%20Service|",
+			"hostname": "existing-host",
+		}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["message"]).To(Equal("Started"))
+		Expect(foundOutput["hostname"]).To(Equal("existing-host"))
+		Expect(foundOutput).NotTo(HaveKey("trace.id"))
+		Expect(foundOutput).NotTo(HaveKey("span.id"))
+	})
+
+	It("doesn't parse the decoration unless configured", func() {
+		inputMap := FluentBitRecord{"log": "Order processed " + decoration}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, config.DataFormatConfig{})
+
+		Expect(foundOutput["message"]).To(Equal("Order processed " + decoration))
+		Expect(foundOutput).NotTo(HaveKey("entity.guid"))
+	})
+})
@@ -0,0 +1,401 @@
+package record
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the OTLP logs protobuf messages (opentelemetry/proto/collector/logs/v1/logs_service.proto,
+// opentelemetry/proto/logs/v1/logs.proto and opentelemetry/proto/common/v1/common.proto)
+const (
+	exportLogsRequestResourceLogs = 1
+
+	resourceLogsResource  = 1
+	resourceLogsScopeLogs = 2
+
+	resourceAttributes = 1
+
+	scopeLogsScope      = 1
+	scopeLogsLogRecords = 2
+
+	scopeName       = 1
+	scopeVersion    = 2
+	scopeAttributes = 3
+
+	logRecordTimeUnixNano         = 1
+	logRecordSeverityNumber       = 2
+	logRecordSeverityText         = 3
+	logRecordBody                 = 5
+	logRecordAttributes           = 6
+	logRecordTraceId              = 9
+	logRecordSpanId               = 10
+	logRecordObservedTimeUnixNano = 11
+
+	keyValueKey   = 1
+	keyValueValue = 2
+
+	anyValueString = 1
+	anyValueBool   = 2
+	anyValueInt    = 3
+	anyValueDouble = 4
+	anyValueArray  = 5
+	anyValueKvList = 6
+	anyValueBytes  = 7
+
+	arrayValueValues    = 1
+	kvListValueValues   = 1
+	otlpScopeName       = "newrelic-fluent-bit-output"
+	otlpMessageKey      = "message"
+	otlpTimestampKey    = "timestamp"
+	otlpPluginKey       = "plugin"
+	otlpKubernetesKey   = "kubernetes"
+	otlpPluginSourceKey = "plugin.source"
+)
+
+// otlpResourcePrefixes are the prefixes of the OpenTelemetry semantic conventions for resource attributes. Top-level
+// attributes using them are sent as resource attributes.
+var otlpResourcePrefixes = []string{"service.", "host.", "k8s.", "cloud.", "container.", "deployment.", "os.", "process."}
+
+// otlpKubernetesAttributes maps the attributes added by the Fluent Bit kubernetes filter to the OpenTelemetry
+// semantic conventions for resource attributes
+var otlpKubernetesAttributes = map[string]string{
+	"namespace_name":  "k8s.namespace.name",
+	"pod_name":        "k8s.pod.name",
+	"pod_id":          "k8s.pod.uid",
+	"container_name":  "k8s.container.name",
+	"host":            "k8s.node.name",
+	"docker_id":       "container.id",
+	"container_image": "container.image.name",
+}
+
+// PackageRecordsAsOtlp works as PackageRecordsWithStats, encoding the records as an OTLP/HTTP
+// ExportLogsServiceRequest
+func PackageRecordsAsOtlp(records []LogRecord, compressionType config.CompressionType, compressionLevel int) (ret []PackagedRecords, stats PackagingStats, err error) {
+	return packageRecords(records, asCompressedOtlp(compressionType, compressionLevel))
+}
+
+func asCompressedOtlp(compressionType config.CompressionType, compressionLevel int) payloadEncoder[LogRecord] {
+	return func(records []LogRecord) (*bytes.Buffer, int, error) {
+		data := encodeOtlpLogs(records, time.Now())
+		buff, err := compress(data, compressionType, compressionLevel)
+		if err != nil {
+			return nil, 0, err
+		}
+		return buff, len(data), nil
+	}
+}
+
+// otlpRecord is a LogRecord split into the parts of the OTLP data model
+type otlpRecord struct {
+	resource       map[string]interface{}
+	scope          map[string]interface{}
+	timestamp      uint64
+	severity       string
+	severityNumber int64
+	body           interface{}
+	traceId        []byte
+	spanId         []byte
+	attributes     map[string]interface{}
+}
+
+// encodeOtlpLogs encodes the records as an ExportLogsServiceRequest, grouping them by resource and scope
+func encodeOtlpLogs(records []LogRecord, observedTime time.Time) []byte {
+	type group struct {
+		resource []byte
+		scope    []byte
+		records  [][]byte
+	}
+	var groups []*group
+	groupsByKey := make(map[string]*group)
+
+	for _, logRecord := range records {
+		rec := toOtlpRecord(logRecord)
+		resource := appendKeyValues(nil, resourceAttributes, rec.resource)
+		scope := encodeOtlpScope(rec.scope)
+
+		key := string(resource) + "\x00" + string(scope)
+		g, ok := groupsByKey[key]
+		if !ok {
+			g = &group{resource: resource, scope: scope}
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
+		g.records = append(g.records, encodeOtlpLogRecord(rec, observedTime))
+	}
+
+	var request []byte
+	for _, g := range groups {
+		var scopeLogs []byte
+		scopeLogs = protowire.AppendTag(scopeLogs, scopeLogsScope, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, g.scope)
+		for _, rec := range g.records {
+			scopeLogs = protowire.AppendTag(scopeLogs, scopeLogsLogRecords, protowire.BytesType)
+			scopeLogs = protowire.AppendBytes(scopeLogs, rec)
+		}
+
+		var resourceLogs []byte
+		resourceLogs = protowire.AppendTag(resourceLogs, resourceLogsResource, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, g.resource)
+		resourceLogs = protowire.AppendTag(resourceLogs, resourceLogsScopeLogs, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+		request = protowire.AppendTag(request, exportLogsRequestResourceLogs, protowire.BytesType)
+		request = protowire.AppendBytes(request, resourceLogs)
+	}
+	return request
+}
+
+// toOtlpRecord maps a LogRecord to the OTLP data model:
+//   - the resource attributes following the OpenTelemetry semantic conventions (including the ones added by the
+//     Fluent Bit kubernetes filter) are sent as resource attributes
+//   - the plugin block is sent as the instrumentation scope
+//   - the timestamp, level, message, trace.id and span.id attributes are sent in their dedicated fields
+//   - any other attribute is sent as a log record attribute
+func toOtlpRecord(logRecord LogRecord) otlpRecord {
+	rec := otlpRecord{
+		resource:   make(map[string]interface{}),
+		scope:      make(map[string]interface{}),
+		attributes: make(map[string]interface{}, len(logRecord)),
+	}
+
+	for key, value := range logRecord {
+		switch {
+		case key == otlpKubernetesKey:
+			kubernetes, ok := value.(map[string]interface{})
+			if !ok {
+				rec.attributes[key] = value
+				continue
+			}
+			remaining := make(map[string]interface{})
+			for k, v := range kubernetes {
+				if resourceKey, ok := otlpKubernetesAttributes[k]; ok {
+					rec.resource[resourceKey] = v
+				} else {
+					remaining[k] = v
+				}
+			}
+			if len(remaining) > 0 {
+				rec.attributes[key] = remaining
+			}
+		case key == otlpPluginKey:
+			switch plugin := value.(type) {
+			case map[string]string:
+				for k, v := range plugin {
+					rec.scope[k] = v
+				}
+			case map[string]interface{}:
+				for k, v := range plugin {
+					rec.scope[k] = v
+				}
+			default:
+				rec.attributes[key] = value
+			}
+		case key == otlpPluginSourceKey:
+			rec.scope[key] = value
+		case key == otlpTimestampKey:
+			if timestamp, ok := otlpTimestamp(value); ok {
+				rec.timestamp = timestamp
+			} else {
+				rec.attributes[key] = value
+			}
+		case key == otlpMessageKey:
+			rec.body = value
+		case key == levelKey:
+			rec.severity = fmt.Sprint(value)
+		case key == severityNumberKey:
+			if number, ok := asInteger(value); ok {
+				rec.severityNumber = number
+			} else {
+				rec.attributes[key] = value
+			}
+		case key == traceIdKey || key == spanIdKey:
+			id, err := hex.DecodeString(fmt.Sprint(value))
+			if err != nil || (key == traceIdKey && len(id) != 16) || (key == spanIdKey && len(id) != 8) {
+				rec.attributes[key] = value
+			} else if key == traceIdKey {
+				rec.traceId = id
+			} else {
+				rec.spanId = id
+			}
+		case hasResourcePrefix(key):
+			rec.resource[key] = value
+		default:
+			rec.attributes[key] = value
+		}
+	}
+
+	return rec
+}
+
+func hasResourcePrefix(key string) bool {
+	for _, prefix := range otlpResourcePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// otlpTimestamp converts a timestamp attribute, as accepted by the Log API (seconds or milliseconds since the epoch),
+// to nanoseconds since the epoch
+func otlpTimestamp(value interface{}) (uint64, bool) {
+	if number, ok := asInteger(value); ok {
+		if number <= 0 {
+			return 0, false
+		}
+		if number < 1e11 {
+			// Seconds
+			return uint64(number) * uint64(time.Second), true
+		}
+		return uint64(number) * uint64(time.Millisecond), true
+	}
+
+	number, ok := value.(float64)
+	if !ok || number <= 0 {
+		return 0, false
+	}
+	if number < 1e11 {
+		return uint64(number * float64(time.Second)), true
+	}
+	return uint64(number * float64(time.Millisecond)), true
+}
+
+func encodeOtlpScope(scope map[string]interface{}) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, scopeName, protowire.BytesType)
+	b = protowire.AppendString(b, otlpScopeName)
+	if version, ok := scope["version"]; ok {
+		b = protowire.AppendTag(b, scopeVersion, protowire.BytesType)
+		b = protowire.AppendString(b, fmt.Sprint(version))
+	}
+	attributes := make(map[string]interface{}, len(scope))
+	for k, v := range scope {
+		if k == "version" {
+			continue
+		}
+		if k != otlpPluginSourceKey {
+			k = "plugin." + k
+		}
+		attributes[k] = v
+	}
+	return appendKeyValues(b, scopeAttributes, attributes)
+}
+
+func encodeOtlpLogRecord(rec otlpRecord, observedTime time.Time) []byte {
+	var b []byte
+	if rec.timestamp > 0 {
+		b = protowire.AppendTag(b, logRecordTimeUnixNano, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, rec.timestamp)
+	}
+	severityNumber := rec.severityNumber
+	if number, ok := severityNumbers[strings.ToUpper(rec.severity)]; ok && severityNumber == 0 {
+		severityNumber = int64(number)
+	}
+	if severityNumber > 0 {
+		b = protowire.AppendTag(b, logRecordSeverityNumber, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(severityNumber))
+	}
+	if len(rec.severity) > 0 {
+		b = protowire.AppendTag(b, logRecordSeverityText, protowire.BytesType)
+		b = protowire.AppendString(b, rec.severity)
+	}
+	if rec.body != nil {
+		b = protowire.AppendTag(b, logRecordBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeAnyValue(rec.body))
+	}
+	b = appendKeyValues(b, logRecordAttributes, rec.attributes)
+	if rec.traceId != nil {
+		b = protowire.AppendTag(b, logRecordTraceId, protowire.BytesType)
+		b = protowire.AppendBytes(b, rec.traceId)
+	}
+	if rec.spanId != nil {
+		b = protowire.AppendTag(b, logRecordSpanId, protowire.BytesType)
+		b = protowire.AppendBytes(b, rec.spanId)
+	}
+	b = protowire.AppendTag(b, logRecordObservedTimeUnixNano, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(observedTime.UnixNano()))
+	return b
+}
+
+// appendKeyValues appends the attributes, sorted by key, as repeated KeyValue messages with the provided field number
+func appendKeyValues(b []byte, field protowire.Number, attributes map[string]interface{}) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var kv []byte
+		kv = protowire.AppendTag(kv, keyValueKey, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kv = protowire.AppendTag(kv, keyValueValue, protowire.BytesType)
+		kv = protowire.AppendBytes(kv, encodeAnyValue(attributes[k]))
+
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, kv)
+	}
+	return b
+}
+
+func encodeAnyValue(value interface{}) []byte {
+	var b []byte
+	switch value := value.(type) {
+	case nil:
+		return b
+	case string:
+		b = protowire.AppendTag(b, anyValueString, protowire.BytesType)
+		return protowire.AppendString(b, value)
+	case bool:
+		b = protowire.AppendTag(b, anyValueBool, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(value))
+	case float32:
+		return encodeAnyValue(float64(value))
+	case float64:
+		b = protowire.AppendTag(b, anyValueDouble, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(value))
+	case uint64:
+		if value > math.MaxInt64 {
+			return encodeAnyValue(float64(value))
+		}
+		b = protowire.AppendTag(b, anyValueInt, protowire.VarintType)
+		return protowire.AppendVarint(b, value)
+	case uint:
+		return encodeAnyValue(uint64(value))
+	case []byte:
+		b = protowire.AppendTag(b, anyValueBytes, protowire.BytesType)
+		return protowire.AppendBytes(b, value)
+	case []interface{}:
+		var array []byte
+		for _, v := range value {
+			array = protowire.AppendTag(array, arrayValueValues, protowire.BytesType)
+			array = protowire.AppendBytes(array, encodeAnyValue(v))
+		}
+		b = protowire.AppendTag(b, anyValueArray, protowire.BytesType)
+		return protowire.AppendBytes(b, array)
+	case map[string]interface{}:
+		b = protowire.AppendTag(b, anyValueKvList, protowire.BytesType)
+		return protowire.AppendBytes(b, appendKeyValues(nil, kvListValueValues, value))
+	case map[string]string:
+		attributes := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			attributes[k] = v
+		}
+		return encodeAnyValue(attributes)
+	}
+
+	if number, ok := asInteger(value); ok {
+		b = protowire.AppendTag(b, anyValueInt, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(number))
+	}
+	b = protowire.AppendTag(b, anyValueString, protowire.BytesType)
+	return protowire.AppendString(b, fmt.Sprint(value))
+}
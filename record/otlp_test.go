@@ -0,0 +1,217 @@
+package record
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"math"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// protoFields decodes a protobuf message into the raw values of its fields, by field number
+type protoFields map[protowire.Number][]interface{}
+
+func decodeProto(b []byte) protoFields {
+	fields := make(protoFields)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+		var value interface{}
+		switch typ {
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			Fail("unexpected wire type")
+		}
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+		fields[num] = append(fields[num], value)
+	}
+	return fields
+}
+
+func (f protoFields) message(num protowire.Number) protoFields {
+	Expect(f[num]).To(HaveLen(1))
+	return decodeProto(f[num][0].([]byte))
+}
+
+func (f protoFields) messages(num protowire.Number) []protoFields {
+	var messages []protoFields
+	for _, value := range f[num] {
+		messages = append(messages, decodeProto(value.([]byte)))
+	}
+	return messages
+}
+
+// decodeAnyValue decodes the AnyValue messages into the Go types used by LogRecord
+func decodeAnyValue(f protoFields) interface{} {
+	switch {
+	case f[anyValueString] != nil:
+		return string(f[anyValueString][0].([]byte))
+	case f[anyValueBool] != nil:
+		return protowire.DecodeBool(f[anyValueBool][0].(uint64))
+	case f[anyValueInt] != nil:
+		return int64(f[anyValueInt][0].(uint64))
+	case f[anyValueDouble] != nil:
+		return math.Float64frombits(f[anyValueDouble][0].(uint64))
+	case f[anyValueArray] != nil:
+		var values []interface{}
+		for _, v := range f.message(anyValueArray).messages(arrayValueValues) {
+			values = append(values, decodeAnyValue(v))
+		}
+		return values
+	case f[anyValueKvList] != nil:
+		return decodeKeyValues(f.message(anyValueKvList).messages(kvListValueValues))
+	}
+	return nil
+}
+
+func decodeKeyValues(keyValues []protoFields) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for _, kv := range keyValues {
+		attributes[string(kv[keyValueKey][0].([]byte))] = decodeAnyValue(kv.message(keyValueValue))
+	}
+	return attributes
+}
+
+var _ = Describe("OTLP encoding", func() {
+	observedTime := time.Unix(1700000000, 0)
+
+	It("maps the timestamp, severity, message and trace context to the log record fields", func() {
+		records := []LogRecord{{
+			"timestamp": int64(1700000000123),
+			"level":     "error",
+			"message":   "Some message",
+			"trace.id":  "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span.id":   "00f067aa0ba902b7",
+			"count":     3,
+			"ratio":     0.5,
+			"ok":        true,
+			"nested":    map[string]interface{}{"key": "value"},
+			"list":      []interface{}{"a", int64(1)},
+		}}
+
+		request := decodeProto(encodeOtlpLogs(records, observedTime))
+		logRecord := request.message(exportLogsRequestResourceLogs).
+			message(resourceLogsScopeLogs).
+			message(scopeLogsLogRecords)
+
+		Expect(logRecord[logRecordTimeUnixNano]).To(Equal([]interface{}{uint64(1700000000123000000)}))
+		Expect(logRecord[logRecordObservedTimeUnixNano]).To(Equal([]interface{}{uint64(observedTime.UnixNano())}))
+		Expect(logRecord[logRecordSeverityNumber]).To(Equal([]interface{}{uint64(17)}))
+		Expect(logRecord[logRecordSeverityText]).To(Equal([]interface{}{[]byte("error")}))
+		Expect(decodeAnyValue(logRecord.message(logRecordBody))).To(Equal("Some message"))
+		Expect(hex.EncodeToString(logRecord[logRecordTraceId][0].([]byte))).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(hex.EncodeToString(logRecord[logRecordSpanId][0].([]byte))).To(Equal("00f067aa0ba902b7"))
+		Expect(decodeKeyValues(logRecord.messages(logRecordAttributes))).To(Equal(map[string]interface{}{
+			"count":  int64(3),
+			"ratio":  0.5,
+			"ok":     true,
+			"nested": map[string]interface{}{"key": "value"},
+			"list":   []interface{}{"a", int64(1)},
+		}))
+	})
+
+	It("keeps invalid trace context and timestamps as attributes", func() {
+		records := []LogRecord{{
+			"timestamp": "yesterday",
+			"trace.id":  "not-an-id",
+		}}
+
+		request := decodeProto(encodeOtlpLogs(records, observedTime))
+		logRecord := request.message(exportLogsRequestResourceLogs).
+			message(resourceLogsScopeLogs).
+			message(scopeLogsLogRecords)
+
+		Expect(logRecord[logRecordTimeUnixNano]).To(BeNil())
+		Expect(logRecord[logRecordTraceId]).To(BeNil())
+		Expect(decodeKeyValues(logRecord.messages(logRecordAttributes))).To(Equal(map[string]interface{}{
+			"timestamp": "yesterday",
+			"trace.id":  "not-an-id",
+		}))
+	})
+
+	It("sends the resource attributes and the plugin block as resource and scope, grouping the records by resource", func() {
+		plugin := map[string]string{"type": "fluent-bit", "version": "1.2.3", "source": "BARE-METAL"}
+		records := []LogRecord{
+			{
+				"message":      "first",
+				"service.name": "checkout",
+				"plugin":       plugin,
+				"kubernetes":   map[string]interface{}{"pod_name": "pod-1", "namespace_name": "shop", "labels": map[string]interface{}{"app": "checkout"}},
+			},
+			{
+				"message":      "second",
+				"service.name": "payments",
+				"plugin":       plugin,
+			},
+			{
+				"message":      "third",
+				"service.name": "checkout",
+				"plugin":       plugin,
+				"kubernetes":   map[string]interface{}{"pod_name": "pod-1", "namespace_name": "shop", "labels": map[string]interface{}{"app": "checkout"}},
+			},
+		}
+
+		request := decodeProto(encodeOtlpLogs(records, observedTime))
+		resourceLogs := request.messages(exportLogsRequestResourceLogs)
+		Expect(resourceLogs).To(HaveLen(2))
+
+		Expect(decodeKeyValues(resourceLogs[0].message(resourceLogsResource).messages(resourceAttributes))).To(Equal(map[string]interface{}{
+			"service.name":       "checkout",
+			"k8s.pod.name":       "pod-1",
+			"k8s.namespace.name": "shop",
+		}))
+		Expect(decodeKeyValues(resourceLogs[1].message(resourceLogsResource).messages(resourceAttributes))).To(Equal(map[string]interface{}{
+			"service.name": "payments",
+		}))
+
+		scopeLogs := resourceLogs[0].message(resourceLogsScopeLogs)
+		scope := scopeLogs.message(scopeLogsScope)
+		Expect(scope[scopeName]).To(Equal([]interface{}{[]byte(otlpScopeName)}))
+		Expect(scope[scopeVersion]).To(Equal([]interface{}{[]byte("1.2.3")}))
+		Expect(decodeKeyValues(scope.messages(scopeAttributes))).To(Equal(map[string]interface{}{
+			"plugin.type":   "fluent-bit",
+			"plugin.source": "BARE-METAL",
+		}))
+
+		logRecords := scopeLogs.messages(scopeLogsLogRecords)
+		Expect(logRecords).To(HaveLen(2))
+		Expect(decodeAnyValue(logRecords[0].message(logRecordBody))).To(Equal("first"))
+		Expect(decodeAnyValue(logRecords[1].message(logRecordBody))).To(Equal("third"))
+		Expect(decodeKeyValues(logRecords[0].messages(logRecordAttributes))).To(Equal(map[string]interface{}{
+			"kubernetes": map[string]interface{}{"labels": map[string]interface{}{"app": "checkout"}},
+		}))
+	})
+
+	It("packages the records as gzip-compressed protobuf payloads", func() {
+		records := []LogRecord{{"message": "Some message"}, {"message": "Another message"}}
+
+		payloads, stats, err := PackageRecordsAsOtlp(records, config.Gzip, 0)
+
+		Expect(err).To(BeNil())
+		Expect(payloads).To(HaveLen(1))
+		reader, err := gzip.NewReader(bytes.NewReader(payloads[0].Bytes()))
+		Expect(err).To(BeNil())
+		data, err := io.ReadAll(reader)
+		Expect(err).To(BeNil())
+		Expect(stats.UncompressedBytes).To(Equal(len(data)))
+
+		logRecords := decodeProto(data).message(exportLogsRequestResourceLogs).
+			message(resourceLogsScopeLogs).
+			messages(scopeLogsLogRecords)
+		Expect(logRecords).To(HaveLen(2))
+	})
+})
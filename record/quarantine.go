@@ -0,0 +1,127 @@
+package record
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/utils"
+)
+
+const quarantineFileExtension = ".json"
+
+// SplitEvents splits a Fluent Bit chunk into its msgpack-encoded events. As output.GetRecord does, it stops at the
+// first event that can't be decoded.
+func SplitEvents(chunk []byte) [][]byte {
+	var events [][]byte
+	reader := msgpackReader{data: chunk}
+	for reader.pos < len(chunk) {
+		start := reader.pos
+		if err := reader.skip(); err != nil {
+			break
+		}
+		events = append(events, chunk[start:reader.pos:reader.pos])
+	}
+	return events
+}
+
+// JoinEvents builds a Fluent Bit chunk from msgpack-encoded events
+func JoinEvents(events [][]byte) []byte {
+	size := 0
+	for _, event := range events {
+		size += len(event)
+	}
+	chunk := make([]byte, 0, size)
+	for _, event := range events {
+		chunk = append(chunk, event...)
+	}
+	return chunk
+}
+
+// FindPoisonEvents bisects the events to find the ones that make process panic when they are part of its input,
+// returning the panic caused by each of them keyed by its index. Process must not have side effects, since it is
+// called several times with overlapping sets of events. Events only making process panic in combination with
+// others that end up in a different half can't be found. When process panics without any event, the events aren't
+// to blame and none is returned.
+func FindPoisonEvents(events [][]byte, process func(events [][]byte)) map[int]error {
+	poison := make(map[int]error)
+	if err := utils.CatchPanic(func() { process(nil) }); err != nil {
+		return poison
+	}
+	var bisect func(offset int, events [][]byte)
+	bisect = func(offset int, events [][]byte) {
+		if len(events) == 0 {
+			return
+		}
+		err := utils.CatchPanic(func() { process(events) })
+		if err == nil {
+			return
+		}
+		if len(events) == 1 {
+			poison[offset] = err
+			return
+		}
+		half := len(events) / 2
+		bisect(offset, events[:half])
+		bisect(offset+half, events[half:])
+	}
+	bisect(0, events)
+	return poison
+}
+
+// Fingerprint identifies an event by the hash of its msgpack encoding, so that the same record can be found in the
+// logs, the quarantine directory and the Fluent Bit storage
+func Fingerprint(event []byte) string {
+	sum := sha256.Sum256(event)
+	return hex.EncodeToString(sum[:8])
+}
+
+// quarantinedEvent is the content of a quarantine file
+type quarantinedEvent struct {
+	Tag         string    `json:"tag"`
+	Fingerprint string    `json:"fingerprint"`
+	Time        time.Time `json:"time"`
+	Error       string    `json:"error"`
+	// Event is the base64 encoding of the event as received from Fluent Bit (msgpack)
+	Event string `json:"event"`
+}
+
+// Quarantine stores the events that can't be processed on disk, as dead letters to be inspected later on. Each
+// event is stored in its own file, named <unix nanos>-<sequence>-<fingerprint>.json.
+type Quarantine struct {
+	store *utils.DiskStore
+}
+
+// NewQuarantine returns a quarantine storing the events in dir, the events quarantined by a previous execution
+// counting towards maxBytes until they are removed
+func NewQuarantine(dir string, maxBytes int64) (*Quarantine, error) {
+	store, err := utils.NewDiskStore(dir, quarantineFileExtension, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("quarantine directory: %v", err)
+	}
+	return &Quarantine{store: store}, nil
+}
+
+// Store writes an event to the quarantine directory, along with the tag of its chunk and the error it caused. It
+// fails if storing it would exceed the maximum quarantine size.
+func (q *Quarantine) Store(event []byte, tag string, cause error) error {
+	fingerprint := Fingerprint(event)
+	data, err := json.Marshal(quarantinedEvent{
+		Tag:         tag,
+		Fingerprint: fingerprint,
+		Time:        time.Now().UTC(),
+		Error:       cause.Error(),
+		Event:       base64.StdEncoding.EncodeToString(event),
+	})
+	if err != nil {
+		return fmt.Errorf("can't encode quarantined event: %v", err)
+	}
+
+	if err := q.store.Write(fingerprint, data); err != nil {
+		return fmt.Errorf("can't quarantine event: %v", err)
+	}
+	return nil
+}
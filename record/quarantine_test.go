@@ -0,0 +1,123 @@
+package record
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quarantine", func() {
+	poisonEvent := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "poison"}})
+
+	// processWithPoison panics if any of the events is the poison event
+	processWithPoison := func(events [][]byte) {
+		for _, event := range events {
+			if bytes.Equal(event, poisonEvent) {
+				panic("poison record")
+			}
+		}
+	}
+
+	It("splits a chunk into its events and joins them back", func() {
+		chunk := encodeEvents(
+			[]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a"}},
+			[]interface{}{[]interface{}{eventTime(1700000000, 0), map[string]interface{}{}}, map[string]interface{}{"log": "b"}},
+			[]interface{}{uint64(1700000000), map[string]interface{}{"log": "c", "nested": []interface{}{1, 2.5, nil}}},
+		)
+
+		events := SplitEvents(chunk)
+
+		Expect(events).To(HaveLen(3))
+		Expect(JoinEvents(events)).To(Equal(chunk))
+		Expect(remapChunk(JoinEvents(events[1:2]), "tag", "0.0.0", config.DataFormatConfig{})).To(HaveLen(1))
+	})
+
+	It("stops splitting a chunk at the first event that can't be decoded", func() {
+		chunk := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a"}})
+		// A truncated [TIMESTAMP, RECORD] event
+		chunk = append(chunk, 0x92, 0xcf)
+
+		Expect(SplitEvents(chunk)).To(HaveLen(1))
+	})
+
+	It("finds the events making the processing panic", func() {
+		var events [][]byte
+		for i := 0; i < 11; i++ {
+			events = append(events, encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": i}}))
+		}
+		events[3] = poisonEvent
+		events[8] = poisonEvent
+
+		poison := FindPoisonEvents(events, processWithPoison)
+
+		Expect(poison).To(HaveLen(2))
+		Expect(poison).To(HaveKey(3))
+		Expect(poison).To(HaveKey(8))
+		Expect(poison[3].Error()).To(Equal("panic: poison record"))
+	})
+
+	It("doesn't find any poison event when the processing doesn't panic", func() {
+		events := SplitEvents(realisticEvents(10))
+
+		Expect(FindPoisonEvents(events, processWithPoison)).To(BeEmpty())
+		Expect(FindPoisonEvents(nil, processWithPoison)).To(BeEmpty())
+	})
+
+	It("doesn't blame any event when the processing panics without events", func() {
+		events := SplitEvents(realisticEvents(10))
+
+		poison := FindPoisonEvents(events, func(events [][]byte) {
+			panic("broken plugin state")
+		})
+
+		Expect(poison).To(BeEmpty())
+	})
+
+	It("fingerprints the events by their content", func() {
+		other := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "healthy"}})
+
+		Expect(Fingerprint(poisonEvent)).To(HaveLen(16))
+		Expect(Fingerprint(poisonEvent)).To(Equal(Fingerprint(append([]byte{}, poisonEvent...))))
+		Expect(Fingerprint(poisonEvent)).ToNot(Equal(Fingerprint(other)))
+	})
+
+	It("stores the quarantined events until the directory is full", func() {
+		tempDir, err := os.MkdirTemp("", "nr-quarantine")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(tempDir)
+
+		// The directory is created if it doesn't exist
+		dir := filepath.Join(tempDir, "quarantine")
+		quarantine, err := NewQuarantine(dir, 1024)
+		Expect(err).To(BeNil())
+
+		cause := errors.New("panic: poison record")
+		Expect(quarantine.Store(poisonEvent, "kube.logs", cause)).To(Succeed())
+
+		files, err := filepath.Glob(filepath.Join(dir, "*"+quarantineFileExtension))
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(1))
+		Expect(files[0]).To(HaveSuffix("-1-" + Fingerprint(poisonEvent) + quarantineFileExtension))
+
+		data, err := os.ReadFile(files[0])
+		Expect(err).To(BeNil())
+		var stored quarantinedEvent
+		Expect(json.Unmarshal(data, &stored)).To(Succeed())
+		Expect(stored.Tag).To(Equal("kube.logs"))
+		Expect(stored.Fingerprint).To(Equal(Fingerprint(poisonEvent)))
+		Expect(stored.Error).To(Equal("panic: poison record"))
+		Expect(base64.StdEncoding.DecodeString(stored.Event)).To(Equal(poisonEvent))
+
+		// The events stored by a previous execution count towards the maximum size
+		quarantine, err = NewQuarantine(dir, int64(len(data)+len(data)/2))
+		Expect(err).To(BeNil())
+		Expect(quarantine.Store(poisonEvent, "kube.logs", cause)).ToNot(Succeed())
+	})
+})
@@ -2,33 +2,67 @@ package record
 
 import (
 	"bytes"
-	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/klauspost/compress/zstd"
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/newrelic/newrelic-fluent-bit-output/utils"
+	"github.com/ugorji/go/codec"
 )
 
 const maxPacketSize = 1000000 // bytes
 
+// base64Suffix is appended to the name of the attributes holding base64-encoded binary values
+const base64Suffix = ".b64"
+
 type FluentBitRecord map[interface{}]interface{}
 
 type LogRecord map[string]interface{}
 
 type PackagedRecords = *bytes.Buffer
 
+// RemapStats counts the values altered while remapping records
+type RemapStats struct {
+	// InvalidUtf8Values is the number of byte values that weren't valid UTF-8, handled according to the configured
+	// InvalidUtf8Action
+	InvalidUtf8Values int
+}
+
 // RemapRecord takes a log record emitted by FluentBit, parses it into a NewRelic LogRecord
-// domain type and performs several key name re-mappings.
-func RemapRecord(inputRecord FluentBitRecord, inputTimestamp interface{}, pluginVersion string, dataFormatConfig config.DataFormatConfig) (outputRecord LogRecord) {
-	outputRecord = make(map[string]interface{})
-	outputRecord = parseRecord(inputRecord)
+// domain type and performs several key name re-mappings. The tag is the Fluent Bit tag of the
+// chunk the record belongs to.
+func RemapRecord(inputRecord FluentBitRecord, inputTimestamp interface{}, tag string, pluginVersion string, dataFormatConfig config.DataFormatConfig) (outputRecord LogRecord) {
+	outputRecord, _ = RemapRecordWithStats(inputRecord, inputTimestamp, tag, pluginVersion, dataFormatConfig)
+	return
+}
+
+// RemapRecordWithStats works as RemapRecord, additionally returning the stats of the remapping
+func RemapRecordWithStats(inputRecord FluentBitRecord, inputTimestamp interface{}, tag string, pluginVersion string, dataFormatConfig config.DataFormatConfig) (outputRecord LogRecord, stats RemapStats) {
+	parser := valueParser{invalidUtf8: dataFormatConfig.InvalidUtf8, stats: &stats}
+	outputRecord = parser.parseRecord(inputRecord)
+
+	if len(dataFormatConfig.Types.Types) > 0 {
+		coerceTypes(outputRecord, dataFormatConfig.Types)
+	}
+
+	if len(dataFormatConfig.TagKey) > 0 {
+		if _, ok := outputRecord[dataFormatConfig.TagKey]; !ok {
+			outputRecord[dataFormatConfig.TagKey] = tag
+		}
+	}
+
+	if dataFormatConfig.IncludeEventMetadata {
+		mergeEventMetadata(outputRecord, inputTimestamp, dataFormatConfig.EventMetadataPrefix, parser)
+	}
 
 	if timestamp, err := resolveTimestamp(outputRecord, inputTimestamp); err == nil {
 		outputRecord["timestamp"] = timestamp
@@ -38,6 +72,20 @@ func RemapRecord(inputRecord FluentBitRecord, inputTimestamp interface{}, plugin
 		outputRecord["message"] = val
 		delete(outputRecord, "log")
 	}
+
+	// The NR-LINKING decoration is stripped from the message before looking for any other trace context in it
+	if dataFormatConfig.ParseNrLinking {
+		parseNrLinking(outputRecord)
+	}
+
+	if dataFormatConfig.Severity.Normalize {
+		normalizeSeverity(outputRecord, dataFormatConfig.Severity)
+	}
+
+	if dataFormatConfig.ExtractTraceContext {
+		extractTraceContext(outputRecord)
+	}
+
 	source, ok := os.LookupEnv("SOURCE")
 	if !ok {
 		source = "BARE-METAL"
@@ -56,34 +104,108 @@ func RemapRecord(inputRecord FluentBitRecord, inputTimestamp interface{}, plugin
 	return
 }
 
+// valueParser turns the values decoded by Fluent Bit into LogRecord values, applying the configured action to the
+// byte values that aren't valid UTF-8. Its zero value replaces the invalid sequences and doesn't count them.
+type valueParser struct {
+	invalidUtf8 config.InvalidUtf8Action
+	stats       *RemapStats
+}
+
 // parseRecord transforms a log record emitted by FluentBit into a LogRecord
 // domain type: a map of string keys and arbitrary (int, string, etc.) values.
-// No value modification is performed by this method (except casting).
-func parseRecord(inputRecord map[interface{}]interface{}) map[string]interface{} {
-	return parseValue(inputRecord).(map[string]interface{})
+// No value modification is performed by this method (except casting, the
+// handling of invalid UTF-8, and the conversion of timestamps to epoch
+// milliseconds and of extension types to their type and base64 data).
+func (p valueParser) parseRecord(inputRecord map[interface{}]interface{}) map[string]interface{} {
+	return p.parseValue(inputRecord).(map[string]interface{})
 }
 
-func parseValue(value interface{}) interface{} {
+func (p valueParser) parseValue(value interface{}) interface{} {
 	switch value := value.(type) {
 	case []byte:
-		return string(value)
+		if utf8.Valid(value) {
+			return string(value)
+		}
+		if str, ok := p.parseInvalidUtf8(value); ok {
+			return str
+		}
+		return nil
 	case map[interface{}]interface{}:
 		remapped := make(map[string]interface{})
 		for k, v := range value {
-			remapped[k.(string)] = parseValue(v)
+			key := p.parseKey(k)
+			if b, ok := v.([]byte); ok && !utf8.Valid(b) {
+				if str, ok := p.parseInvalidUtf8(b); ok {
+					if p.invalidUtf8 == config.InvalidUtf8Base64 {
+						key += base64Suffix
+					}
+					remapped[key] = str
+				}
+				continue
+			}
+			remapped[key] = p.parseValue(v)
 		}
 		return remapped
 	case []interface{}:
-		remapped := make([]interface{}, len(value))
-		for i, v := range value {
-			remapped[i] = parseValue(v)
+		remapped := make([]interface{}, 0, len(value))
+		for _, v := range value {
+			// Array elements can't be renamed, so base64-encoded values are kept in place
+			if b, ok := v.([]byte); ok && !utf8.Valid(b) {
+				if str, ok := p.parseInvalidUtf8(b); ok {
+					remapped = append(remapped, str)
+				}
+				continue
+			}
+			remapped = append(remapped, p.parseValue(v))
 		}
 		return remapped
+	case output.FLBTime:
+		return value.UnixMilli()
+	case time.Time:
+		return value.UnixMilli()
+	case codec.RawExt:
+		// Extension types unknown to the Fluent Bit decoder
+		return map[string]interface{}{
+			"type": value.Tag,
+			"data": base64.StdEncoding.EncodeToString(value.Data),
+		}
 	default:
 		return value
 	}
 }
 
+// parseKey converts a map key into a string. Keys are strings in most records, but msgpack allows keys of any type,
+// which are converted as values and then encoded as JSON (for instance, 1 becomes "1" and true becomes "true").
+func (p valueParser) parseKey(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	}
+
+	if data, err := json.Marshal(p.parseValue(key)); err == nil {
+		return string(data)
+	}
+	return fmt.Sprint(key)
+}
+
+// parseInvalidUtf8 applies the configured action to a byte value that isn't valid UTF-8, returning false if the
+// value must be dropped
+func (p valueParser) parseInvalidUtf8(value []byte) (string, bool) {
+	if p.stats != nil {
+		p.stats.InvalidUtf8Values++
+	}
+	switch p.invalidUtf8 {
+	case config.InvalidUtf8Base64:
+		return base64.StdEncoding.EncodeToString(value), true
+	case config.InvalidUtf8Drop:
+		return "", false
+	default:
+		return strings.ToValidUTF8(string(value), string(utf8.RuneError)), true
+	}
+}
+
 func resolveTimestamp(outputRecord LogRecord, inputTimestamp interface{}) (interface{}, error) {
 	if val, ok := outputRecord["timestamp"]; ok {
 		return val, nil
@@ -98,6 +220,9 @@ func resolveTimestamp(outputRecord LogRecord, inputTimestamp interface{}) (inter
 	// The timestamp field is allocated in the first position of that nested array: [[TIMESTAMP, METADATA], MESSAGE]
 	// https://docs.fluentbit.io/manual/concepts/key-concepts#event-format
 	case []interface{}:
+		if len(inputTimestamp.([]interface{})) == 0 {
+			return 0, errors.New("empty event header")
+		}
 		return resolveTimestamp(outputRecord, inputTimestamp.([]interface{})[0])
 	default:
 		// Unhandled timestamp type, just ignore (don't log, since I assume we'll fill up someone's disk)
@@ -105,8 +230,48 @@ func resolveTimestamp(outputRecord LogRecord, inputTimestamp interface{}) (inter
 	}
 }
 
+// mergeEventMetadata adds the metadata of a Fluent Bit v2 event ([[TIMESTAMP, METADATA], MESSAGE]) into the record,
+// prefixing each metadata key with the provided prefix. Existing attributes are never overwritten.
+func mergeEventMetadata(outputRecord LogRecord, inputTimestamp interface{}, prefix string, parser valueParser) {
+	event, ok := inputTimestamp.([]interface{})
+	if !ok || len(event) < 2 {
+		return
+	}
+
+	metadata, ok := parser.parseValue(event[1]).(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for k, v := range metadata {
+		key := prefix + k
+		if _, exists := outputRecord[key]; !exists {
+			outputRecord[key] = v
+		}
+	}
+}
+
+// PackagingStats describes the payloads resulting from packaging an array of LogRecords
+type PackagingStats struct {
+	// UncompressedBytes is the size of the encoded records included in the payloads
+	UncompressedBytes int
+	// CompressedBytes is the size of the payloads
+	CompressedBytes int
+	// DiscardedRecords is the number of records that couldn't be compressed below the maximum payload size
+	DiscardedRecords int
+}
+
+// CompressionRatio returns the ratio between the uncompressed and the compressed size of the payloads, or 0 if
+// there are no payloads
+func (stats PackagingStats) CompressionRatio() float64 {
+	if stats.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(stats.UncompressedBytes) / float64(stats.CompressedBytes)
+}
+
 // PackageRecords gets an array of LogRecords and returns them as an array of PackagedRecords
-// (byte buffers), ready to be sent to NewRelic.
+// (byte buffers), ready to be sent to NewRelic. The default level of the compression codec is used.
 //
 // If any record exceeds 1MB after being compressed, then it does not get included in the final result
 // and the resulting compressed array is split at the  point where that long record was present.
@@ -116,82 +281,117 @@ func resolveTimestamp(outputRecord LogRecord, inputTimestamp interface{}) (inter
 //	INPUT: [shortRecord, longRecord, shortRecord2, shortRecord3]
 //	OUTPUT: [GZIP(JSON(shortRecord)), GZIP(JSON(shortRecord2, shortRecord3))]
 func PackageRecords(records []LogRecord, compressionType config.CompressionType) (ret []PackagedRecords, err error) {
-	if len(records) == 0 {
-		return []PackagedRecords{}, nil
+	ret, _, err = PackageRecordsWithStats(records, compressionType, 0)
+	return
+}
+
+// PackageRecordsWithStats works as PackageRecords, using the provided compression level (0 being the default level
+// of the codec) and additionally returning the stats of the resulting payloads
+func PackageRecordsWithStats(records []LogRecord, compressionType config.CompressionType, compressionLevel int) (ret []PackagedRecords, stats PackagingStats, err error) {
+	if !isSupportedCompression(compressionType) {
+		if len(records) == 0 {
+			return []PackagedRecords{}, stats, nil
+		}
+		return nil, stats, fmt.Errorf("unknown compression method")
 	}
+	return packageRecords(records, asCompressedJson(compressionType, compressionLevel))
+}
 
-	var compressedData *bytes.Buffer
-	if compressionType == config.Gzip {
-		compressedData, err = asGzipCompressedJson(records)
-	} else if compressionType == config.Zstd {
-		compressedData, err = asZstdCompressedJson(records)
-	} else {
-		err = fmt.Errorf("unknown compression method")
+// PackageEncodedRecords works as PackageRecordsWithStats, with records already encoded as JSON objects (such as the
+// ones returned by TranscodeChunk)
+func PackageEncodedRecords(records []json.RawMessage, compressionType config.CompressionType, compressionLevel int) (ret []PackagedRecords, stats PackagingStats, err error) {
+	if !isSupportedCompression(compressionType) {
+		if len(records) == 0 {
+			return []PackagedRecords{}, stats, nil
+		}
+		return nil, stats, fmt.Errorf("unknown compression method")
 	}
+	return packageRecords(records, asCompressedJsonArray(compressionType, compressionLevel))
+}
+
+// payloadEncoder encodes and compresses an array of records, also returning the size of the encoded records
+// before compression
+type payloadEncoder[T any] func(records []T) (*bytes.Buffer, int, error)
+
+// packageRecords encodes the records into payloads, splitting them in half until each payload is below the
+// maximum packet size
+func packageRecords[T any](records []T, encode payloadEncoder[T]) (ret []PackagedRecords, stats PackagingStats, err error) {
+	if len(records) == 0 {
+		return []PackagedRecords{}, stats, nil
+	}
+
+	compressedData, uncompressedSize, err := encode(records)
 	if err != nil {
-		return nil, err
+		return nil, stats, err
 	}
 	// TODO Check Ian/Brian: I do believe that this should be compresssedData.Len(), let's confirm it before changing.
 	compressedSize := int64(compressedData.Cap())
 	if compressedSize >= maxPacketSize && len(records) == 1 {
 		log.Error("Can't compress record below required maximum packet size and it will be discarded.")
-		return []PackagedRecords{}, nil
+		stats.DiscardedRecords = 1
+		return []PackagedRecords{}, stats, nil
 	} else if compressedSize >= maxPacketSize && len(records) > 1 {
 		log.Debug("Records were too big, splitting in half and retrying compression again.")
-		firstHalf, err := PackageRecords(records[:len(records)/2], compressionType)
+		firstHalf, firstStats, err := packageRecords(records[:len(records)/2], encode)
 		if err != nil {
-			return nil, err
+			return nil, stats, err
 		}
-		secondHalf, err := PackageRecords(records[len(records)/2:], compressionType)
+		secondHalf, secondStats, err := packageRecords(records[len(records)/2:], encode)
 		if err != nil {
-			return nil, err
+			return nil, stats, err
 		}
 
-		return append(firstHalf, secondHalf...), nil
+		stats = PackagingStats{
+			UncompressedBytes: firstStats.UncompressedBytes + secondStats.UncompressedBytes,
+			CompressedBytes:   firstStats.CompressedBytes + secondStats.CompressedBytes,
+			DiscardedRecords:  firstStats.DiscardedRecords + secondStats.DiscardedRecords,
+		}
+		return append(firstHalf, secondHalf...), stats, nil
 	} else {
-		return []PackagedRecords{compressedData}, nil
+		stats.UncompressedBytes = uncompressedSize
+		stats.CompressedBytes = compressedData.Len()
+		return []PackagedRecords{compressedData}, stats, nil
 	}
 }
 
-// asGzipCompressedJson takes an array of LogRecords, encodes them as a JSON array and
-// compresses them into a byte buffer using the GZip compression algorithm.
-func asGzipCompressedJson(records []LogRecord) (*bytes.Buffer, error) {
-	buff := new(bytes.Buffer)
-	data, err := json.Marshal(records)
-	if err != nil {
-		return nil, err
-	}
-	g := gzip.NewWriter(buff)
-	if _, err := g.Write(data); err != nil {
-		return nil, err
-	}
-	if err = g.Flush(); err != nil {
-		return nil, err
-	}
-	if err = g.Close(); err != nil {
-		return nil, err
+// asCompressedJson returns an encoder that encodes an array of LogRecords as a JSON array and compresses it into
+// a byte buffer using the provided compression codec and level. It also returns the size of the JSON array.
+func asCompressedJson(compressionType config.CompressionType, compressionLevel int) payloadEncoder[LogRecord] {
+	return func(records []LogRecord) (*bytes.Buffer, int, error) {
+		encoded := getBuffer()
+		defer putBuffer(encoded)
+		if err := json.NewEncoder(encoded).Encode(records); err != nil {
+			return nil, 0, err
+		}
+		// Unlike json.Marshal, the encoder terminates the array with a newline
+		data := bytes.TrimSuffix(encoded.Bytes(), []byte("\n"))
+		buff, err := compress(data, compressionType, compressionLevel)
+		if err != nil {
+			return nil, 0, err
+		}
+		return buff, len(data), nil
 	}
-	return buff, nil
 }
 
-// asZstdCompressedJson takes an array of LogRecords, encodes them as a JSON array and
-// compresses them into a byte buffer using the Zstd compression algorithm.
-func asZstdCompressedJson(records []LogRecord) (*bytes.Buffer, error) {
-	buff := new(bytes.Buffer)
-	data, err := json.Marshal(records)
-	if err != nil {
-		return nil, err
-	}
-	compressor, err := zstd.NewWriter(buff)
-	if err != nil {
-		return nil, err
-	}
-	if _, err := compressor.Write(data); err != nil {
-		return nil, err
-	}
-	// Close already takes care of flushing the final output
-	if err = compressor.Close(); err != nil {
-		return nil, err
+// asCompressedJsonArray returns an encoder that joins JSON objects into a JSON array and compresses it into a byte
+// buffer using the provided compression codec and level. It also returns the size of the JSON array.
+func asCompressedJsonArray(compressionType config.CompressionType, compressionLevel int) payloadEncoder[json.RawMessage] {
+	return func(records []json.RawMessage) (*bytes.Buffer, int, error) {
+		encoded := getBuffer()
+		defer putBuffer(encoded)
+		encoded.WriteByte('[')
+		for i, record := range records {
+			if i > 0 {
+				encoded.WriteByte(',')
+			}
+			encoded.Write(record)
+		}
+		encoded.WriteByte(']')
+
+		buff, err := compress(encoded.Bytes(), compressionType, compressionLevel)
+		if err != nil {
+			return nil, 0, err
+		}
+		return buff, encoded.Len(), nil
 	}
-	return buff, nil
 }
@@ -3,12 +3,14 @@ package record
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
 	"github.com/klauspost/compress/zstd"
 	"io"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/newrelic/newrelic-fluent-bit-output/config"
@@ -18,6 +20,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 	. "github.com/onsi/gomega"
+	"github.com/ugorji/go/codec"
 )
 
 var _ = Describe("Out New Relic", func() {
@@ -36,10 +39,10 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 			var inputTimestamp interface{}
 			inputTimestamp = output.FLBTime{
-				time.Now(),
+				Time: time.Now(),
 			}
 			inputMap["log"] = "message"
-			foundOutput := RemapRecord(inputMap, inputTimestamp, pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, inputTimestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 			Expect(foundOutput["message"]).To(Equal("message"))
 			Expect(foundOutput["log"]).To(BeNil())
 			Expect(foundOutput["timestamp"]).To(Equal(inputTimestamp.(output.FLBTime).UnixNano() / 1000000))
@@ -56,13 +59,13 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 			var inputTimestamp interface{}
 			inputTimestamp = output.FLBTime{
-				time.Now(),
+				Time: time.Now(),
 			}
 			expectedType := "something"
 			inputMap["plugin"] = map[string]string{
 				"type": expectedType,
 			}
-			foundOutput := RemapRecord(inputMap, inputTimestamp, pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, inputTimestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 			pluginMap := foundOutput["plugin"].(map[string]string)
 			Expect(pluginMap["type"]).To(Equal(expectedType))
 		})
@@ -71,9 +74,9 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 			var inputTimestamp interface{}
 			inputTimestamp = output.FLBTime{
-				time.Now(),
+				Time: time.Now(),
 			}
-			foundOutput := RemapRecord(inputMap, inputTimestamp, pluginVersion, config.DataFormatConfig{true})
+			foundOutput := RemapRecord(inputMap, inputTimestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: true})
 			Expect(foundOutput["plugin.source"]).To(Equal("BARE-METAL-fb-" + pluginVersion))
 		})
 
@@ -81,16 +84,123 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 			var inputTimestamp interface{}
 			inputTimestamp = output.FLBTime{
-				time.Now(),
+				Time: time.Now(),
 			}
 			expectedSource := "docker"
 			inputMap["log"] = "message"
 			os.Setenv("SOURCE", expectedSource)
-			foundOutput := RemapRecord(inputMap, inputTimestamp, pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, inputTimestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 			pluginMap := foundOutput["plugin"].(map[string]string)
 			Expect(pluginMap["source"]).To(Equal(expectedSource))
 		})
 
+		It("adds the Fluent Bit tag as an attribute when configured", func() {
+			inputMap := FluentBitRecord{"log": "message"}
+
+			foundOutput := RemapRecord(inputMap, nil, "kube.var.log", pluginVersion, config.DataFormatConfig{TagKey: "fb.tag"})
+
+			Expect(foundOutput["fb.tag"]).To(Equal("kube.var.log"))
+		})
+
+		It("doesn't overwrite an existing attribute with the Fluent Bit tag", func() {
+			inputMap := FluentBitRecord{"fb.tag": "original"}
+
+			foundOutput := RemapRecord(inputMap, nil, "kube.var.log", pluginVersion, config.DataFormatConfig{TagKey: "fb.tag"})
+
+			Expect(foundOutput["fb.tag"]).To(Equal("original"))
+		})
+
+		It("doesn't add the Fluent Bit tag unless configured", func() {
+			inputMap := FluentBitRecord{"log": "message"}
+
+			foundOutput := RemapRecord(inputMap, nil, "kube.var.log", pluginVersion, config.DataFormatConfig{})
+
+			Expect(foundOutput).To(HaveLen(2))
+			Expect(foundOutput).To(HaveKey("message"))
+			Expect(foundOutput).To(HaveKey("plugin"))
+		})
+
+		invalidUtf8ActionToExpectedRecord := map[config.InvalidUtf8Action]map[string]interface{}{
+			config.InvalidUtf8Replace: {
+				"valid":  "héllo",
+				"binary": "\uFFFDPNG",
+				"nested": map[string]interface{}{"binary": "\uFFFD"},
+				"array":  []interface{}{"ok", "a\uFFFDb"},
+			},
+			config.InvalidUtf8Base64: {
+				"valid":      "héllo",
+				"binary.b64": "iVBORw==",
+				"nested":     map[string]interface{}{"binary.b64": "/w=="},
+				"array":      []interface{}{"ok", "Yf9i"},
+			},
+			config.InvalidUtf8Drop: {
+				"valid":  "héllo",
+				"nested": map[string]interface{}{},
+				"array":  []interface{}{"ok"},
+			},
+		}
+
+		for action, expected := range invalidUtf8ActionToExpectedRecord {
+			// Lock in current values (otherwise all tests will run with the last values in the map)
+			action, expected := action, expected
+
+			It("handles the byte values that aren't valid UTF-8 with the "+action.String()+" action", func() {
+				inputMap := FluentBitRecord{
+					"valid":  []byte("héllo"),
+					"binary": []byte{0x89, 'P', 'N', 'G'},
+					"nested": map[interface{}]interface{}{"binary": []byte{0xff}},
+					"array":  []interface{}{[]byte("ok"), []byte{'a', 0xff, 'b'}},
+				}
+
+				foundOutput, stats := RemapRecordWithStats(inputMap, nil, "", pluginVersion, config.DataFormatConfig{InvalidUtf8: action})
+
+				delete(foundOutput, "plugin")
+				Expect(foundOutput).To(Equal(LogRecord(expected)))
+				Expect(stats.InvalidUtf8Values).To(Equal(3))
+			})
+		}
+
+		It("stringifies the keys that aren't strings", func() {
+			inputMap := map[interface{}]interface{}{
+				int64(1):  "int",
+				1.5:       "float",
+				true:      "bool",
+				nil:       "nil",
+				"nested":  map[interface{}]interface{}{uint64(2): "uint"},
+				"strings": "untouched",
+			}
+
+			foundOutput := valueParser{}.parseRecord(inputMap)
+
+			Expect(foundOutput).To(Equal(map[string]interface{}{
+				"1":       "int",
+				"1.5":     "float",
+				"true":    "bool",
+				"null":    "nil",
+				"nested":  map[string]interface{}{"2": "uint"},
+				"strings": "untouched",
+			}))
+		})
+
+		It("converts nested timestamps to epoch milliseconds and extension types to readable values", func() {
+			eventTime := output.FLBTime{Time: time.Unix(1700000000, 123456789)}
+			inputMap := map[interface{}]interface{}{
+				"eventTime": eventTime,
+				"time":      []interface{}{time.Unix(1700000001, 0)},
+				"ext":       codec.RawExt{Tag: 5, Data: []byte("ab")},
+				eventTime:   "key",
+			}
+
+			foundOutput := valueParser{}.parseRecord(inputMap)
+
+			Expect(foundOutput).To(Equal(map[string]interface{}{
+				"eventTime":     int64(1700000000123),
+				"time":          []interface{}{int64(1700000001000)},
+				"ext":           map[string]interface{}{"type": uint64(5), "data": "YWI="},
+				"1700000000123": "key",
+			}))
+		})
+
 		It("Correctly massage nested map[interface]interface{} to map[string]interface{}", func() {
 			// Given
 			inputMap := map[interface{}]interface{}{
@@ -101,7 +211,7 @@ var _ = Describe("Out New Relic", func() {
 			}
 
 			// When
-			foundOutput := parseRecord(inputMap)
+			foundOutput := valueParser{}.parseRecord(inputMap)
 
 			// Then
 			expectedOutput := map[string]interface{}{
@@ -129,7 +239,7 @@ var _ = Describe("Out New Relic", func() {
 			}
 
 			// When
-			foundOutput := parseRecord(inputMap)
+			foundOutput := valueParser{}.parseRecord(inputMap)
 
 			// Then
 			expectedOutput := map[string]interface{}{
@@ -152,7 +262,7 @@ var _ = Describe("Out New Relic", func() {
 
 		inputTimestampToExpectedOutput := map[interface{}]int64{
 			// Modern Fluent Bit does uses FLBTime
-			output.FLBTime{time.Unix(1234567890, 123456789)}: 1234567890123,
+			output.FLBTime{Time: time.Unix(1234567890, 123456789)}: 1234567890123,
 
 			// We've seen older of Fluent Bit versions use uint64
 			// (generally being sent in seconds, but we handle other granularities out of paranoia)
@@ -171,7 +281,7 @@ var _ = Describe("Out New Relic", func() {
 				func() {
 					inputMap := make(FluentBitRecord)
 
-					foundOutput := RemapRecord(inputMap, input, pluginVersion, config.DataFormatConfig{false})
+					foundOutput := RemapRecord(inputMap, input, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 
 					Expect(foundOutput["timestamp"]).To(Equal(expected))
 				},
@@ -182,11 +292,11 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 
 			timestamp := []interface{}{
-				output.FLBTime{time.Unix(1234567890, 123456789)},
+				output.FLBTime{Time: time.Unix(1234567890, 123456789)},
 				"Other metadata",
 			}
 
-			foundOutput := RemapRecord(inputMap, timestamp, pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, timestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 
 			Expect(foundOutput["timestamp"]).To(Equal(int64(1234567890123)))
 		})
@@ -199,7 +309,7 @@ var _ = Describe("Out New Relic", func() {
 				"Other metadata",
 			}
 
-			foundOutput := RemapRecord(inputMap, timestamp, pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, timestamp, "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 
 			Expect(foundOutput["timestamp"]).To(Equal(int64(1234567890000)))
 		})
@@ -208,7 +318,7 @@ var _ = Describe("Out New Relic", func() {
 			inputMap := make(FluentBitRecord)
 
 			// We don't handle string types
-			foundOutput := RemapRecord(inputMap, "1234567890", pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, "1234567890", "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 
 			Expect(foundOutput["timestamp"]).To(BeNil())
 		})
@@ -218,12 +328,50 @@ var _ = Describe("Out New Relic", func() {
 		It("Record timestamp has precedence over fluentbit's", func() {
 			inputMap := FluentBitRecord{"timestamp": 654321}
 
-			foundOutput := RemapRecord(inputMap, uint64(1234567890), pluginVersion, config.DataFormatConfig{false})
+			foundOutput := RemapRecord(inputMap, uint64(1234567890), "", pluginVersion, config.DataFormatConfig{LowDataMode: false})
 
 			Expect(foundOutput["timestamp"]).To(Equal(654321))
 		})
 	})
 
+	Describe("Event metadata", func() {
+		event := []interface{}{
+			output.FLBTime{Time: time.Unix(1234567890, 123456789)},
+			map[interface{}]interface{}{
+				"otlp": map[interface{}]interface{}{
+					"severity_text": []byte("INFO"),
+				},
+				"source": "opentelemetry",
+			},
+		}
+
+		It("merges the Fluent Bit event metadata under the configured prefix", func() {
+			inputMap := FluentBitRecord{"metadata.source": "original"}
+			dataFormatConfig := config.DataFormatConfig{IncludeEventMetadata: true, EventMetadataPrefix: "metadata."}
+
+			foundOutput := RemapRecord(inputMap, event, "", pluginVersion, dataFormatConfig)
+
+			Expect(foundOutput["metadata.otlp"]).To(Equal(map[string]interface{}{"severity_text": "INFO"}))
+			Expect(foundOutput["metadata.source"]).To(Equal("original"))
+			Expect(foundOutput["timestamp"]).To(Equal(int64(1234567890123)))
+		})
+
+		It("ignores events without metadata", func() {
+			dataFormatConfig := config.DataFormatConfig{IncludeEventMetadata: true, EventMetadataPrefix: "metadata."}
+
+			foundOutput := RemapRecord(FluentBitRecord{}, event[:1], "", pluginVersion, dataFormatConfig)
+
+			Expect(foundOutput).To(HaveKey("timestamp"))
+			Expect(foundOutput).To(HaveLen(2))
+		})
+
+		It("doesn't merge the Fluent Bit event metadata unless configured", func() {
+			foundOutput := RemapRecord(FluentBitRecord{}, event, "", pluginVersion, config.DataFormatConfig{})
+
+			Expect(foundOutput).NotTo(HaveKey("metadata.source"))
+		})
+	})
+
 	Describe("Record packaging", func() {
 
 		It("returns an empty array of packages if the provided slice is nil", func() {
@@ -385,6 +533,61 @@ var _ = Describe("Out New Relic", func() {
 		})
 	})
 
+	Describe("Packaging stats", func() {
+		It("reports the uncompressed and compressed sizes of the payloads", func() {
+			// Given
+			logRecords := []LogRecord{
+				{
+					"timestamp": 1,
+					"message":   strings.Repeat("Some repetitive message ", 100),
+				},
+			}
+			expectedJson, _ := json.Marshal(logRecords)
+
+			// When
+			packagedRecords, stats, err := PackageRecordsWithStats(logRecords, config.Gzip, 0)
+
+			// Then
+			Expect(err).To(BeNil())
+			Expect(packagedRecords).To(HaveLen(1))
+			Expect(stats.UncompressedBytes).To(Equal(len(expectedJson)))
+			Expect(stats.CompressedBytes).To(Equal(packagedRecords[0].Len()))
+			Expect(stats.DiscardedRecords).To(BeZero())
+			Expect(stats.CompressionRatio()).To(BeNumerically(">", 1))
+		})
+
+		It("counts the records that were discarded for being too large", func() {
+			// Given
+			rand.Seed(1)
+			logRecords := []LogRecord{
+				{
+					"message": "Some message",
+				},
+				{
+					"message": longRandomMessage(2),
+				},
+			}
+
+			// When
+			packagedRecords, stats, err := PackageRecordsWithStats(logRecords, config.Gzip, 0)
+
+			// Then
+			Expect(err).To(BeNil())
+			Expect(packagedRecords).To(HaveLen(1))
+			Expect(stats.DiscardedRecords).To(Equal(1))
+			Expect(stats.CompressedBytes).To(Equal(packagedRecords[0].Len()))
+		})
+
+		It("reports a zero compression ratio when there are no payloads", func() {
+			// When
+			_, stats, err := PackageRecordsWithStats(nil, config.Gzip, 0)
+
+			// Then
+			Expect(err).To(BeNil())
+			Expect(stats.CompressionRatio()).To(BeZero())
+		})
+	})
+
 	Describe("Compression", func() {
 		It("produces compressed Gzip payloads that can be correctly parsed", func() {
 			// Given
@@ -439,6 +642,39 @@ var _ = Describe("Out New Relic", func() {
 			}
 			Expect(uncompressedJson).To(Equal(expectedJson))
 		})
+
+		for _, compressionType := range []config.CompressionType{config.Deflate, config.NoCompression} {
+			// Lock in current value (otherwise all tests will run with the last value)
+			compressionType := compressionType
+
+			It("produces "+compressionType.String()+" payloads that can be correctly parsed", func() {
+				logRecords := []LogRecord{{"timestamp": 1, "message": "Some message 1"}}
+
+				packagedRecords, err := PackageRecords(logRecords, compressionType)
+
+				Expect(err).To(BeNil())
+				Expect(packagedRecords).To(HaveLen(1))
+				uncompressedJson, err := uncompressRecord(packagedRecords[0], compressionType)
+				Expect(err).To(BeNil())
+				Expect(uncompressedJson).To(Equal(`[{"message":"Some message 1","timestamp":1}]`))
+			})
+		}
+
+		It("applies the compression level", func() {
+			words := []string{"GET", "POST", "/api/orders", "/api/users", "200", "404", "500", "checkout", "payments"}
+			random := rand.New(rand.NewSource(1))
+			logRecords := make([]LogRecord, 2000)
+			for i := range logRecords {
+				logRecords[i] = LogRecord{"message": fmt.Sprintf("%s %s %s %d", words[random.Intn(len(words))], words[random.Intn(len(words))], words[random.Intn(len(words))], random.Intn(100000))}
+			}
+
+			_, fastestStats, err := PackageRecordsWithStats(logRecords, config.Gzip, 1)
+			Expect(err).To(BeNil())
+			_, bestStats, err := PackageRecordsWithStats(logRecords, config.Gzip, 9)
+			Expect(err).To(BeNil())
+
+			Expect(bestStats.CompressedBytes).To(BeNumerically("<", fastestStats.CompressedBytes))
+		})
 	})
 })
 
@@ -451,6 +687,10 @@ func uncompressRecord(packagedRecords PackagedRecords, compressionType config.Co
 	} else if compressionType == config.Zstd {
 		decoder, e := zstd.NewReader(&compressedRecords)
 		reader, err = decoder.IOReadCloser(), e
+	} else if compressionType == config.Deflate {
+		reader, err = zlib.NewReader(&compressedRecords)
+	} else if compressionType == config.NoCompression {
+		reader = io.NopCloser(&compressedRecords)
 	} else {
 		return "", fmt.Errorf("Unsupported compression type: %v", compressionType)
 	}
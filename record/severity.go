@@ -0,0 +1,192 @@
+package record
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+)
+
+const (
+	levelKey          = "level"
+	severityNumberKey = "severity.number"
+)
+
+// Attributes where the log level is usually found, in order of precedence
+var severitySourceKeys = []string{"level", "severity", "lvl"}
+
+// Attributes containing a numeric syslog severity (0-7), as reported by journald
+var syslogSeverityKeys = []string{"PRIORITY", "priority"}
+
+// Attribute containing a full syslog priority value (facility * 8 + severity), as reported by the syslog parser
+const syslogPriorityKey = "pri"
+
+// Default mappings from the lower-cased original level to the normalized one
+var defaultSeverityMapping = map[string]string{
+	"trace":         "TRACE",
+	"debug":         "DEBUG",
+	"dbg":           "DEBUG",
+	"info":          "INFO",
+	"information":   "INFO",
+	"informational": "INFO",
+	"notice":        "INFO",
+	"warn":          "WARN",
+	"warning":       "WARN",
+	"error":         "ERROR",
+	"err":           "ERROR",
+	"crit":          "FATAL",
+	"critical":      "FATAL",
+	"alert":         "FATAL",
+	"emerg":         "FATAL",
+	"emergency":     "FATAL",
+	"fatal":         "FATAL",
+	"panic":         "FATAL",
+}
+
+// Syslog severities (RFC 5424), indexed by their numeric value
+var syslogSeverities = []string{"FATAL", "FATAL", "FATAL", "ERROR", "WARN", "INFO", "INFO", "DEBUG"}
+
+// Numeric levels used by bunyan/pino loggers
+var loggerNumericLevels = map[int64]string{
+	10: "TRACE",
+	20: "DEBUG",
+	30: "INFO",
+	40: "WARN",
+	50: "ERROR",
+	60: "FATAL",
+}
+
+// OpenTelemetry severity numbers for each normalized level
+var severityNumbers = map[string]int{
+	"TRACE": 1,
+	"DEBUG": 5,
+	"INFO":  9,
+	"WARN":  13,
+	"ERROR": 17,
+	"FATAL": 21,
+}
+
+var messageLevelPrefix = regexp.MustCompile(`^\s*[\[(<]?(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|CRIT|CRITICAL|FATAL|PANIC)\b`)
+
+// normalizeSeverity sets a consistent "level" attribute (and optionally the "severity.number" attribute)
+// out of the different attributes used by the logging libraries and formats to report the log level.
+// If no level can be found in the attributes, it can optionally be inferred from the message prefix.
+func normalizeSeverity(outputRecord LogRecord, cfg config.SeverityConfig) {
+	level, ok := severityFromAttributes(outputRecord, cfg.Mapping)
+	if !ok && cfg.FromMessage {
+		level, ok = severityFromMessage(outputRecord, cfg.Mapping)
+	}
+	if !ok {
+		return
+	}
+
+	outputRecord[levelKey] = level
+	if number, ok := severityNumbers[level]; ok && cfg.AddNumber {
+		outputRecord[severityNumberKey] = number
+	}
+}
+
+func severityFromAttributes(outputRecord LogRecord, mapping map[string]string) (string, bool) {
+	for _, key := range severitySourceKeys {
+		if val, ok := outputRecord[key]; ok {
+			if level, ok := mapSeverity(val, mapping); ok {
+				return level, true
+			}
+		}
+	}
+
+	for _, key := range syslogSeverityKeys {
+		if number, ok := asInteger(outputRecord[key]); ok && number >= 0 && number < int64(len(syslogSeverities)) {
+			return syslogSeverities[number], true
+		}
+	}
+
+	if number, ok := asInteger(outputRecord[syslogPriorityKey]); ok && number >= 0 {
+		return syslogSeverities[number%8], true
+	}
+
+	return "", false
+}
+
+func severityFromMessage(outputRecord LogRecord, mapping map[string]string) (string, bool) {
+	message, ok := outputRecord["message"].(string)
+	if !ok {
+		return "", false
+	}
+
+	match := messageLevelPrefix.FindStringSubmatch(message)
+	if match == nil {
+		return "", false
+	}
+	return mapSeverity(match[1], mapping)
+}
+
+// mapSeverity normalizes a level, which can be either a string or a numeric (syslog or bunyan/pino) value.
+// User-provided mappings take precedence over the default ones.
+func mapSeverity(value interface{}, mapping map[string]string) (string, bool) {
+	if str, ok := value.(string); ok {
+		key := strings.ToLower(strings.TrimSpace(str))
+		if level, ok := mapping[key]; ok {
+			return level, true
+		}
+		if level, ok := defaultSeverityMapping[key]; ok {
+			return level, true
+		}
+	}
+
+	if number, ok := asInteger(value); ok {
+		if level, ok := mapping[strconv.FormatInt(number, 10)]; ok {
+			return level, true
+		}
+		if number >= 0 && number < int64(len(syslogSeverities)) {
+			return syslogSeverities[number], true
+		}
+		if level, ok := loggerNumericLevels[number]; ok {
+			return level, true
+		}
+	}
+
+	return "", false
+}
+
+// asInteger converts integer values (or strings and floats representing integers) into an int64
+func asInteger(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		// Values above math.MaxInt64 would wrap around to negative numbers
+		if value > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	case float32:
+		return asInteger(float64(value))
+	case float64:
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	case string:
+		number, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,93 @@
+package record
+
+import (
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Severity normalization", func() {
+	const pluginVersion = "0.0.0"
+	severityConfig := config.SeverityConfig{
+		Normalize: true,
+		AddNumber: true,
+	}
+	dataFormatConfig := config.DataFormatConfig{Severity: severityConfig}
+
+	inputToExpectedLevel := map[string]struct {
+		record FluentBitRecord
+		level  string
+	}{
+		"level attribute":                   {FluentBitRecord{"level": "warning"}, "WARN"},
+		"severity attribute":                {FluentBitRecord{"severity": "Error"}, "ERROR"},
+		"lvl attribute":                     {FluentBitRecord{"lvl": "dbg"}, "DEBUG"},
+		"journald PRIORITY":                 {FluentBitRecord{"PRIORITY": "3"}, "ERROR"},
+		"syslog pri":                        {FluentBitRecord{"pri": 134}, "INFO"},
+		"numeric syslog level":              {FluentBitRecord{"level": 4}, "WARN"},
+		"numeric pino level":                {FluentBitRecord{"level": float64(50)}, "ERROR"},
+		"level precedence over PRIORITY":    {FluentBitRecord{"level": "info", "PRIORITY": "3"}, "INFO"},
+		"unknown level falls back to other": {FluentBitRecord{"level": "verbose", "severity": "fatal"}, "FATAL"},
+	}
+
+	for description, testCase := range inputToExpectedLevel {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		input := testCase.record
+		expected := testCase.level
+
+		It("normalizes the level out of the "+description, func() {
+			foundOutput := RemapRecord(input, nil, "", pluginVersion, dataFormatConfig)
+
+			Expect(foundOutput["level"]).To(Equal(expected))
+			Expect(foundOutput["severity.number"]).To(Equal(severityNumbers[expected]))
+		})
+	}
+
+	It("leaves unknown levels untouched", func() {
+		foundOutput := RemapRecord(FluentBitRecord{"level": "verbose"}, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["level"]).To(Equal("verbose"))
+		Expect(foundOutput).NotTo(HaveKey("severity.number"))
+	})
+
+	It("uses the configured mappings before the default ones", func() {
+		cfg := dataFormatConfig
+		cfg.Severity.Mapping = map[string]string{
+			"verbose": "TRACE",
+			"warning": "ERROR",
+		}
+
+		Expect(RemapRecord(FluentBitRecord{"level": "VERBOSE"}, nil, "", pluginVersion, cfg)["level"]).To(Equal("TRACE"))
+		Expect(RemapRecord(FluentBitRecord{"level": "warning"}, nil, "", pluginVersion, cfg)["level"]).To(Equal("ERROR"))
+	})
+
+	It("doesn't add the severity number unless configured", func() {
+		cfg := dataFormatConfig
+		cfg.Severity.AddNumber = false
+
+		foundOutput := RemapRecord(FluentBitRecord{"level": "warning"}, nil, "", pluginVersion, cfg)
+
+		Expect(foundOutput["level"]).To(Equal("WARN"))
+		Expect(foundOutput).NotTo(HaveKey("severity.number"))
+	})
+
+	It("infers the level from the message prefix when configured", func() {
+		cfg := dataFormatConfig
+		cfg.Severity.FromMessage = true
+
+		Expect(RemapRecord(FluentBitRecord{"log": "ERROR something failed"}, nil, "", pluginVersion, cfg)["level"]).To(Equal("ERROR"))
+		Expect(RemapRecord(FluentBitRecord{"log": "[WARN] disk almost full"}, nil, "", pluginVersion, cfg)["level"]).To(Equal("WARN"))
+		Expect(RemapRecord(FluentBitRecord{"log": "Errors happen"}, nil, "", pluginVersion, cfg)).NotTo(HaveKey("level"))
+	})
+
+	It("doesn't infer the level from the message unless configured", func() {
+		foundOutput := RemapRecord(FluentBitRecord{"log": "ERROR something failed"}, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput).NotTo(HaveKey("level"))
+	})
+
+	It("doesn't modify the level when normalization is disabled", func() {
+		foundOutput := RemapRecord(FluentBitRecord{"level": "warning"}, nil, "", pluginVersion, config.DataFormatConfig{})
+
+		Expect(foundOutput["level"]).To(Equal("warning"))
+	})
+})
@@ -0,0 +1,136 @@
+package record
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	traceIdKey = "trace.id"
+	spanIdKey  = "span.id"
+)
+
+// Attributes containing a W3C traceparent header value: version-traceid-parentid-flags
+var traceparentKeys = []string{"traceparent", "traceParent", "Traceparent"}
+
+// Attributes containing a B3 single header value: traceid-spanid[-sampled[-parentspanid]]
+var b3SingleKeys = []string{"b3", "B3"}
+
+// Attributes containing B3 multi header values
+var b3TraceIdKeys = []string{"X-B3-TraceId", "x-b3-traceid", "X-B3-Traceid"}
+var b3SpanIdKeys = []string{"X-B3-SpanId", "x-b3-spanid", "X-B3-Spanid"}
+
+var (
+	traceparentPattern = regexp.MustCompile(`^\s*([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})\s*$`)
+	b3SinglePattern    = regexp.MustCompile(`^\s*([0-9a-f]{16}|[0-9a-f]{32})-([0-9a-f]{16})(-.*)?$`)
+	traceIdPattern     = regexp.MustCompile(`^\s*([0-9a-f]{16}|[0-9a-f]{32})\s*$`)
+	spanIdPattern      = regexp.MustCompile(`^\s*([0-9a-f]{16})\s*$`)
+
+	inlineTraceparentPattern = regexp.MustCompile(`(?i)traceparent["']?\s*[:=]\s*["']?[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\b`)
+	inlineB3SinglePattern    = regexp.MustCompile(`(?i)\bb3["']?\s*[:=]\s*["']?([0-9a-f]{32}|[0-9a-f]{16})-([0-9a-f]{16})\b`)
+	inlineB3TraceIdPattern   = regexp.MustCompile(`(?i)x-b3-traceid["']?\s*[:=]\s*["']?([0-9a-f]{32}|[0-9a-f]{16})\b`)
+	inlineB3SpanIdPattern    = regexp.MustCompile(`(?i)x-b3-spanid["']?\s*[:=]\s*["']?([0-9a-f]{16})\b`)
+)
+
+// extractTraceContext sets the "trace.id" and "span.id" attributes required by New Relic logs-in-context out of
+// W3C traceparent or B3 values, found either in the record attributes or inline in the message. Existing
+// "trace.id" and "span.id" values are left untouched.
+func extractTraceContext(outputRecord LogRecord) {
+	_, hasTraceId := outputRecord[traceIdKey]
+	_, hasSpanId := outputRecord[spanIdKey]
+	if hasTraceId && hasSpanId {
+		return
+	}
+
+	traceId, spanId, ok := traceContextFromAttributes(outputRecord)
+	if !ok {
+		traceId, spanId, ok = traceContextFromMessage(outputRecord)
+	}
+	if !ok {
+		return
+	}
+
+	if !hasTraceId {
+		outputRecord[traceIdKey] = traceId
+	}
+	if !hasSpanId && spanId != "" {
+		outputRecord[spanIdKey] = spanId
+	}
+}
+
+func traceContextFromAttributes(outputRecord LogRecord) (traceId string, spanId string, ok bool) {
+	if value, found := firstString(outputRecord, traceparentKeys); found {
+		if match := traceparentPattern.FindStringSubmatch(strings.ToLower(value)); match != nil && match[1] != "ff" {
+			return validTraceContext(match[2], match[3])
+		}
+	}
+
+	if value, found := firstString(outputRecord, b3SingleKeys); found {
+		if match := b3SinglePattern.FindStringSubmatch(strings.ToLower(value)); match != nil {
+			return validTraceContext(match[1], match[2])
+		}
+	}
+
+	if value, found := firstString(outputRecord, b3TraceIdKeys); found {
+		if match := traceIdPattern.FindStringSubmatch(strings.ToLower(value)); match != nil {
+			spanId := ""
+			if value, found := firstString(outputRecord, b3SpanIdKeys); found {
+				if match := spanIdPattern.FindStringSubmatch(strings.ToLower(value)); match != nil {
+					spanId = match[1]
+				}
+			}
+			return validTraceContext(match[1], spanId)
+		}
+	}
+
+	return "", "", false
+}
+
+func traceContextFromMessage(outputRecord LogRecord) (traceId string, spanId string, ok bool) {
+	message, isString := outputRecord["message"].(string)
+	if !isString {
+		return "", "", false
+	}
+
+	if match := inlineTraceparentPattern.FindStringSubmatch(message); match != nil {
+		return validTraceContext(strings.ToLower(match[1]), strings.ToLower(match[2]))
+	}
+
+	if match := inlineB3SinglePattern.FindStringSubmatch(message); match != nil {
+		return validTraceContext(strings.ToLower(match[1]), strings.ToLower(match[2]))
+	}
+
+	if match := inlineB3TraceIdPattern.FindStringSubmatch(message); match != nil {
+		spanId := ""
+		if spanMatch := inlineB3SpanIdPattern.FindStringSubmatch(message); spanMatch != nil {
+			spanId = strings.ToLower(spanMatch[1])
+		}
+		return validTraceContext(strings.ToLower(match[1]), spanId)
+	}
+
+	return "", "", false
+}
+
+// validTraceContext discards all-zero (invalid) identifiers and left-pads 64-bit B3 trace identifiers to
+// 128 bits, so that the same trace always gets the same trace.id regardless of the propagation format.
+func validTraceContext(traceId string, spanId string) (string, string, bool) {
+	if strings.Trim(traceId, "0") == "" {
+		return "", "", false
+	}
+	if len(traceId) == 16 {
+		traceId = strings.Repeat("0", 16) + traceId
+	}
+	if strings.Trim(spanId, "0") == "" {
+		spanId = ""
+	}
+	return traceId, spanId, true
+}
+
+func firstString(outputRecord LogRecord, keys []string) (string, bool) {
+	for _, key := range keys {
+		if value, ok := outputRecord[key].(string); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
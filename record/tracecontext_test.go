@@ -0,0 +1,86 @@
+package record
+
+import (
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Trace context extraction", func() {
+	const pluginVersion = "0.0.0"
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const spanId = "00f067aa0ba902b7"
+	dataFormatConfig := config.DataFormatConfig{ExtractTraceContext: true}
+
+	inputToExpectedContext := map[string]struct {
+		record  FluentBitRecord
+		traceId string
+		spanId  string
+	}{
+		"traceparent attribute": {
+			FluentBitRecord{"traceparent": "00-" + traceId + "-" + spanId + "-01"}, traceId, spanId,
+		},
+		"B3 single attribute": {
+			FluentBitRecord{"b3": traceId + "-" + spanId + "-1"}, traceId, spanId,
+		},
+		"B3 multi attributes": {
+			FluentBitRecord{"X-B3-TraceId": traceId, "X-B3-SpanId": spanId}, traceId, spanId,
+		},
+		"64-bit B3 trace id": {
+			FluentBitRecord{"X-B3-TraceId": "a3ce929d0e0e4736", "X-B3-SpanId": spanId}, "0000000000000000a3ce929d0e0e4736", spanId,
+		},
+		"inline traceparent": {
+			FluentBitRecord{"log": "request done traceparent=00-" + traceId + "-" + spanId + "-01 status=200"}, traceId, spanId,
+		},
+		"inline B3 single header": {
+			FluentBitRecord{"log": `{"b3": "` + traceId + "-" + spanId + `-1"}`}, traceId, spanId,
+		},
+		"inline B3 multi headers": {
+			FluentBitRecord{"log": "X-B3-TraceId: " + traceId + ", X-B3-SpanId: " + spanId}, traceId, spanId,
+		},
+	}
+
+	for description, testCase := range inputToExpectedContext {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		input := testCase
+		It("extracts the trace context out of a "+description, func() {
+			foundOutput := RemapRecord(input.record, nil, "", pluginVersion, dataFormatConfig)
+
+			Expect(foundOutput["trace.id"]).To(Equal(input.traceId))
+			Expect(foundOutput["span.id"]).To(Equal(input.spanId))
+		})
+	}
+
+	It("leaves existing trace.id and span.id values alone", func() {
+		inputMap := FluentBitRecord{
+			"trace.id":    "existing",
+			"traceparent": "00-" + traceId + "-" + spanId + "-01",
+		}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["trace.id"]).To(Equal("existing"))
+		Expect(foundOutput["span.id"]).To(Equal(spanId))
+	})
+
+	It("ignores invalid identifiers", func() {
+		inputMap := FluentBitRecord{
+			"traceparent": "00-00000000000000000000000000000000-" + spanId + "-01",
+		}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput).NotTo(HaveKey("trace.id"))
+		Expect(foundOutput).NotTo(HaveKey("span.id"))
+	})
+
+	It("doesn't extract the trace context unless configured", func() {
+		inputMap := FluentBitRecord{
+			"traceparent": "00-" + traceId + "-" + spanId + "-01",
+		}
+
+		foundOutput := RemapRecord(inputMap, nil, "", pluginVersion, config.DataFormatConfig{})
+
+		Expect(foundOutput).NotTo(HaveKey("trace.id"))
+	})
+})
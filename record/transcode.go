@@ -0,0 +1,718 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	"github.com/newrelic/newrelic-fluent-bit-output/utils"
+)
+
+// errFallback signals that an event can't be transcoded exactly as RemapRecord would remap it (for instance, because
+// it has extension types, duplicated keys or invalid UTF-8 values), so it must go through the regular path instead
+var errFallback = errors.New("event not supported by the transcoder")
+
+// SupportsTranscoding returns whether the records can be transcoded by TranscodeChunk with the provided configuration.
+// Only the remapping of the log, timestamp and plugin attributes (and the tag attribute) can be applied on the fly:
+// every other feature needs the records as maps.
+func SupportsTranscoding(cfg config.DataFormatConfig) bool {
+	switch cfg.TagKey {
+	case "log", "message", "timestamp", "plugin", "plugin.source":
+		return false
+	}
+	return cfg.FastPath &&
+		!cfg.Severity.Normalize &&
+		!cfg.ExtractTraceContext &&
+		!cfg.ParseNrLinking &&
+		!cfg.IncludeEventMetadata &&
+		len(cfg.Types.Types) == 0
+}
+
+// TranscodeChunk converts the events of a Fluent Bit chunk straight from msgpack into JSON objects, without building
+// any intermediate map. The result is the same as remapping each record with RemapRecord and encoding it with
+// json.Marshal, although the attributes keep the order they had in the chunk. The events that can't be transcoded
+// are remapped with RemapRecord, and decoding stops at the first invalid event, as output.GetRecord does. It also
+// returns the stats of the remapping.
+func TranscodeChunk(chunk []byte, tag string, pluginVersion string, cfg config.DataFormatConfig) ([]json.RawMessage, RemapStats, error) {
+	source, ok := os.LookupEnv("SOURCE")
+	if !ok {
+		source = "BARE-METAL"
+	}
+	t := transcoder{tag: tag, pluginVersion: pluginVersion, source: source, cfg: cfg}
+
+	var out []byte
+	var offsets []int
+	reader := msgpackReader{data: chunk}
+	for reader.pos < len(chunk) {
+		start := reader.pos
+		if err := reader.skip(); err != nil {
+			break
+		}
+		event := chunk[start:reader.pos]
+
+		offsets = append(offsets, len(out))
+		encoded, err := t.appendEvent(out, event)
+		if err == errFallback {
+			encoded, err = t.appendRemappedEvent(out, event)
+		}
+		if err == errInvalidEvent {
+			offsets = offsets[:len(offsets)-1]
+			break
+		}
+		if err != nil {
+			return nil, t.stats, err
+		}
+		out = encoded
+	}
+
+	records := make([]json.RawMessage, len(offsets))
+	for i, offset := range offsets {
+		end := len(out)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		records[i] = out[offset:end:end]
+	}
+	return records, t.stats, nil
+}
+
+// errInvalidEvent signals an event that output.GetRecord can't decode either, which ends the decoding of the chunk
+var errInvalidEvent = errors.New("invalid event")
+
+var messageKey = []byte("message")
+
+type transcoder struct {
+	tag           string
+	pluginVersion string
+	source        string
+	cfg           config.DataFormatConfig
+	// keys holds the keys of the maps being transcoded, to detect duplicated keys
+	keys  [][]byte
+	stats RemapStats
+}
+
+// appendRemappedEvent decodes an event with the Fluent Bit decoder, remaps it with RemapRecord and appends its JSON
+// encoding to dst
+func (t *transcoder) appendRemappedEvent(dst []byte, event []byte) ([]byte, error) {
+	ts, fbRecord, ok := NewEventDecoder(event).Next()
+	if !ok {
+		return nil, errInvalidEvent
+	}
+
+	remapped, stats := RemapRecordWithStats(fbRecord, ts, t.tag, t.pluginVersion, t.cfg)
+	t.stats.InvalidUtf8Values += stats.InvalidUtf8Values
+
+	data, err := json.Marshal(remapped)
+	if err != nil {
+		return nil, fmt.Errorf("encoding record: %v", err)
+	}
+	return append(dst, data...), nil
+}
+
+// appendEvent appends the JSON encoding of a [TIMESTAMP, RECORD] or [[TIMESTAMP, METADATA], RECORD] event to dst,
+// applying the same remapping as RemapRecord
+func (t *transcoder) appendEvent(dst []byte, event []byte) ([]byte, error) {
+	r := msgpackReader{data: event}
+	if n, err := r.readArrayLen(); err != nil || n != 2 {
+		return nil, errFallback
+	}
+	timestamp, err := r.readEventTimestamp()
+	if err != nil {
+		return nil, errFallback
+	}
+	n, err := r.readMapLen()
+	if err != nil {
+		return nil, errFallback
+	}
+
+	// A first pass over the keys tells which attributes are remapped, as the remapping depends on all of them
+	recordStart := r.pos
+	base := len(t.keys)
+	defer func() { t.keys = t.keys[:base] }()
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, errFallback
+		}
+		t.keys = append(t.keys, key)
+		if err := r.skip(); err != nil {
+			return nil, errFallback
+		}
+	}
+	keys := t.keys[base:]
+	if hasDuplicates(keys) {
+		return nil, errFallback
+	}
+	hasLog := containsKey(keys, "log")
+	hasPlugin := containsKey(keys, "plugin")
+	addPluginSource := !hasPlugin && t.cfg.LowDataMode
+
+	r.pos = recordStart
+	dst = append(dst, '{')
+	first := true
+	for i := 0; i < n; i++ {
+		key, _ := r.readString()
+		if (string(key) == "message" && hasLog) || (string(key) == "plugin.source" && addPluginSource) {
+			if err := r.skip(); err != nil {
+				return nil, errFallback
+			}
+			continue
+		}
+		if string(key) == "log" {
+			key = messageKey
+		}
+
+		if !first {
+			dst = append(dst, ',')
+		}
+		first = false
+		dst = appendJsonString(dst, key)
+		dst = append(dst, ':')
+		if dst, err = t.appendValue(dst, &r); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(t.cfg.TagKey) > 0 && !containsKey(keys, t.cfg.TagKey) {
+		dst = appendJsonAttribute(dst, &first, t.cfg.TagKey)
+		dst = appendJsonString(dst, []byte(t.tag))
+	}
+	if !containsKey(keys, "timestamp") {
+		dst = appendJsonAttribute(dst, &first, "timestamp")
+		dst = strconv.AppendInt(dst, timestamp, 10)
+	}
+	if addPluginSource {
+		dst = appendJsonAttribute(dst, &first, "plugin.source")
+		dst = appendJsonString(dst, []byte(t.source+"-fb-"+t.pluginVersion))
+	} else if !hasPlugin {
+		dst = appendJsonAttribute(dst, &first, "plugin")
+		dst = append(dst, `{"source":`...)
+		dst = appendJsonString(dst, []byte(t.source))
+		dst = append(dst, `,"type":"fluent-bit","version":`...)
+		dst = appendJsonString(dst, []byte(t.pluginVersion))
+		dst = append(dst, '}')
+	}
+	return append(dst, '}'), nil
+}
+
+// appendValue appends the JSON encoding of the next msgpack value to dst, encoding it as json.Marshal would encode
+// the value decoded by the Fluent Bit decoder and parsed by parseValue
+func (t *transcoder) appendValue(dst []byte, r *msgpackReader) ([]byte, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return nil, errFallback
+	}
+
+	switch {
+	case b <= 0x7f:
+		return strconv.AppendUint(dst, uint64(b), 10), nil
+	case b >= 0xe0:
+		return strconv.AppendInt(dst, int64(int8(b)), 10), nil
+	case b >= 0xa0 && b <= 0xbf:
+		return t.appendString(dst, r, int(b&0x1f))
+	case b >= 0x90 && b <= 0x9f:
+		return t.appendArray(dst, r, int(b&0x0f))
+	case b >= 0x80 && b <= 0x8f:
+		return t.appendMap(dst, r, int(b&0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return append(dst, "null"...), nil
+	case 0xc2:
+		return append(dst, "false"...), nil
+	case 0xc3:
+		return append(dst, "true"...), nil
+	case 0xc4, 0xd9, 0xc5, 0xda, 0xc6, 0xdb:
+		n, err := r.readLength(b)
+		if err != nil {
+			return nil, errFallback
+		}
+		return t.appendString(dst, r, n)
+	case 0xca:
+		bits, err := r.readUint(4)
+		if err != nil {
+			return nil, errFallback
+		}
+		return appendJsonFloat(dst, float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := r.readUint(8)
+		if err != nil {
+			return nil, errFallback
+		}
+		return appendJsonFloat(dst, math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := r.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, errFallback
+		}
+		return strconv.AppendUint(dst, value, 10), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		value, err := r.readUint(size)
+		if err != nil {
+			return nil, errFallback
+		}
+		// Sign-extend the value from its size
+		shift := 64 - 8*size
+		return strconv.AppendInt(dst, int64(value<<shift)>>shift, 10), nil
+	case 0xdc, 0xdd:
+		n, err := r.readLength(b)
+		if err != nil {
+			return nil, errFallback
+		}
+		return t.appendArray(dst, r, n)
+	case 0xde, 0xdf:
+		n, err := r.readLength(b)
+		if err != nil {
+			return nil, errFallback
+		}
+		return t.appendMap(dst, r, n)
+	}
+
+	// Extension types (such as nested event times) are decoded into types with their own JSON encoding
+	return nil, errFallback
+}
+
+func (t *transcoder) appendString(dst []byte, r *msgpackReader, n int) ([]byte, error) {
+	str, err := r.next(n)
+	if err != nil || !utf8.Valid(str) {
+		return nil, errFallback
+	}
+	return appendJsonString(dst, str), nil
+}
+
+func (t *transcoder) appendArray(dst []byte, r *msgpackReader, n int) ([]byte, error) {
+	var err error
+	dst = append(dst, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		if dst, err = t.appendValue(dst, r); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (t *transcoder) appendMap(dst []byte, r *msgpackReader, n int) ([]byte, error) {
+	base := len(t.keys)
+	defer func() { t.keys = t.keys[:base] }()
+
+	dst = append(dst, '{')
+	for i := 0; i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, errFallback
+		}
+		t.keys = append(t.keys, key)
+
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJsonString(dst, key)
+		dst = append(dst, ':')
+		if dst, err = t.appendValue(dst, r); err != nil {
+			return nil, err
+		}
+	}
+	if hasDuplicates(t.keys[base:]) {
+		return nil, errFallback
+	}
+	return append(dst, '}'), nil
+}
+
+func hasDuplicates(keys [][]byte) bool {
+	if len(keys) > 32 {
+		seen := make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			if _, ok := seen[string(key)]; ok {
+				return true
+			}
+			seen[string(key)] = struct{}{}
+		}
+		return false
+	}
+
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if bytes.Equal(keys[i], keys[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsKey(keys [][]byte, key string) bool {
+	for _, k := range keys {
+		if string(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func appendJsonAttribute(dst []byte, first *bool, key string) []byte {
+	if !*first {
+		dst = append(dst, ',')
+	}
+	*first = false
+	dst = appendJsonString(dst, []byte(key))
+	return append(dst, ':')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJsonString appends a JSON string to dst, escaping it as json.Marshal does: HTML characters are escaped and
+// invalid UTF-8 is replaced by the Unicode replacement character
+func appendJsonString(dst []byte, s []byte) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON, but not valid JavaScript
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// appendJsonFloat appends a float64 to dst using the same format as json.Marshal
+func appendJsonFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		// json.Marshal fails on these, so the regular path reports the error
+		return nil, errFallback
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+var errMsgpack = errors.New("invalid msgpack data")
+
+// msgpackReader reads msgpack values from a byte slice without decoding them into Go values
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errMsgpack
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *msgpackReader) peekByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errMsgpack
+	}
+	return r.data[r.pos], nil
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errMsgpack
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// readUint reads a big-endian unsigned integer of 1, 2, 4 or 8 bytes
+func (r *msgpackReader) readUint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// readLength reads the length following the type byte of the str, bin, array, map and ext formats
+func (r *msgpackReader) readLength(b byte) (int, error) {
+	var size int
+	switch b {
+	case 0xc4, 0xc7, 0xd9:
+		size = 1
+	case 0xc5, 0xc8, 0xda, 0xdc, 0xde:
+		size = 2
+	case 0xc6, 0xc9, 0xdb, 0xdd, 0xdf:
+		size = 4
+	default:
+		return 0, errMsgpack
+	}
+	n, err := r.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)) {
+		return 0, errMsgpack
+	}
+	return int(n), nil
+}
+
+func (r *msgpackReader) readArrayLen() (int, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if b >= 0x90 && b <= 0x9f {
+		return int(b & 0x0f), nil
+	}
+	if b == 0xdc || b == 0xdd {
+		return r.readLength(b)
+	}
+	return 0, errMsgpack
+}
+
+func (r *msgpackReader) readMapLen() (int, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if b >= 0x80 && b <= 0x8f {
+		return int(b & 0x0f), nil
+	}
+	if b == 0xde || b == 0xdf {
+		return r.readLength(b)
+	}
+	return 0, errMsgpack
+}
+
+// readString reads a str or bin value, both of them being decoded as strings by the regular path
+func (r *msgpackReader) readString() ([]byte, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if b >= 0xa0 && b <= 0xbf {
+		return r.next(int(b & 0x1f))
+	}
+	switch b {
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		n, err := r.readLength(b)
+		if err != nil {
+			return nil, err
+		}
+		return r.next(n)
+	}
+	return nil, errMsgpack
+}
+
+// readEventTimestamp reads the timestamp of an event, as an event time or an integer, or the timestamp of the
+// [TIMESTAMP, METADATA] header of the Fluent Bit v2 events, and returns it in milliseconds
+func (r *msgpackReader) readEventTimestamp() (int64, error) {
+	b, err := r.peekByte()
+	if err != nil {
+		return 0, err
+	}
+	if (b >= 0x90 && b <= 0x9f) || b == 0xdc || b == 0xdd {
+		n, err := r.readArrayLen()
+		if err != nil || n < 2 {
+			return 0, errMsgpack
+		}
+		timestamp, err := r.readTimestamp()
+		if err != nil {
+			return 0, err
+		}
+		for i := 1; i < n; i++ {
+			if err := r.skip(); err != nil {
+				return 0, err
+			}
+		}
+		return timestamp, nil
+	}
+	return r.readTimestamp()
+}
+
+// readTimestamp reads an event time or an unsigned integer, the timestamp types supported by output.GetRecord
+func (r *msgpackReader) readTimestamp() (int64, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	// Positive fixints are decoded as int, which output.GetRecord doesn't support, unlike the uint formats
+	switch {
+	case b >= 0xcc && b <= 0xcf:
+		value, err := r.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return 0, err
+		}
+		return utils.TimeToMillis(int64(value)), nil
+	case b == 0xd7 || b == 0xc7:
+		// Event time: fixext 8 (or ext 8 with a length of 8) of type 0, holding the seconds and nanoseconds
+		if b == 0xc7 {
+			if n, err := r.readLength(b); err != nil || n != 8 {
+				return 0, errMsgpack
+			}
+		}
+		extType, err := r.readByte()
+		if err != nil || extType != 0 {
+			return 0, errMsgpack
+		}
+		seconds, err := r.readUint(4)
+		if err != nil {
+			return 0, err
+		}
+		nanoseconds, err := r.readUint(4)
+		if err != nil {
+			return 0, err
+		}
+		return utils.TimeToMillis(time.Unix(int64(seconds), int64(nanoseconds)).UnixNano()), nil
+	}
+	return 0, errMsgpack
+}
+
+// skip moves the reader past the next value
+func (r *msgpackReader) skip() error {
+	for pending := 1; pending > 0; pending-- {
+		b, err := r.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case b <= 0x7f || b >= 0xe0:
+			continue
+		case b >= 0xa0 && b <= 0xbf:
+			_, err = r.next(int(b & 0x1f))
+		case b >= 0x90 && b <= 0x9f:
+			pending += int(b & 0x0f)
+		case b >= 0x80 && b <= 0x8f:
+			pending += 2 * int(b&0x0f)
+		default:
+			err = r.skipFormat(b, &pending)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *msgpackReader) skipFormat(b byte, pending *int) error {
+	switch b {
+	case 0xc0, 0xc2, 0xc3:
+		return nil
+	case 0xcc, 0xd0:
+		_, err := r.next(1)
+		return err
+	case 0xcd, 0xd1:
+		_, err := r.next(2)
+		return err
+	case 0xca, 0xce, 0xd2:
+		_, err := r.next(4)
+		return err
+	case 0xcb, 0xcf, 0xd3:
+		_, err := r.next(8)
+		return err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// fixext: type byte and 1, 2, 4, 8 or 16 bytes of data
+		_, err := r.next(1 + 1<<(b-0xd4))
+		return err
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		n, err := r.readLength(b)
+		if err != nil {
+			return err
+		}
+		_, err = r.next(n)
+		return err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.readLength(b)
+		if err != nil {
+			return err
+		}
+		_, err = r.next(n + 1)
+		return err
+	case 0xdc, 0xdd:
+		n, err := r.readLength(b)
+		if err != nil {
+			return err
+		}
+		*pending += n
+		return nil
+	case 0xde, 0xdf:
+		n, err := r.readLength(b)
+		if err != nil {
+			return err
+		}
+		*pending += 2 * n
+		return nil
+	}
+	return errMsgpack
+}
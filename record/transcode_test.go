@@ -0,0 +1,260 @@
+package record
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ugorji/go/codec"
+)
+
+var _ = Describe("Transcoding", func() {
+	const pluginVersion = "0.0.0"
+	const tag = "kube.logs"
+
+	expectSameAsRemapped := func(chunk []byte, dataFormatConfig config.DataFormatConfig) {
+		transcoded, _, err := TranscodeChunk(chunk, tag, pluginVersion, dataFormatConfig)
+		Expect(err).To(BeNil())
+
+		remapped := remapChunk(chunk, tag, pluginVersion, dataFormatConfig)
+		Expect(transcoded).To(HaveLen(len(remapped)))
+		for i := range remapped {
+			Expect(string(transcoded[i])).To(MatchJSON(remapped[i]))
+		}
+	}
+
+	It("transcodes records as RemapRecord and json.Marshal do", func() {
+		chunk := encodeEvents(
+			[]interface{}{eventTime(1700000000, 123000000), map[string]interface{}{
+				"log":     "Hello <world> & \"friends\"\n\t ",
+				"stream":  "stdout",
+				"int":     42,
+				"neg":     -7,
+				"big":     uint64(math.MaxUint64),
+				"float":   0.1,
+				"tiny":    1e-9,
+				"huge":    1e22,
+				"bool":    true,
+				"null":    nil,
+				"array":   []interface{}{1, "two", 3.5, []interface{}{}, map[string]interface{}{}},
+				"nested":  map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+				"unicode": "héllo 世界",
+			}},
+			[]interface{}{uint64(1700000000), map[string]interface{}{"message": "no log key"}},
+		)
+
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true})
+	})
+
+	It("replaces the message with the log attribute and keeps existing timestamp and plugin attributes", func() {
+		chunk := encodeEvents(
+			[]interface{}{eventTime(1700000000, 0), map[string]interface{}{
+				"log":       "from log",
+				"message":   "from message",
+				"timestamp": 1234,
+				"plugin":    "custom",
+			}},
+		)
+
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true})
+	})
+
+	It("adds the tag and the low data mode plugin attribute", func() {
+		chunk := encodeEvents(
+			[]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a", "plugin.source": "custom"}},
+			[]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "b", "fb.tag": "existing"}},
+		)
+
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true, TagKey: "fb.tag", LowDataMode: true})
+	})
+
+	It("transcodes Fluent Bit v2 events", func() {
+		chunk := encodeEvents(
+			[]interface{}{[]interface{}{eventTime(1700000000, 5000000), map[string]interface{}{"otlp": "metadata"}}, map[string]interface{}{"log": "v2"}},
+		)
+
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true})
+	})
+
+	It("falls back to RemapRecord for the records with extension types, duplicated keys or non-string keys", func() {
+		chunk := encodeEvents(
+			[]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a", "time": eventTime(1700000001, 0)}},
+		)
+		// [uint8(1), {"a": 1, "a": 2, "c": bin("d")}]
+		chunk = append(chunk, 0x92, 0xcc, 0x01, 0x83, 0xa1, 'a', 0x01, 0xa1, 'a', 0x02, 0xa1, 'c', 0xc4, 0x01, 'd')
+		// [eventTime, {"log": "b", 1: "i", true: "t"}]
+		chunk = append(append(chunk, 0x92), encodeEvents(eventTime(1700000000, 0))...)
+		chunk = append(chunk, 0x83, 0xa3, 'l', 'o', 'g', 0xa1, 'b', 0x01, 0xa1, 'i', 0xc3, 0xa1, 't')
+
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true})
+	})
+
+	It("falls back to RemapRecord for the records with invalid UTF-8 values, counting them", func() {
+		chunk := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a", "binary": []byte{0xff, 0xfe}}})
+		dataFormatConfig := config.DataFormatConfig{FastPath: true, InvalidUtf8: config.InvalidUtf8Base64}
+
+		transcoded, stats, err := TranscodeChunk(chunk, tag, pluginVersion, dataFormatConfig)
+
+		Expect(err).To(BeNil())
+		Expect(stats.InvalidUtf8Values).To(Equal(1))
+		Expect(transcoded).To(HaveLen(1))
+		Expect(string(transcoded[0])).To(ContainSubstring(`"binary.b64":"//4="`))
+		expectSameAsRemapped(chunk, dataFormatConfig)
+	})
+
+	It("stops at the first event that can't be decoded", func() {
+		chunk := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "a"}})
+		// [5, {}], whose timestamp type (a positive fixint, decoded as int) isn't supported
+		chunk = append(chunk, 0x92, 0x05, 0x80)
+		chunk = append(chunk, encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"log": "b"}})...)
+
+		transcoded, _, err := TranscodeChunk(chunk, tag, pluginVersion, config.DataFormatConfig{FastPath: true})
+
+		Expect(err).To(BeNil())
+		Expect(transcoded).To(HaveLen(1))
+		expectSameAsRemapped(chunk, config.DataFormatConfig{FastPath: true})
+	})
+
+	It("fails with the values json.Marshal can't encode", func() {
+		chunk := encodeEvents([]interface{}{eventTime(1700000000, 0), map[string]interface{}{"nan": math.NaN()}})
+
+		_, _, err := TranscodeChunk(chunk, tag, pluginVersion, config.DataFormatConfig{FastPath: true})
+
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("escapes strings as json.Marshal does", func() {
+		for _, str := range []string{"plain", "<script>&amp;</script>", "\x00\x01\x1f\x7f", "\b\f\n\r\t\"\\", "\xff\xfeinvalid", "\u2028\u2029", "emoji 😀"} {
+			expected, err := json.Marshal(str)
+			Expect(err).To(BeNil())
+			Expect(string(appendJsonString(nil, []byte(str)))).To(Equal(string(expected)))
+		}
+	})
+
+	It("formats floats as json.Marshal does", func() {
+		for _, f := range []float64{0, -0.5, 0.1, 1e-7, 123456789.125, 1e20, 1e21, -3.4e-10, math.MaxFloat64} {
+			expected, err := json.Marshal(f)
+			Expect(err).To(BeNil())
+			formatted, err := appendJsonFloat(nil, f)
+			Expect(err).To(BeNil())
+			Expect(string(formatted)).To(Equal(string(expected)))
+		}
+	})
+
+	configToSupported := map[string]struct {
+		dataFormatConfig config.DataFormatConfig
+		supported        bool
+	}{
+		"pass-through":           {config.DataFormatConfig{FastPath: true, LowDataMode: true, TagKey: "fb.tag"}, true},
+		"disabled fast path":     {config.DataFormatConfig{}, false},
+		"remapped tag key":       {config.DataFormatConfig{FastPath: true, TagKey: "log"}, false},
+		"severity normalization": {config.DataFormatConfig{FastPath: true, Severity: config.SeverityConfig{Normalize: true}}, false},
+		"trace context":          {config.DataFormatConfig{FastPath: true, ExtractTraceContext: true}, false},
+		"NR-LINKING":             {config.DataFormatConfig{FastPath: true, ParseNrLinking: true}, false},
+		"event metadata":         {config.DataFormatConfig{FastPath: true, IncludeEventMetadata: true}, false},
+		"type coercion":          {config.DataFormatConfig{FastPath: true, Types: config.TypesConfig{Types: map[string]config.AttributeType{"a": config.IntType}}}, false},
+	}
+
+	for description, testCase := range configToSupported {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		testCase := testCase
+
+		It("decides whether to transcode the records with "+description, func() {
+			Expect(SupportsTranscoding(testCase.dataFormatConfig)).To(Equal(testCase.supported))
+		})
+	}
+})
+
+// encodeEvents encodes the events as a Fluent Bit chunk
+func encodeEvents(events ...interface{}) []byte {
+	var data []byte
+	encoder := codec.NewEncoderBytes(&data, new(codec.MsgpackHandle))
+	for _, event := range events {
+		Expect(encoder.Encode(event)).To(Succeed())
+	}
+	return data
+}
+
+// eventTime returns the msgpack extension used by Fluent Bit to encode timestamps
+func eventTime(seconds, nanoseconds uint32) codec.RawExt {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, seconds)
+	binary.BigEndian.PutUint32(data[4:], nanoseconds)
+	return codec.RawExt{Tag: 0, Data: data}
+}
+
+// remapChunk decodes and remaps the records of a chunk as the plugin does when the records aren't transcoded,
+// returning their JSON encoding
+func remapChunk(chunk []byte, tag string, pluginVersion string, dataFormatConfig config.DataFormatConfig) []string {
+	var records []string
+	dec := NewEventDecoder(chunk)
+	for {
+		ts, fbRecord, ok := dec.Next()
+		if !ok {
+			return records
+		}
+		data, err := json.Marshal(RemapRecord(fbRecord, ts, tag, pluginVersion, dataFormatConfig))
+		Expect(err).To(BeNil())
+		records = append(records, string(data))
+	}
+}
+
+// realisticEvents encodes the records built by realisticChunk as the events of a Fluent Bit chunk, as they are
+// received from the tail input
+func realisticEvents(size int) []byte {
+	var data []byte
+	encoder := codec.NewEncoderBytes(&data, new(codec.MsgpackHandle))
+	for _, logRecord := range realisticChunk(1, size) {
+		logRecord["log"] = logRecord["message"]
+		delete(logRecord, "message")
+		delete(logRecord, "timestamp")
+		delete(logRecord, "plugin")
+		if err := encoder.Encode([]interface{}{eventTime(1700000000, 0), map[string]interface{}(logRecord)}); err != nil {
+			panic(err)
+		}
+	}
+	return data
+}
+
+func BenchmarkRemapAndPackageChunk(b *testing.B) {
+	chunk := realisticEvents(2000)
+	dataFormatConfig := config.DataFormatConfig{FastPath: true}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var records []LogRecord
+		dec := NewEventDecoder(chunk)
+		for {
+			ts, fbRecord, ok := dec.Next()
+			if !ok {
+				break
+			}
+			records = append(records, RemapRecord(fbRecord, ts, "tag", "0.0.0", dataFormatConfig))
+		}
+		if _, _, err := PackageRecordsWithStats(records, config.Gzip, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTranscodeAndPackageChunk(b *testing.B) {
+	chunk := realisticEvents(2000)
+	dataFormatConfig := config.DataFormatConfig{FastPath: true}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		records, _, err := TranscodeChunk(chunk, "tag", "0.0.0", dataFormatConfig)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := PackageEncodedRecords(records, config.Gzip, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
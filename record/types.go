@@ -0,0 +1,179 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+)
+
+const rawSuffix = "_raw"
+
+// coerceTypes converts the values of the configured attributes to their type. The values that can't be converted
+// are handled according to the configured failure action.
+func coerceTypes(outputRecord LogRecord, cfg config.TypesConfig) {
+	for key, attributeType := range cfg.Types {
+		parent, name, found := lookupParent(outputRecord, key)
+		if !found {
+			continue
+		}
+
+		value := parent[name]
+		if coerced, ok := coerceValue(value, attributeType); ok {
+			parent[name] = coerced
+			continue
+		}
+
+		switch cfg.OnFailure {
+		case config.CoercionDrop:
+			delete(parent, name)
+		case config.CoercionRaw:
+			delete(parent, name)
+			parent[name+rawSuffix] = value
+		}
+	}
+}
+
+// lookupParent returns the map holding an attribute and its name in that map, following the same rules as
+// LookupAttribute
+func lookupParent(logRecord LogRecord, key string) (map[string]interface{}, string, bool) {
+	if _, ok := logRecord[key]; ok {
+		return logRecord, key, true
+	}
+
+	var current map[string]interface{} = logRecord
+	for {
+		i := strings.IndexByte(key, '.')
+		if i < 0 {
+			return nil, "", false
+		}
+		nested, ok := current[key[:i]].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		if _, ok := nested[key[i+1:]]; ok {
+			return nested, key[i+1:], true
+		}
+		current, key = nested, key[i+1:]
+	}
+}
+
+func coerceValue(value interface{}, attributeType config.AttributeType) (interface{}, bool) {
+	switch attributeType {
+	case config.IntType:
+		return coerceInt(value)
+	case config.FloatType:
+		return coerceFloat(value)
+	case config.BoolType:
+		return coerceBool(value)
+	case config.StringType:
+		return coerceString(value)
+	case config.DurationType:
+		return coerceDuration(value)
+	}
+	return value, false
+}
+
+func coerceInt(value interface{}) (interface{}, bool) {
+	if number, ok := asInteger(value); ok {
+		return number, true
+	}
+
+	// Strings such as "500.0", only if they represent an integral value so that no information is lost
+	if str, ok := value.(string); ok {
+		number, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err == nil && number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 {
+			return int64(number), true
+		}
+	}
+	return value, false
+}
+
+func coerceFloat(value interface{}) (interface{}, bool) {
+	if number, ok := AsFloat(value); ok {
+		return number, true
+	}
+	return value, false
+}
+
+// AsFloat converts numbers and numeric strings into a float64, failing if the result isn't finite (e.g. "NaN" or
+// "+Inf")
+func AsFloat(value interface{}) (float64, bool) {
+	var number float64
+	switch value := value.(type) {
+	case float64:
+		number = value
+	case float32:
+		number = float64(value)
+	case uint:
+		number = float64(value)
+	case uint64:
+		// Values above math.MaxInt64 aren't an int64 but they are still numbers
+		number = float64(value)
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, false
+		}
+		number = parsed
+	default:
+		integer, ok := asInteger(value)
+		if !ok {
+			return 0, false
+		}
+		number = float64(integer)
+	}
+	return number, !math.IsNaN(number) && !math.IsInf(number, 0)
+}
+
+func coerceBool(value interface{}) (interface{}, bool) {
+	switch value := value.(type) {
+	case bool:
+		return value, true
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return value, false
+		}
+		return b, true
+	}
+	if number, ok := asInteger(value); ok && (number == 0 || number == 1) {
+		return number == 1, true
+	}
+	return value, false
+}
+
+func coerceString(value interface{}) (interface{}, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case nil:
+		return value, false
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return value, false
+		}
+		return string(data), true
+	}
+	return fmt.Sprint(value), true
+}
+
+// coerceDuration converts Go duration strings (such as 1.5s or 250ms) to milliseconds. Numbers are assumed to
+// already be milliseconds.
+func coerceDuration(value interface{}) (interface{}, bool) {
+	str, ok := value.(string)
+	if !ok {
+		return coerceFloat(value)
+	}
+
+	duration, err := time.ParseDuration(strings.TrimSpace(str))
+	if err != nil {
+		return coerceFloat(value)
+	}
+	return float64(duration) / float64(time.Millisecond), true
+}
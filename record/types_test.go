@@ -0,0 +1,113 @@
+package record
+
+import (
+	"math"
+
+	"github.com/newrelic/newrelic-fluent-bit-output/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Type coercion", func() {
+	const pluginVersion = "0.0.0"
+
+	inputToExpectedValue := map[string]struct {
+		value         interface{}
+		attributeType config.AttributeType
+		expected      interface{}
+		ok            bool
+	}{
+		"int from string":                {"500", config.IntType, int64(500), true},
+		"int from integral float string": {"500.0", config.IntType, int64(500), true},
+		"int from non-integral float":    {1.5, config.IntType, 1.5, false},
+		"int from text":                  {"five", config.IntType, "five", false},
+		"int from uint64 above int64":    {uint64(math.MaxUint64), config.IntType, uint64(math.MaxUint64), false},
+		"int from float above int64":     {1e19, config.IntType, 1e19, false},
+		"float from uint64 above int64":  {uint64(math.MaxUint64), config.FloatType, float64(math.MaxUint64), true},
+		"float from string":              {" 0.25 ", config.FloatType, 0.25, true},
+		"float from int":                 {3, config.FloatType, float64(3), true},
+		"float from NaN":                 {"NaN", config.FloatType, "NaN", false},
+		"float from Infinity":            {"+Infinity", config.FloatType, "+Infinity", false},
+		"float from infinite float":      {math.Inf(-1), config.FloatType, math.Inf(-1), false},
+		"float from uint":                {uint(7), config.FloatType, float64(7), true},
+		"bool from string":               {"true", config.BoolType, true, true},
+		"bool from int":                  {0, config.BoolType, false, true},
+		"bool from text":                 {"maybe", config.BoolType, "maybe", false},
+		"string from int":                {404, config.StringType, "404", true},
+		"string from map":                {map[string]interface{}{"a": "b"}, config.StringType, `{"a":"b"}`, true},
+		"duration from Go duration":      {"1.5s", config.DurationType, float64(1500), true},
+		"duration from milliseconds":     {"250", config.DurationType, float64(250), true},
+		"duration from text":             {"slow", config.DurationType, "slow", false},
+	}
+
+	for description, testCase := range inputToExpectedValue {
+		// Lock in current values (otherwise all tests will run with the last values in the map)
+		testCase := testCase
+
+		It("coerces the "+description, func() {
+			coerced, ok := coerceValue(testCase.value, testCase.attributeType)
+
+			Expect(ok).To(Equal(testCase.ok))
+			Expect(coerced).To(Equal(testCase.expected))
+		})
+	}
+
+	It("converts only the finite numbers and numeric strings to float", func() {
+		for _, value := range []interface{}{1.5, float32(1.5), "1.5", " 1.5 ", "15e-1"} {
+			number, ok := AsFloat(value)
+			Expect(ok).To(BeTrue(), "%#v", value)
+			Expect(number).To(Equal(1.5), "%#v", value)
+		}
+		for _, value := range []interface{}{int8(-2), uint64(2), "2"} {
+			number, ok := AsFloat(value)
+			Expect(ok).To(BeTrue(), "%#v", value)
+			Expect(math.Abs(number)).To(Equal(float64(2)), "%#v", value)
+		}
+		for _, value := range []interface{}{"NaN", "Inf", "-inf", "+Infinity", "1e400", math.NaN(), math.Inf(1), "five", true, nil} {
+			_, ok := AsFloat(value)
+			Expect(ok).To(BeFalse(), "%#v", value)
+		}
+	})
+
+	It("coerces top-level and nested attributes", func() {
+		input := FluentBitRecord{
+			"status":    []byte("500"),
+			"http.code": "404",
+			"request":   map[interface{}]interface{}{"size": "1024"},
+		}
+		dataFormatConfig := config.DataFormatConfig{Types: config.TypesConfig{Types: map[string]config.AttributeType{
+			"status":       config.IntType,
+			"http.code":    config.IntType,
+			"request.size": config.IntType,
+			"missing":      config.IntType,
+		}}}
+
+		foundOutput := RemapRecord(input, nil, "", pluginVersion, dataFormatConfig)
+
+		Expect(foundOutput["status"]).To(Equal(int64(500)))
+		Expect(foundOutput["http.code"]).To(Equal(int64(404)))
+		Expect(foundOutput["request"]).To(Equal(map[string]interface{}{"size": int64(1024)}))
+		Expect(foundOutput).NotTo(HaveKey("missing"))
+	})
+
+	failureActionToExpectedRecord := map[config.CoercionFailureAction]LogRecord{
+		config.CoercionKeep: {"status": "unknown"},
+		config.CoercionDrop: {},
+		config.CoercionRaw:  {"status_raw": "unknown"},
+	}
+
+	for action, expected := range failureActionToExpectedRecord {
+		action, expected := action, expected
+
+		It("handles the values that can't be coerced with the "+action.String()+" action", func() {
+			logRecord := LogRecord{"status": "unknown"}
+
+			coerceTypes(logRecord, config.TypesConfig{
+				Types:     map[string]config.AttributeType{"status": config.IntType},
+				OnFailure: action,
+			})
+
+			Expect(logRecord).To(Equal(expected))
+		})
+	}
+})
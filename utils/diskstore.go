@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskStore stores data in the files of a directory, up to a maximum total size. Each piece of data is stored in its
+// own file, named <unix nanos>-<sequence>-<suffix><extension>, so that the lexicographical order of the names is the
+// order in which they were written. Files stored by a previous execution count towards the maximum size until they
+// are removed.
+type DiskStore struct {
+	mu        sync.Mutex
+	dir       string
+	extension string
+	maxBytes  int64
+	size      int64
+	seq       uint64
+}
+
+func NewDiskStore(dir string, extension string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can't create directory %s: %v", dir, err)
+	}
+
+	s := &DiskStore{
+		dir:       dir,
+		extension: extension,
+		maxBytes:  maxBytes,
+	}
+
+	files, err := s.Files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			s.size += info.Size()
+		}
+	}
+
+	return s, nil
+}
+
+// Write stores the data in a new file, whose name ends with the suffix and the extension of the store. It fails if
+// storing it would exceed the maximum size.
+func (s *DiskStore) Write(suffix string, data []byte) error {
+	return s.WriteAll([]string{suffix}, [][]byte{data})
+}
+
+// WriteAll stores each piece of data in a new file, as Write does, with the suffix at the same index. Either all of
+// them are stored or none: it fails without writing anything if they would exceed the maximum size, and removes the
+// files already written if writing any of them fails.
+func (s *DiskStore) WriteAll(suffixes []string, data [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, d := range data {
+		total += int64(len(d))
+	}
+	if s.size+total > s.maxBytes {
+		return fmt.Errorf("directory %s is full (%d bytes)", s.dir, s.size)
+	}
+
+	written := make([]string, 0, len(data))
+	for i, d := range data {
+		s.seq++
+		name := fmt.Sprintf("%020d-%d-%s%s", time.Now().UnixNano(), s.seq, suffixes[i], s.extension)
+		path := filepath.Join(s.dir, name)
+		if err := os.WriteFile(path, d, 0600); err != nil {
+			// A partially written file is removed as well
+			os.Remove(path)
+			for _, w := range written {
+				os.Remove(w)
+			}
+			return fmt.Errorf("can't write %s: %v", name, err)
+		}
+		written = append(written, path)
+	}
+	s.size += total
+
+	return nil
+}
+
+// Files returns the paths of the stored files, from the oldest to the newest one
+func (s *DiskStore) Files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+s.extension))
+	if err != nil {
+		return nil, fmt.Errorf("can't list directory %s: %v", s.dir, err)
+	}
+	// File names start with a zero-padded timestamp, so the lexicographical order is the insertion order
+	sort.Strings(files)
+	return files, nil
+}
+
+// Remove deletes a file returned by Files, releasing its size
+func (s *DiskStore) Remove(file string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("can't remove %s: %v", file, err)
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("can't remove %s: %v", file, err)
+	}
+	s.size -= info.Size()
+	return nil
+}
+
+// Size returns the total size of the stored files
+func (s *DiskStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Suffix returns the suffix given to Write when storing a file returned by Files
+func (s *DiskStore) Suffix(file string) string {
+	parts := strings.SplitN(strings.TrimSuffix(filepath.Base(file), s.extension), "-", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
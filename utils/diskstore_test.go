@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DiskStore", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = os.MkdirTemp("", "nr-diskstore")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("stores the data in order until the directory is full", func() {
+		// The directory is created if it doesn't exist
+		dir := filepath.Join(tempDir, "store")
+		store, err := NewDiskStore(dir, ".data", 10)
+		Expect(err).To(BeNil())
+
+		Expect(store.Write("first", []byte("1234"))).To(Succeed())
+		Expect(store.Write("second-part", []byte("5678"))).To(Succeed())
+		Expect(store.Write("third", []byte("9ab"))).ToNot(Succeed())
+
+		files, err := store.Files()
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(2))
+		Expect(store.Suffix(files[0])).To(Equal("first"))
+		Expect(store.Suffix(files[1])).To(Equal("second-part"))
+		Expect(os.ReadFile(files[1])).To(Equal([]byte("5678")))
+		Expect(store.Size()).To(Equal(int64(8)))
+
+		Expect(store.Remove(files[0])).To(Succeed())
+		Expect(store.Size()).To(Equal(int64(4)))
+		Expect(store.Write("third", []byte("9ab"))).To(Succeed())
+	})
+
+	It("writes all the data or none of it", func() {
+		store, err := NewDiskStore(tempDir, ".data", 10)
+		Expect(err).To(BeNil())
+
+		// Nothing is written when the data doesn't fit
+		Expect(store.WriteAll([]string{"first", "second"}, [][]byte{[]byte("123456"), []byte("123456")})).ToNot(Succeed())
+		Expect(store.Files()).To(BeEmpty())
+		Expect(store.Size()).To(BeZero())
+
+		// The files already written are removed when writing another one fails
+		Expect(store.WriteAll([]string{"first", "missing/second"}, [][]byte{[]byte("1234"), []byte("5678")})).ToNot(Succeed())
+		Expect(store.Files()).To(BeEmpty())
+		Expect(store.Size()).To(BeZero())
+
+		Expect(store.WriteAll([]string{"first", "second"}, [][]byte{[]byte("1234"), []byte("5678")})).To(Succeed())
+		files, err := store.Files()
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(2))
+		Expect(store.Suffix(files[1])).To(Equal("second"))
+		Expect(store.Size()).To(Equal(int64(8)))
+	})
+
+	It("counts the files stored by a previous execution, ignoring other files", func() {
+		store, err := NewDiskStore(tempDir, ".data", 10)
+		Expect(err).To(BeNil())
+		Expect(store.Write("first", []byte("1234"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tempDir, "other.txt"), []byte("123456789"), 0600)).To(Succeed())
+
+		reopened, err := NewDiskStore(tempDir, ".data", 10)
+
+		Expect(err).To(BeNil())
+		Expect(reopened.Size()).To(Equal(int64(4)))
+		Expect(reopened.Files()).To(HaveLen(1))
+	})
+})
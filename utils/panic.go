@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is a panic recovered by CatchPanic
+type PanicError struct {
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// CatchPanic runs f, returning a *PanicError if it panics
+func CatchPanic(f func()) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CatchPanic", func() {
+	It("recovers from panics, keeping their value and stack trace", func() {
+		err := CatchPanic(func() {
+			var m map[string]string
+			m["message"] = "assignment to a nil map"
+		})
+
+		var panicErr *PanicError
+		Expect(errors.As(err, &panicErr)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("assignment to entry in nil map"))
+		Expect(string(panicErr.Stack)).To(ContainSubstring("panic_test.go"))
+
+		Expect(CatchPanic(func() {})).To(BeNil())
+	})
+})